@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// pressurePollInterval is how often -background samples host pressure.
+	pressurePollInterval = 2 * time.Second
+
+	// The workers pause once pressure reaches pausePressure and resume when
+	// it falls below resumePressure; the gap keeps them from flapping.
+	pausePressure  = 20.0
+	resumePressure = 5.0
+)
+
+// pressureSource reports how loaded the host is, as a percentage, with a
+// short description of what was measured.
+type pressureSource interface {
+	pressure() (float64, string, bool)
+}
+
+// pressureMonitor pauses the scan while the host is under pressure. The
+// workers call wait between batches of lines and block while it is paused.
+type pressureMonitor struct {
+	src pressureSource
+
+	mu     sync.Mutex
+	resume chan struct{} // non-nil while paused, closed on resume
+}
+
+func newPressureMonitor(src pressureSource) *pressureMonitor {
+	return &pressureMonitor{src: src}
+}
+
+// run samples the source until ctx is done.
+func (m *pressureMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(pressurePollInterval)
+	defer ticker.Stop()
+	for {
+		m.update()
+		select {
+		case <-ctx.Done():
+			m.setPaused(false)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *pressureMonitor) update() {
+	p, what, ok := m.src.pressure()
+	if !ok {
+		return
+	}
+
+	m.mu.Lock()
+	paused := m.resume != nil
+	m.mu.Unlock()
+	switch {
+	case !paused && p >= pausePressure:
+		logf("host under pressure (%s %s%%), pausing workers\n", what, formatFloat(p))
+		m.setPaused(true)
+	case paused && p < resumePressure:
+		logf("pressure eased (%s %s%%), resuming workers\n", what, formatFloat(p))
+		m.setPaused(false)
+	}
+}
+
+func (m *pressureMonitor) setPaused(paused bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if paused && m.resume == nil {
+		m.resume = make(chan struct{})
+	} else if !paused && m.resume != nil {
+		close(m.resume)
+		m.resume = nil
+	}
+}
+
+// wait blocks while the monitor is paused.
+func (m *pressureMonitor) wait(ctx context.Context) error {
+	m.mu.Lock()
+	resume := m.resume
+	m.mu.Unlock()
+	if resume == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
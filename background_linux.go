@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// psiSource reads "some avg10" from /proc/pressure/memory and io: the share
+// of the last ten seconds in which at least one task stalled on memory or
+// I/O. The files are kept open and re-read in place, so sampling keeps
+// working after -sandbox drops filesystem access.
+type psiSource struct {
+	files map[string]*os.File
+	buf   []byte
+}
+
+// loadSource is the fallback for kernels without PSI: by how many percent
+// the one-minute load average exceeds the CPU count.
+type loadSource struct {
+	file *os.File
+	buf  []byte
+}
+
+func openPressureSource() (pressureSource, error) {
+	files := make(map[string]*os.File)
+	for _, name := range []string{"memory", "io"} {
+		f, err := os.Open("/proc/pressure/" + name)
+		if err != nil {
+			continue
+		}
+		files[name] = f
+	}
+	if len(files) > 0 {
+		return &psiSource{files: files, buf: make([]byte, 256)}, nil
+	}
+
+	f, err := os.Open("/proc/loadavg")
+	if err != nil {
+		return nil, fmt.Errorf("neither pressure stall information nor load average is available: %v", err)
+	}
+	return &loadSource{file: f, buf: make([]byte, 128)}, nil
+}
+
+func (s *psiSource) pressure() (float64, string, bool) {
+	worst, what, ok := 0.0, "", false
+	for name, f := range s.files {
+		n, err := f.ReadAt(s.buf, 0)
+		if err != nil && err != io.EOF {
+			continue
+		}
+		v, found := psiSomeAvg10(s.buf[:n])
+		if !found {
+			continue
+		}
+		if !ok || v > worst {
+			worst, what, ok = v, name+" pressure", true
+		}
+	}
+	return worst, what, ok
+}
+
+// psiSomeAvg10 extracts avg10 from the "some" line of a PSI file.
+func psiSomeAvg10(data []byte) (float64, bool) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) < 2 || string(fields[0]) != "some" {
+			continue
+		}
+		v, ok := bytes.CutPrefix(fields[1], []byte("avg10="))
+		if !ok {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (s *loadSource) pressure() (float64, string, bool) {
+	n, err := s.file.ReadAt(s.buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, "", false
+	}
+	fields := bytes.Fields(s.buf[:n])
+	if len(fields) == 0 {
+		return 0, "", false
+	}
+	load, err := strconv.ParseFloat(string(fields[0]), 64)
+	if err != nil {
+		return 0, "", false
+	}
+	cpus := float64(runtime.NumCPU())
+	return max(0, 100*(load-cpus)/cpus), "CPU overload", true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openPressureSource() (pressureSource, error) {
+	return nil, errors.New("-background is only supported on Linux")
+}
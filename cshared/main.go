@@ -0,0 +1,108 @@
+//go:build cgo
+
+// Command cshared exposes the counting core to other languages as a C
+// shared library:
+//
+//	go build -buildmode=c-shared -o libipcounter.so ./cshared
+//
+// which also writes libipcounter.h. A counter is a handle to an
+// ipcounter.State; lines are parsed exactly as the CLI parses them with
+// -trim and -ipv6, and serialized counters are the files of -save-state,
+// so they can be merged with the CLI's. A handle must not be used from
+// several threads at once.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"runtime/cgo"
+	"unsafe"
+
+	"ip-addr-counter/ipcounter"
+)
+
+func main() {}
+
+func state(h C.uintptr_t) *ipcounter.State {
+	return cgo.Handle(h).Value().(*ipcounter.State)
+}
+
+// ipc_new returns a counter of keys with the given prefix length (32 for
+// addresses), or 0 if the length is out of range.
+//
+//export ipc_new
+func ipc_new(prefixLen C.int) C.uintptr_t {
+	s, err := ipcounter.NewState(int(prefixLen))
+	if err != nil {
+		return 0
+	}
+	return C.uintptr_t(cgo.NewHandle(s))
+}
+
+// ipc_free releases a counter.
+//
+//export ipc_free
+func ipc_free(h C.uintptr_t) {
+	cgo.Handle(h).Delete()
+}
+
+// ipc_add adds the address on one line of n bytes; it returns 0, or -1 if
+// the line is invalid.
+//
+//export ipc_add
+func ipc_add(h C.uintptr_t, line *C.char, n C.size_t) C.int {
+	if state(h).AddLine(unsafe.Slice((*byte)(unsafe.Pointer(line)), int(n))) != nil {
+		return -1
+	}
+	return 0
+}
+
+// ipc_merge adds src's keys to dst and frees src; it returns 0, or -1 if
+// the counters have different prefix lengths, in which case src is kept.
+//
+//export ipc_merge
+func ipc_merge(dst, src C.uintptr_t) C.int {
+	if state(dst).Merge(state(src)) != nil {
+		return -1
+	}
+	cgo.Handle(src).Delete()
+	return 0
+}
+
+// ipc_cardinality returns the number of distinct keys, IPv4 and IPv6.
+//
+//export ipc_cardinality
+func ipc_cardinality(h C.uintptr_t) C.uint64_t {
+	s := state(h)
+	return C.uint64_t(s.Unique() + s.UniqueIPv6())
+}
+
+// ipc_serialize stores the counter in a buffer allocated with malloc, to
+// be released with free, and its size in *n; it returns NULL on failure.
+//
+//export ipc_serialize
+func ipc_serialize(h C.uintptr_t, n *C.size_t) unsafe.Pointer {
+	var buf bytes.Buffer
+	if _, err := state(h).WriteTo(&buf); err != nil {
+		return nil
+	}
+	*n = C.size_t(buf.Len())
+	return C.CBytes(buf.Bytes())
+}
+
+// ipc_deserialize returns a counter read from n bytes written by
+// ipc_serialize or -save-state, or 0 if they are not a valid state.
+//
+//export ipc_deserialize
+func ipc_deserialize(data unsafe.Pointer, n C.size_t) C.uintptr_t {
+	s, err := ipcounter.ReadState(bytes.NewReader(C.GoBytes(data, C.int(n))))
+	if err != nil {
+		return 0
+	}
+	return C.uintptr_t(cgo.NewHandle(s))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// numberFormat controls how counts, byte sizes and rates are printed in
+// reports. It is set once from flags; there is deliberately no locale
+// detection, so the same flags always give the same output.
+type numberFormat struct {
+	// thousandsSep is inserted between groups of three digits, if set.
+	thousandsSep string
+	// siUnits selects powers of 1000 (kB, MB) instead of 1024 (KiB, MiB).
+	siUnits bool
+	// decimals is the number of decimal places for sizes and rates.
+	decimals int
+}
+
+var numFmt = numberFormat{decimals: 1}
+
+// formatCount formats an integer count. uint64 counts go through
+// FormatUint, as saturated totals such as the -weighted occurrences can
+// exceed MaxInt64.
+func formatCount[T int | int64 | uint64](n T) string {
+	var s string
+	switch n := any(n).(type) {
+	case uint64:
+		s = strconv.FormatUint(n, 10)
+	case int64:
+		s = strconv.FormatInt(n, 10)
+	case int:
+		s = strconv.Itoa(n)
+	}
+	if numFmt.thousandsSep == "" {
+		return s
+	}
+	return groupThousands(s, numFmt.thousandsSep)
+}
+
+func groupThousands(digits, sep string) string {
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	if len(digits) <= 3 {
+		return sign + digits
+	}
+
+	var b strings.Builder
+	b.WriteString(sign)
+	head := len(digits) % 3
+	if head == 0 {
+		head = 3
+	}
+	b.WriteString(digits[:head])
+	for i := head; i < len(digits); i += 3 {
+		b.WriteString(sep)
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
+
+// formatFloat formats f with the configured decimal places and grouping.
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'f', numFmt.decimals, 64)
+	if numFmt.thousandsSep == "" {
+		return s
+	}
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	s = groupThousands(whole, numFmt.thousandsSep)
+	if hasFrac {
+		s += "." + frac
+	}
+	return s
+}
+
+// formatBytes formats a byte size in IEC or SI units.
+func formatBytes(n uint64) string {
+	unit, suffix := uint64(1024), "iB"
+	if numFmt.siUnits {
+		unit, suffix = 1000, "B"
+	}
+	if n < unit {
+		return fmt.Sprintf("%s B", formatCount(n))
+	}
+
+	div, exp := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	prefix := "KMGTPE"[exp : exp+1]
+	if numFmt.siUnits && prefix == "K" {
+		prefix = "k"
+	}
+	return fmt.Sprintf("%s %s%s", formatFloat(float64(n)/float64(div)), prefix, suffix)
+}
+
+func parseUnits(s string) (bool, error) {
+	switch s {
+	case "iec":
+		return false, nil
+	case "si":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown units %q (want iec or si)", s)
+	}
+}
+
+// parseSize parses a byte size such as "512MiB", "1GB" or "4096".
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+
+	num, mult := strings.TrimSpace(s), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * mult, nil
+}
+
+// parseFraction parses "0.1%" or "0.001" into a fraction in (0, 1].
+func parseFraction(s string) (float64, error) {
+	v, percent := strings.CutSuffix(s, "%")
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid fraction %q", s)
+	}
+	if percent {
+		f /= 100
+	}
+	if f <= 0 || f > 1 {
+		return 0, fmt.Errorf("fraction %q out of range", s)
+	}
+	return f, nil
+}
+
+// parseDelimiter parses a -delimiter value: a single byte, or "tab" or
+// "space" (runs of whitespace) for the ones awkward to type.
+func parseDelimiter(s string) (byte, error) {
+	switch s {
+	case "tab", `\t`:
+		return '\t', nil
+	case "space":
+		return ' ', nil
+	}
+	if len(s) != 1 {
+		return 0, fmt.Errorf("invalid delimiter %q: want a single byte, tab or space", s)
+	}
+	return s[0], nil
+}
+
+// parseExtract parses an -extract value: "regex:" and a pattern, or the
+// name of a log format preset.
+func parseExtract(s string) (*regexp.Regexp, error) {
+	if pattern, ok := strings.CutPrefix(s, "regex:"); ok {
+		return regexp.Compile(pattern)
+	}
+	return ipcounter.ExtractPreset(s)
+}
+
+// prefixList is a repeatable flag of comma-separated prefixes; a bare
+// address stands for itself alone.
+type prefixList []netip.Prefix
+
+func (l *prefixList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, len(*l))
+	for i, p := range *l {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *prefixList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(v)
+			if addrErr != nil {
+				return fmt.Errorf("invalid prefix %q", v)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		*l = append(*l, p)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ip-addr-counter/ipcounter"
+)
+
+func TestFormatCount(t *testing.T) {
+	defer func(saved numberFormat) { numFmt = saved }(numFmt)
+	for _, tt := range []struct {
+		sep  string
+		n    any
+		want string
+	}{
+		{"", 0, "0"},
+		{"", int64(-1234), "-1234"},
+		{",", -1234567, "-1,234,567"},
+		{"", uint64(math.MaxInt64) + 1, "9223372036854775808"},
+		{"", uint64(math.MaxUint64), "18446744073709551615"},
+		{",", uint64(math.MaxUint64), "18,446,744,073,709,551,615"},
+	} {
+		numFmt.thousandsSep = tt.sep
+		var got string
+		switch n := tt.n.(type) {
+		case int:
+			got = formatCount(n)
+		case int64:
+			got = formatCount(n)
+		case uint64:
+			got = formatCount(n)
+		}
+		if got != tt.want {
+			t.Errorf("formatCount(%v) with separator %q = %q, want %q", tt.n, tt.sep, got, tt.want)
+		}
+	}
+}
+
+// TestFormatSaturatedOccurrences formats the -weighted total of weights
+// that add up past MaxUint64, where addWeight saturates.
+func TestFormatSaturatedOccurrences(t *testing.T) {
+	defer func(saved numberFormat) { numFmt = saved }(numFmt)
+	numFmt.thousandsSep = ""
+	path := filepath.Join(t.TempDir(), "weighted")
+	input := "10.0.0.1,18446744073709551615\n10.0.0.2,5\n"
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ipcounter.New(ipcounter.WithWeights(true), ipcounter.WithWorkers(1)).Run(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Occurrences != math.MaxUint64 {
+		t.Fatalf("occurrences %d, want the saturated %d", result.Occurrences, uint64(math.MaxUint64))
+	}
+	if got, want := formatCount(result.Occurrences), "18446744073709551615"; got != want {
+		t.Errorf("formatCount(saturated occurrences) = %q, want %q", got, want)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"4096", 4096, true},
+		{"512MiB", 512 << 20, true},
+		{"1 GB", 1e9, true},
+		{"8388607TiB", 8388607 << 40, true},
+		{"9223372036854775807B", math.MaxInt64, true},
+		{"8388608TiB", 0, false},
+		{"99999999999TB", 0, false},
+		{"9223372036854775808", 0, false},
+		{"-1KiB", 0, false},
+		{"1PiB", 0, false},
+	} {
+		got, err := parseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -2,4 +2,14 @@ module ip-addr-counter
 
 go 1.22.1
 
-require golang.org/x/sync v0.8.0
+require (
+	filippo.io/age v1.2.1
+	github.com/klauspost/compress v1.17.11
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/sync v0.8.0
+)
+
+require (
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
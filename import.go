@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// runImport implements the import subcommand: it counts a list of
+// addresses exported by another tool into a state file, as -save-state
+// would, so that it can seed later counts through -merge-state.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.BoolVar(&quiet, "quiet", false, "log nothing but errors")
+	out := fs.String("o", "", "write the state to this file (required)")
+	inputFormat := fs.String("input-format", "text", "list encoding: text (an address per line) or binary4 (packed 4-byte big-endian IPv4 addresses)")
+	workers := fs.Int("workers", 0, "number of scan workers; 0 uses one per CPU")
+	mode := fs.String("mode", "exact", "counting mode: exact or roaring (compressed bitmaps for lists with few distinct addresses)")
+	trim := fs.Bool("trim", false, "also strip surrounding quotes, no-break spaces and byte order marks from each line before parsing")
+	ipv6 := fs.Bool("ipv6", false, "also import IPv6 addresses")
+	mask := fs.Int("mask", 32, "import networks of this prefix length instead of addresses; later runs must count with the same -mask")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [flags] list -o state\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	// Flags may follow the list too, as in "import list.txt -o seed.bm".
+	args = parseInterspersed(fs, args)
+	if len(args) != 1 || *out == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := []ipcounter.Option{
+		ipcounter.WithState(true),
+		ipcounter.WithTrim(*trim),
+		ipcounter.WithIPv6(*ipv6),
+	}
+	numWorkers, err := workerCount(*workers, 0)
+	if err != nil {
+		log.Fatalf("invalid -workers: %v", err)
+	}
+	opts = append(opts, ipcounter.WithWorkers(numWorkers))
+	switch *mode {
+	case "exact":
+	case "roaring":
+		opts = append(opts, ipcounter.WithRoaring(true))
+	default:
+		log.Fatalf("invalid -mode %q: want exact or roaring", *mode)
+	}
+	switch *inputFormat {
+	case "text":
+	case "binary4":
+		opts = append(opts, ipcounter.WithInputFormat(ipcounter.InputBinary4))
+	default:
+		log.Fatalf("invalid -input-format %q: want text or binary4", *inputFormat)
+	}
+	if *mask < 0 || *mask > 32 {
+		log.Fatalf("invalid -mask %d: want a prefix length between 0 and 32", *mask)
+	}
+	opts = append(opts, ipcounter.WithMask(*mask))
+
+	counter := ipcounter.New(opts...)
+	ctx := context.Background()
+	var result *ipcounter.Result
+	if args[0] == "-" {
+		result, err = counter.RunReader(ctx, os.Stdin)
+	} else {
+		result, err = counter.Run(ctx, args[0])
+	}
+	if err != nil {
+		log.Fatalf("failed to import %s: %v", args[0], err)
+	}
+	reportInvalid(result.Invalid)
+	logf("%s: %s unique IPv4, %s unique IPv6\n", args[0], formatCount(result.Unique), formatCount(result.UniqueIPv6))
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("failed to create state file: %v", err)
+	}
+	n, err := result.State.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("failed to write state: %v", err)
+	}
+	logf("state written to %s (%s)\n", *out, formatBytes(uint64(n)))
+}
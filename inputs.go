@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// expandInputs expands the glob patterns among the input arguments, in the
+// order given and with each file listed once. Arguments without glob
+// metacharacters, and URLs, are taken as they are, so that a missing file
+// is reported when it is opened. "-" must be the only input.
+func expandInputs(args []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		if arg == "-" {
+			if len(args) > 1 {
+				return nil, errors.New("stdin (\"-\") cannot be combined with other inputs")
+			}
+			return args, nil
+		}
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") && !ipcounter.IsRemote(arg) {
+			var err error
+			if matches, err = filepath.Glob(arg); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	return files, nil
+}
+
+// labeledInputs is the repeatable -input flag: "path=label" pairs, where
+// path may be a glob pattern.
+type labeledInputs []ipcounter.LabeledFile
+
+func (l *labeledInputs) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, len(*l))
+	for i, f := range *l {
+		s[i] = f.Path + "=" + f.Label
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *labeledInputs) Set(value string) error {
+	i := strings.LastIndexByte(value, '=')
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("want path=label, got %q", value)
+	}
+	paths, err := expandInputs([]string{value[:i]})
+	if err != nil {
+		return err
+	}
+	if paths[0] == "-" {
+		return errors.New("stdin (\"-\") cannot be a labeled input")
+	}
+	for _, path := range paths {
+		*l = append(*l, ipcounter.LabeledFile{Path: path, Label: value[i+1:]})
+	}
+	return nil
+}
+
+// pathList is a repeatable flag of comma-separated paths, each of which may
+// be a glob pattern.
+type pathList []string
+
+func (l *pathList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *pathList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		paths, err := expandInputs([]string{strings.TrimSpace(v)})
+		if err != nil {
+			return err
+		}
+		if paths[0] == "-" {
+			return errors.New("stdin (\"-\") cannot be given here")
+		}
+		*l = append(*l, paths...)
+	}
+	return nil
+}
+
+// readIdentities reads the age identities, one secret key per line as
+// written by age-keygen, from the file at path.
+func readIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
@@ -0,0 +1,70 @@
+package ipcounter
+
+import (
+	"bytes"
+	"io"
+)
+
+// blockLines reads lines in large blocks: it fills its buffer with as much
+// input as fits, hands out the complete lines in it as slices of the buffer,
+// found with bytes.IndexByte, and moves the partial line at its end to the
+// front before reading the next block. The buffer doubles, up to
+// maxReadSize, when a single line does not fit, so that lines are limited
+// alike whichever way an input is read.
+type blockLines struct {
+	r   io.Reader
+	buf []byte
+	// The lines not handed out yet are buf[start:end].
+	start, end int
+	// err is the error that ended the input, returned once the lines
+	// before it are.
+	err error
+}
+
+func newBlockLines(r io.Reader, size int) *blockLines {
+	return &blockLines{r: r, buf: make([]byte, size)}
+}
+
+func (b *blockLines) readLine() ([]byte, error) {
+	for {
+		if i := bytes.IndexByte(b.buf[b.start:b.end], '\n'); i >= 0 {
+			line := b.buf[b.start : b.start+i]
+			b.start += i + 1
+			return line, nil
+		}
+		if b.err != nil {
+			if b.start < b.end {
+				// A last line without a line end.
+				line := b.buf[b.start:b.end]
+				b.start = b.end
+				return line, nil
+			}
+			return nil, b.err
+		}
+		if err := b.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fill moves the partial line to the front of the buffer, growing it if
+// the line fills it, and reads into the rest. It reads once, so that a pipe
+// hands over what it has instead of the scan waiting for a full block;
+// files fill the block in one read.
+func (b *blockLines) fill() error {
+	if b.start == 0 && b.end == len(b.buf) {
+		if len(b.buf) >= maxReadSize {
+			return ErrLineTooLong
+		}
+		grown := make([]byte, min(2*len(b.buf), maxReadSize))
+		copy(grown, b.buf)
+		b.buf = grown
+	}
+	b.end = copy(b.buf, b.buf[b.start:b.end])
+	b.start = 0
+	for n := 0; n == 0 && b.err == nil; {
+		n, b.err = b.r.Read(b.buf[b.end:])
+		b.end += n
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package ipcounter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// chunkCache keeps the counted set and line counts of each chunk in a
+// directory, keyed by a hash of the chunk's bytes, its offsets and the
+// options that change what is counted. A later count of the same input
+// with the same workers reads a cached chunk instead of parsing it again;
+// any change to the bytes of a chunk, including the line it ends with,
+// misses. Entries are never evicted: the directory can be emptied at any
+// time.
+type chunkCache struct {
+	dir          string
+	hits, misses atomic.Int64
+}
+
+// chunkCacheMagic starts every entry. It is followed by the lines, the
+// filtered lines and the occurrences of the chunk (uint64 each), its
+// invalid lines for each of InvalidReasons in order (uint64 each), and the
+// chunk's set as State.WriteTo writes it. Integers are little-endian.
+const chunkCacheMagic = "IPCCHNK2"
+
+// cacheSkipReason returns why a count with o cannot use the chunk cache,
+// or "" if it can: the cache holds sets and line counts, not what the
+// options below need from every line.
+func (o options) cacheSkipReason(in *input) string {
+	switch {
+	case in.remote != nil:
+		return "remote inputs would be downloaded twice to hash their chunks"
+	case o.newHash != nil:
+		return "-hash needs every byte read"
+	case o.segmentSize > 0:
+		return "segment reports need line offsets"
+	case o.recorder != nil || o.invalidSamples > 0:
+		return "recording or sampling invalid lines needs the lines"
+	case o.frequencies || o.topN > 0:
+		return "occurrence counts are not cached"
+	case o.external:
+		return "external sorting keeps no set to cache"
+	}
+	return ""
+}
+
+// chunk counts [startOffset, endOffset) like processChunk, from the cache
+// when it holds the chunk and into the cache when it does not. Failing to
+// store an entry is logged and does not fail the count.
+func (c *chunkCache) chunk(ctx context.Context, in *input, startOffset, endOffset int64, opts options, bitmap []uint64) (*chunkResult, error) {
+	key, err := c.key(in, startOffset, endOffset, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash chunk: %v", err)
+	}
+	path := filepath.Join(c.dir, key)
+	if result, err := readCacheEntry(path, opts, bitmap); err == nil {
+		c.hits.Add(1)
+		if opts.readCounter != nil {
+			opts.readCounter.Add(endOffset - startOffset)
+		}
+		return result, nil
+	}
+
+	c.misses.Add(1)
+	result, err := processChunk(ctx, in, startOffset, endOffset, opts, bitmap)
+	if err != nil {
+		return nil, err
+	}
+	if result.partial {
+		return result, nil
+	}
+	if err := writeCacheEntry(path, result, opts); err != nil {
+		opts.logf("warning: failed to cache chunk [%d, %d): %v\n", startOffset, endOffset, err)
+	}
+	return result, nil
+}
+
+// key hashes what the count of a chunk depends on: the options that change
+// which keys and counts come out of a line, the chunk's offsets, and its
+// bytes from the one before startOffset, which decides whether the first
+// line belongs to the previous chunk, to the line end the last line is
+// finished by.
+func (c *chunkCache) key(in *input, startOffset, endOffset int64, opts options) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %d %d trim=%t weighted=%t field=%d/%q ipv6=%t mask=%#x hll=%d\n",
+		chunkCacheMagic, startOffset, endOffset, opts.trim, opts.weighted, opts.column, opts.delimiter,
+		opts.ipv6, opts.hostMask, opts.hllPrecision)
+	if opts.inputFormat != InputText {
+		fmt.Fprintf(h, "format %d\n", opts.inputFormat)
+	}
+	if opts.extract != nil {
+		fmt.Fprintf(h, "extract %d %q\n", opts.extractGroup, opts.extract.String())
+	}
+	if f := opts.filter; f != nil {
+		fmt.Fprintf(h, "filter %v %v %v %v\n", f.include4, f.exclude4, f.include6, f.exclude6)
+	}
+	if err := hashLines(h, in.file, max(startOffset-1, 0), endOffset); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashLines writes the bytes of r from start to end into h, and on past end
+// up to and including the next line end, or to the end of r.
+func hashLines(h hash.Hash, r io.ReaderAt, start, end int64) error {
+	buf := make([]byte, 1<<20)
+	for off := start; ; {
+		n, err := r.ReadAt(buf, off)
+		data := buf[:n]
+		if off+int64(n) > end {
+			// The last line ends at the first \n from end-1 on.
+			from := max(end-1-off, 0)
+			if i := bytes.IndexByte(data[from:], '\n'); i >= 0 {
+				h.Write(data[:from+int64(i)+1])
+				return nil
+			}
+		}
+		h.Write(data)
+		off += int64(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCacheEntry reads the entry at path into a chunk result, ORing its
+// keys into bitmap for a dense count.
+func readCacheEntry(path string, opts options, bitmap []uint64) (*chunkResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	magic := make([]byte, len(chunkCacheMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != chunkCacheMagic {
+		return nil, fmt.Errorf("%s is not a chunk cache entry", path)
+	}
+	counts := make([]uint64, 3+len(InvalidReasons))
+	if err := binary.Read(br, binary.LittleEndian, counts); err != nil {
+		return nil, err
+	}
+	s, err := ReadState(br)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &chunkResult{
+		lines:       int64(counts[0]),
+		filtered:    int64(counts[1]),
+		occurrences: counts[2],
+		invalid:     make(map[error]int64),
+	}
+	for i, reason := range InvalidReasons {
+		if n := counts[3+i]; n > 0 {
+			result.invalid[reason] = int64(n)
+		}
+	}
+	if opts.ipv6 {
+		result.v6 = s.v6
+	}
+	switch {
+	case s.sketch != nil:
+		result.sketch, result.sketch6 = s.sketch, s.sketch6
+	case opts.roaring:
+		result.sparse = s.v4
+	default:
+		if bitmap == nil {
+			bitmap = make([]uint64, bitmapWords)
+		}
+		orRoaring(bitmap, s.v4, opts.layout)
+		result.bitmap = bitmap
+	}
+	return result, nil
+}
+
+// orRoaring sets the bits of the keys of r in a dense bitmap.
+func orRoaring(bitmap []uint64, r *roaringBitmap, layout Layout) {
+	r.each(func(key uint32) {
+		idx, pos := layout.index(key)
+		bitmap[idx] |= 1 << pos
+	})
+}
+
+// writeCacheEntry stores a chunk result at path, through a temporary file
+// so that a concurrent count never reads half an entry.
+func writeCacheEntry(path string, result *chunkResult, opts options) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	bw := bufio.NewWriter(f)
+	bw.WriteString(chunkCacheMagic)
+	counts := []uint64{uint64(result.lines), uint64(result.filtered), result.occurrences}
+	for _, reason := range InvalidReasons {
+		counts = append(counts, uint64(result.invalid[reason]))
+	}
+	binary.Write(bw, binary.LittleEndian, counts)
+	s := newState(&runResult{
+		bitmap:  result.bitmap,
+		sparse:  result.sparse,
+		v6:      result.v6,
+		sketch:  result.sketch,
+		sketch6: result.sketch6,
+	}, opts)
+	_, err = s.WriteTo(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,72 @@
+package ipcounter
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression is a compressed input format, recognized by its magic bytes.
+// File names are not consulted: a dump named .gz is often not gzipped, and
+// an IP list never starts with any of these bytes.
+type compression int
+
+const (
+	uncompressed compression = iota
+	compressGzip
+	compressBzip2
+	compressZstd
+)
+
+// compressionMagicLen is how many leading bytes detectCompression needs.
+const compressionMagicLen = 4
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+func (c compression) String() string {
+	switch c {
+	case compressGzip:
+		return "gzip"
+	case compressBzip2:
+		return "bzip2"
+	case compressZstd:
+		return "zstd"
+	default:
+		return "uncompressed"
+	}
+}
+
+// detectCompression identifies the format of an input from its first
+// compressionMagicLen bytes.
+func detectCompression(head []byte) compression {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return compressGzip
+	case len(head) >= 4 && bytes.HasPrefix(head, []byte("BZh")) && head[3] >= '1' && head[3] <= '9':
+		return compressBzip2
+	case bytes.HasPrefix(head, zstdMagic):
+		return compressZstd
+	}
+	return uncompressed
+}
+
+// decompress returns the decompressed contents of r, which holds one or
+// more concatenated gzip members, bzip2 streams or zstd frames.
+func decompress(c compression, r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case compressGzip:
+		return gzip.NewReader(r)
+	case compressBzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case compressZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
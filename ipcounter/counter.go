@@ -0,0 +1,911 @@
+// Package ipcounter counts the unique IPv4 addresses in text files with one
+// address per line.
+//
+// The file is split into one chunk per worker, each worker sets the bits of
+// the addresses in its chunk in a dense bitmap covering the whole IPv4 space
+// (512 MiB), and the bitmaps are merged and popcounted at the end. Sorted
+// input is detected and counted in a single pass without a bitmap.
+// RunFiles counts several files, each on its own and all together, and
+// RunLabeled also groups them by label and measures the labels' overlaps.
+//
+// Window counts addresses added one at a time over a sliding time window,
+// for long-running processes.
+package ipcounter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// cancelCheckLines is how many lines a worker reads between checks of the
+// context and calls to the throttle.
+const cancelCheckLines = 1 << 16
+
+// Counter counts unique addresses. Options given to New apply to every
+// count; options given to Count or Run are applied after them.
+type Counter struct {
+	opts []Option
+}
+
+// New returns a Counter with the given default options.
+func New(opts ...Option) *Counter {
+	return &Counter{opts: opts}
+}
+
+// Result is the outcome of counting one input.
+type Result struct {
+	// Unique is the number of distinct IPv4 addresses, or of distinct
+	// networks with WithMask.
+	Unique uint64
+	// UniqueIPv6 is the number of distinct IPv6 addresses; 0 unless
+	// WithIPv6 is set.
+	UniqueIPv6 uint64
+	// Lines is the number of lines read, valid or not.
+	Lines int64
+	// Bytes is the size of the input as read, before decompression.
+	Bytes int64
+	// Occurrences is the number of valid lines, or the sum of their counts
+	// with WithWeights, left out the ones Filtered counts.
+	Occurrences uint64
+	// Frequencies maps each IPv4 address (or network, with WithMask) to
+	// how often it occurred, summing counts with WithWeights; nil unless
+	// WithFrequencies is set.
+	Frequencies map[uint32]uint64
+	// Top lists the WithTopN most frequent addresses (or networks), most
+	// frequent first; TopApproximate is set when their counts are
+	// estimates.
+	Top            []TopEntry
+	TopApproximate bool
+	// Filtered is the number of valid lines whose address the CIDR filters
+	// left out; see WithIncludeCIDR and WithExcludeCIDR.
+	Filtered int64
+	// Invalid counts the lines that failed to parse by reason, one of
+	// InvalidReasons.
+	Invalid map[error]int64
+	// InvalidSamples holds the first WithInvalidSamples lines that failed
+	// to parse, in input order; nil for the total of RunFiles.
+	InvalidSamples []InvalidLine
+	// Partial is set when WithStop stopped the count early; Covered is then
+	// how many bytes of the input, decompressed, were counted.
+	Partial bool
+	Covered int64
+	// Sorted is set when the input was sorted and counted without a bitmap.
+	Sorted bool
+	// Digest is the tree hash of the input; nil unless WithHash is set.
+	Digest []byte
+	// Segments is nil unless WithSegmentSize is set.
+	Segments []Segment
+	// Approximate is set when Unique and UniqueIPv6 are HyperLogLog
+	// estimates; see WithHyperLogLog.
+	Approximate bool
+	// Summary describes the IPv4 set for comparison with other runs; nil
+	// unless WithSummary is set and the count was exact.
+	Summary *SetSummary
+	// State is the counted set for merging with later counts; nil unless
+	// WithState is set.
+	State *State
+	// SpotCheck is nil unless WithSpotCheck is set and a bitmap was built
+	// from a file; a stream cannot be re-read.
+	SpotCheck *SpotCheck
+}
+
+// Count returns the number of unique addresses in the file at path, IPv4
+// and IPv6 together.
+func (c *Counter) Count(ctx context.Context, path string, opts ...Option) (uint64, error) {
+	result, err := c.Run(ctx, path, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return result.Unique + result.UniqueIPv6, nil
+}
+
+// Run counts the file at path and returns everything the options asked for.
+// When ctx is cancelled, the workers stop and Run returns ctx.Err(). Paths
+// that cannot be split into chunks, such as FIFOs, are read like RunReader
+// reads a stream.
+func (c *Counter) Run(ctx context.Context, path string, opts ...Option) (*Result, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	return withExternalSet(o, func(o options) (*Result, error) {
+		res, _, err := runFile(ctx, path, o)
+		return res, err
+	})
+}
+
+// runFile is Run with the options applied. It also returns the counted set,
+// for RunFiles to merge.
+func runFile(ctx context.Context, path string, o options) (*Result, *runResult, error) {
+	if IsRemote(path) {
+		return runRemote(ctx, path, o)
+	}
+	if why, ok := streamReason(path); ok {
+		o.logf("warning: %s %s, reading it as a single stream\n", path, why)
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open input file: %v", err)
+		}
+		defer file.Close()
+		o.directIO = false
+		result, err := runStream(ctx, file, -1, o)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newResult(result, o), result, nil
+	}
+
+	// Age files cannot be split into chunks; see decrypt. Neither can
+	// packet captures, whose records follow one another, nor compressed
+	// binary input, which runCompressed would split at line ends.
+	c, err := fileCompression(path)
+	compressed := err == nil && c != uncompressed
+	if encrypted, err := fileEncrypted(path); o.pcap != 0 || compressed && o.inputFormat == InputBinary4 || err == nil && encrypted {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open input file: %v", err)
+		}
+		defer file.Close()
+		fi, err := file.Stat()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to stat input file: %v", err)
+		}
+		o.directIO, o.mmap = false, false
+		result, err := runStream(ctx, file, fi.Size(), o)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newResult(result, o), result, nil
+	}
+
+	if compressed {
+		result, err := runCompressed(ctx, path, c, o)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newResult(result, o), result, nil
+	}
+
+	if o.autoIO {
+		chooseIO(path, &o)
+	}
+	in, err := openInput(path, o)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open input file: %v", err)
+	}
+	defer in.Close()
+
+	if o.preload {
+		if err := preload(ctx, in, o); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if bs, ok := fsBlockSize(path); ok {
+		o.blockSize = bs
+		o.logf("filesystem block size: %s, aligning chunks and reads to it\n", o.formatBytes(uint64(bs)))
+	}
+	return countInput(ctx, in, o)
+}
+
+// countInput counts an opened input in chunks, or by comparing neighbours
+// when it is sorted.
+func countInput(ctx context.Context, in *input, o options) (*Result, *runResult, error) {
+	var err error
+	if o.recordPath != "" {
+		o.recorder, err = createInvalidRecorder(o.recordPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create invalid-line recording: %v", err)
+		}
+		defer o.recorder.Close()
+	}
+
+	if o.cacheDir != "" {
+		if why := o.cacheSkipReason(in); why != "" {
+			o.logf("chunk cache not used: %s\n", why)
+		} else {
+			o.cache = &chunkCache{dir: o.cacheDir}
+		}
+	}
+
+	available, haveAvailable := availableMemory()
+	plan, planErr := planMemory(o.workers, available, haveAvailable, o)
+
+	// The spill file is created up front because beforeScan may forbid
+	// creating files later.
+	var spill *spillFile
+	if planErr == nil && plan.spillSlots > 0 {
+		spill, err = createSpillFile(o.spillDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create spill file: %v", err)
+		}
+		defer spill.Close()
+	}
+
+	if o.beforeScan != nil {
+		if err := o.beforeScan(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	stop := o.startProgress(in.size, o.workers)
+	defer stop()
+
+	var result *runResult
+	var sorted bool
+	if !o.keepSet && o.inputFormat == InputText && looksSorted(in, o) {
+		result, sorted, err = countSorted(ctx, in, o)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("processing failed: %v", err)
+		}
+		if sorted {
+			o.logf("input is sorted: counted by comparing with the previous address, no bitmap allocated\n")
+		} else {
+			o.logf("input sample looked sorted but the input is not, falling back to bitmap counting\n")
+			o.tracker.reset()
+			if o.recorder != nil {
+				if err := o.recorder.reset(); err != nil {
+					return nil, nil, fmt.Errorf("failed to reset invalid-line recording: %v", err)
+				}
+			}
+		}
+	}
+
+	if !sorted {
+		logMemoryPlan(plan, available, haveAvailable, o)
+		if planErr != nil {
+			return nil, nil, fmt.Errorf("not enough memory: %v", planErr)
+		}
+
+		result, err = countBitmap(ctx, in, o, plan, spill)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("processing failed: %v", err)
+		}
+		if o.cache != nil {
+			o.logf("chunk cache: %d of %d chunks reused, %d parsed and stored\n",
+				o.cache.hits.Load(), o.cache.hits.Load()+o.cache.misses.Load(), o.cache.misses.Load())
+		}
+	}
+
+	if o.recorder != nil {
+		if err := o.recorder.Close(); err != nil {
+			return nil, nil, fmt.Errorf("failed to write invalid-line recording: %v", err)
+		}
+	}
+
+	res := newResult(result, o)
+	res.Sorted = sorted
+	if contains := result.contains(o); o.spotCheck > 0 && contains != nil && !result.partial {
+		if res.SpotCheck, err = runSpotCheck(in, o.spotCheck, o, contains); err != nil {
+			return nil, nil, fmt.Errorf("spot check failed: %v", err)
+		}
+	}
+	return res, result, nil
+}
+
+// options applies the Counter's options, then opts.
+func (c *Counter) options(opts []Option) (options, error) {
+	o := defaultOptions()
+	for _, opt := range c.opts {
+		opt(&o)
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o, o.validate()
+}
+
+func newResult(result *runResult, o options) *Result {
+	res := &Result{
+		Unique:      uint64(result.unique),
+		UniqueIPv6:  uint64(len(result.v6)),
+		Lines:       result.lines,
+		Bytes:       result.bytes,
+		Occurrences: result.occurrences,
+		Filtered:    result.filtered,
+		Frequencies: result.frequencies,
+		Invalid:     result.invalid,
+		Approximate: result.sketch != nil,
+		Partial:     result.partial,
+	}
+	if result.partial {
+		res.Covered = result.covered
+	}
+	if len(result.samples) > 0 {
+		res.InvalidSamples = result.samples
+	}
+	if result.sketch6 != nil {
+		res.UniqueIPv6 = result.sketch6.estimate()
+	}
+	if o.newHash != nil {
+		res.Digest = treeDigest(o.newHash, result.digests)
+	}
+	if result.segments != nil {
+		res.Segments = result.segments.summary()
+	}
+	if o.summary {
+		res.Summary = summarize(result, o)
+	}
+	if o.state {
+		res.State = newState(result, o)
+	}
+	switch {
+	case o.topN > 0 && result.frequencies != nil:
+		res.Top = topOf(result.frequencies, o.topN)
+	case result.top != nil:
+		res.Top, res.TopApproximate = result.top.top()
+	}
+	return res
+}
+
+// countBitmap splits the file into one chunk per worker, builds a bitmap per
+// chunk and counts the bits set in their union. When plan asks for spilling,
+// only plan.spillSlots bitmaps exist: workers take one from a pool, write it
+// to spill once their chunk is done and hand it back.
+func countBitmap(ctx context.Context, in *input, opts options, plan memoryPlan, spill *spillFile) (*runResult, error) {
+	numWorkers := opts.workers
+	fileSize := in.size
+	chunkSize := fileSize / int64(numWorkers)
+	if align := opts.chunkAlign(); align > 0 {
+		chunkSize -= chunkSize % align
+	}
+	if opts.inputFormat == InputBinary4 {
+		chunkSize -= chunkSize % binary4RecordSize
+	}
+	offsets := make([]int64, 0, numWorkers+1)
+
+	for i := 0; i < numWorkers; i++ {
+		offsets = append(offsets, int64(i)*chunkSize)
+	}
+
+	offsets = append(offsets, fileSize)
+
+	bitmaps := make([][]uint64, numWorkers)
+	sparse := make([]*roaringBitmap, numWorkers)
+	digests := make([][][]byte, numWorkers)
+	samples := make([][]InvalidLine, numWorkers)
+	v6Sets := make([]ipv6Set, numWorkers)
+	frequencies := make([]frequencyMap, numWorkers)
+	tops := make([]*topCounter, numWorkers)
+	invalid := make(map[error]int64)
+	var occurrences uint64
+	var lines, filtered, covered int64
+	var partial bool
+	var segments *segmentStats
+	var sketch, sketch6 *hyperLogLog
+	var mu sync.Mutex
+	g, ctx := errgroup.WithContext(ctx)
+
+	var pool chan []uint64
+	var preallocated [][]uint64
+	if spill != nil {
+		pool = make(chan []uint64, plan.spillSlots)
+		preallocated = preallocBitmaps(plan.spillSlots, opts)
+		for i := 0; i < plan.spillSlots; i++ {
+			if preallocated != nil {
+				pool <- preallocated[i]
+			} else {
+				pool <- make([]uint64, bitmapWords)
+			}
+		}
+	} else {
+		// One bitmap per worker and the merge target.
+		preallocated = preallocBitmaps(numWorkers+1, opts)
+	}
+
+	for i := 0; i < numWorkers; i++ {
+		i := i
+		g.Go(func() error {
+			var bitmap []uint64
+			if pool != nil {
+				select {
+				case bitmap = <-pool:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				clear(bitmap)
+				defer func() { pool <- bitmap }()
+			} else if preallocated != nil {
+				bitmap = preallocated[i]
+			}
+
+			wopts := opts
+			wopts.readCounter = opts.tracker.worker(i)
+			var result *chunkResult
+			var err error
+			if opts.cache != nil {
+				result, err = opts.cache.chunk(ctx, in, offsets[i], offsets[i+1], wopts, bitmap)
+			} else {
+				result, err = processChunk(ctx, in, offsets[i], offsets[i+1], wopts, bitmap)
+			}
+			if err != nil {
+				return fmt.Errorf("worker %d failed: %v", i, err)
+			}
+
+			if spill != nil {
+				if err := spill.write(i, result.bitmap); err != nil {
+					return fmt.Errorf("worker %d failed to spill its bitmap: %v", i, err)
+				}
+			} else {
+				bitmaps[i] = result.bitmap
+			}
+			sparse[i] = result.sparse
+			digests[i] = result.digests
+			samples[i] = result.samples
+			v6Sets[i] = result.v6
+			frequencies[i] = result.frequencies
+			tops[i] = result.top
+			mu.Lock()
+			occurrences = addWeight(occurrences, result.occurrences)
+			lines += result.lines
+			filtered += result.filtered
+			covered += result.scanned
+			partial = partial || result.partial
+			sketch = mergeSketch(sketch, result.sketch)
+			sketch6 = mergeSketch(sketch6, result.sketch6)
+			if result.segments != nil {
+				if segments == nil {
+					segments = result.segments
+				} else {
+					segments.merge(result.segments)
+				}
+			}
+			for reason, n := range result.invalid {
+				invalid[reason] += n
+			}
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	result := &runResult{
+		lines:       lines,
+		filtered:    filtered,
+		bytes:       fileSize,
+		partial:     partial,
+		covered:     covered,
+		occurrences: occurrences,
+		invalid:     invalid,
+		segments:    segments,
+		sketch:      sketch,
+		sketch6:     sketch6,
+	}
+	if opts.ipv6 && sketch6 == nil {
+		result.v6 = mergeIPv6Sets(v6Sets)
+	}
+	result.frequencies = mergeFrequencies(frequencies)
+	result.top = mergeTop(tops)
+	for _, d := range digests {
+		result.digests = append(result.digests, d...)
+	}
+	// Chunks are in input order, and so are the samples of each.
+	for _, s := range samples {
+		result.samples = append(result.samples, s...)
+	}
+	if len(result.samples) > opts.invalidSamples {
+		result.samples = result.samples[:opts.invalidSamples]
+	}
+
+	switch {
+	case sketch != nil:
+		result.unique = int(sketch.estimate())
+		return result, nil
+	case opts.roaring:
+		result.sparse = mergeRoaring(sparse, opts.mergeWorkers)
+		result.unique = result.sparse.cardinality()
+		return result, nil
+	case opts.external:
+		// The keys are in the partitions, counted by withExternalSet.
+		return result, nil
+	}
+
+	var finalBitmap []uint64
+	if spill != nil {
+		// Reuse one pooled bitmap as the merge target; there is no memory
+		// for another.
+		finalBitmap = <-pool
+		clear(finalBitmap)
+		if err := spill.mergeInto(finalBitmap, numWorkers, opts.mergeWorkers); err != nil {
+			return nil, fmt.Errorf("failed to merge spilled bitmaps: %v", err)
+		}
+	} else if preallocated != nil {
+		finalBitmap = mergeBitmapsInto(preallocated[numWorkers], bitmaps, opts.mergeWorkers)
+	} else {
+		finalBitmap = mergeBitmaps(bitmaps, len(bitmaps[0]), opts.mergeWorkers)
+	}
+
+	result.bitmap = finalBitmap
+	result.unique = countBits(finalBitmap, opts.mergeWorkers)
+	return result, nil
+}
+
+type chunkResult struct {
+	bitmap      []uint64
+	v6          ipv6Set
+	sparse      *roaringBitmap
+	sketch      *hyperLogLog
+	lines       int64
+	filtered    int64
+	sketch6     *hyperLogLog
+	occurrences uint64
+	invalid     map[error]int64
+	samples     []InvalidLine
+	digests     [][]byte
+	segments    *segmentStats
+	frequencies frequencyMap
+	top         *topCounter
+	// partial is set when WithStop stopped the scan after scanned bytes.
+	partial bool
+	scanned int64
+}
+
+// runResult is the outcome of counting one input.
+type runResult struct {
+	unique      int
+	lines       int64
+	filtered    int64
+	bytes       int64
+	occurrences uint64
+	invalid     map[error]int64
+	// samples are the first WithInvalidSamples invalid lines.
+	samples []InvalidLine
+	// partial is set when WithStop stopped the count after covered bytes.
+	partial bool
+	covered int64
+	// digests are the input's hash pieces in file order; nil unless
+	// WithHash is set.
+	digests [][]byte
+	// segments is nil unless WithSegmentSize is set.
+	segments *segmentStats
+	// bitmap is the final merged bitmap, nil for the sorted-input path.
+	bitmap []uint64
+	// v6 holds the IPv6 addresses; nil unless WithIPv6 is set.
+	v6 ipv6Set
+	// sparse replaces bitmap with WithRoaring.
+	sparse *roaringBitmap
+	// frequencies is nil unless WithFrequencies is set, and top unless
+	// WithTopN is set without it.
+	frequencies frequencyMap
+	top         *topCounter
+	// summary is built during the sorted-input pass, which keeps no set.
+	summary *SetSummary
+	// sketch and sketch6 replace bitmap and v6 with WithHyperLogLog.
+	sketch, sketch6 *hyperLogLog
+}
+
+// contains returns a membership test for the counted IPv4 keys, or nil if
+// there is no exact set to test against.
+func (r *runResult) contains(o options) func(ip uint32) bool {
+	switch {
+	case r.bitmap != nil:
+		return func(ip uint32) bool {
+			idx, pos := o.layout.index(ip)
+			return r.bitmap[idx]&(1<<pos) != 0
+		}
+	case r.sparse != nil:
+		return r.sparse.contains
+	}
+	return nil
+}
+
+// newChunkReader wraps the chunk [startOffset, endOffset) of an open input in
+// a line reader, hashing the chunk on the way when opts asks for it.
+func newChunkReader(file io.Reader, startOffset, endOffset int64, readSize int, opts options) (*blockLines, *pieceHasher, io.Reader) {
+	if opts.newHash == nil {
+		return newBlockLines(file, readSize), nil, file
+	}
+	hasher := newPieceHasher(opts.newHash, endOffset-startOffset)
+	src := io.TeeReader(file, hasher)
+	return newBlockLines(src, readSize), hasher, src
+}
+
+// processChunk counts the addresses in [startOffset, endOffset) into bitmap,
+// which must be zeroed, or into a newly allocated bitmap if it is nil. With
+// WithRoaring or WithHyperLogLog, bitmap is nil and stays so.
+func processChunk(ctx context.Context, in *input, startOffset, endOffset int64, opts options, bitmap []uint64) (*chunkResult, error) {
+	if in.data != nil {
+		return processMappedChunk(ctx, in.data, startOffset, endOffset, opts, bitmap)
+	}
+
+	chunk, err := in.openChunk(startOffset)
+	if err != nil {
+		return nil, err
+	}
+	defer chunk.Close()
+	file := countReads(chunk, opts.readCounter)
+
+	if opts.inputFormat == InputBinary4 {
+		return processRecordChunk(ctx, file, startOffset, endOffset, opts, bitmap)
+	}
+
+	readSize := opts.readSize(sampleLineStats(in.file, startOffset))
+	reader, hasher, src := newChunkReader(file, startOffset, endOffset, readSize, opts)
+
+	// A line belongs to the chunk it starts in. Unless the previous chunk
+	// ended exactly at a line boundary, the first bytes here finish a line
+	// owned by the previous chunk.
+	currentOffset := startOffset
+	if startOffset != 0 {
+		var prev [1]byte
+		if _, err := in.file.ReadAt(prev[:], startOffset-1); err != nil {
+			return nil, fmt.Errorf("failed to read chunk boundary: %v", err)
+		}
+		if prev[0] != '\n' {
+			line, err := reader.readLine()
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("failed to discard partial line: %v", err)
+			}
+			currentOffset += int64(len(line)) + 1
+		}
+	}
+
+	if bitmap == nil && opts.dense() {
+		bitmap = make([]uint64, bitmapWords)
+	}
+	result, err := scanLines(ctx, reader, currentOffset, endOffset, opts, bitmap)
+	if err != nil {
+		return nil, err
+	}
+	if hasher != nil {
+		if result.digests, err = hasher.finish(src); err != nil {
+			return nil, fmt.Errorf("failed to hash chunk: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// scanLines counts the lines starting in [offset, endOffset) into bitmap,
+// reader being positioned at offset. With WithRoaring or WithHyperLogLog,
+// bitmap is unused and the addresses go into a new roaring bitmap or new
+// sketches instead.
+func scanLines(ctx context.Context, reader lineReader, offset, endOffset int64, opts options, bitmap []uint64) (*chunkResult, error) {
+	currentOffset := offset
+	invalid := make(map[error]int64)
+	keys := newChunkKeys(opts, bitmap)
+
+	var lines int64
+	var samples []InvalidLine
+	partial := opts.stopped()
+	for currentOffset < endOffset && !partial {
+		line, err := reader.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading line: %v", err)
+		}
+		if lines++; lines%cancelCheckLines == 0 {
+			if err := opts.checkpoint(ctx); err != nil {
+				return nil, err
+			}
+			if partial = opts.stopped(); partial {
+				lines--
+				break
+			}
+		}
+		lineOffset := currentOffset
+		currentOffset += int64(len(line)) + 1
+
+		ipUint32, ip6, weight, err := opts.parseAny(line)
+		if err != nil {
+			invalid[err]++
+			if len(samples) < opts.invalidSamples {
+				samples = append(samples, InvalidLine{lineOffset, bytes.Clone(line), err})
+			}
+			if opts.recorder != nil {
+				if err := opts.recorder.record(lineOffset, line); err != nil {
+					return nil, fmt.Errorf("failed to record invalid line: %v", err)
+				}
+			}
+			continue
+		}
+		if err := keys.add(ipUint32, ip6, weight, lineOffset); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := keys.result()
+	if err != nil {
+		return nil, err
+	}
+	result.partial, result.scanned, result.lines = partial, currentOffset-offset, lines
+	result.invalid, result.samples = invalid, samples
+	return result, nil
+}
+
+// chunkKeys takes the addresses a scan parses: it filters and masks them,
+// adds them to the set of the count and keeps the occurrence, frequency and
+// segment counts the options ask for.
+type chunkKeys struct {
+	opts        options
+	bitmap      []uint64
+	v6          ipv6Set
+	sparse      *roaringBitmap
+	sketch      *hyperLogLog
+	sketch6     *hyperLogLog
+	partitions  *externalWriter
+	frequencies frequencyMap
+	top         *topCounter
+	segments    *segmentStats
+	occurrences uint64
+	filtered    int64
+}
+
+func newChunkKeys(opts options, bitmap []uint64) *chunkKeys {
+	k := &chunkKeys{opts: opts, bitmap: bitmap}
+	if opts.segmentSize > 0 {
+		k.segments = newSegmentStats(opts.segmentSize)
+	}
+	switch {
+	case opts.frequencies:
+		k.frequencies = frequencyMap{}
+	case opts.topN > 0:
+		k.top = newTopCounter(opts.topN)
+	}
+	if opts.roaring {
+		k.sparse = newRoaringBitmap()
+	}
+	switch {
+	case opts.hllPrecision > 0:
+		k.sketch = newHyperLogLog(opts.hllPrecision)
+		if opts.ipv6 {
+			k.sketch6 = newHyperLogLog(opts.hllPrecision)
+		}
+	case opts.ipv6:
+		k.v6 = ipv6Set{}
+	}
+	if opts.partitions != nil {
+		k.partitions = opts.partitions.writer()
+	}
+	return k
+}
+
+// add takes the IPv4 address ip, or ip6 if it is valid, standing for weight
+// occurrences at offset in the input.
+func (k *chunkKeys) add(ip uint32, ip6 netip.Addr, weight uint64, offset int64) error {
+	if weight == 0 {
+		return nil
+	}
+	if k.opts.filtered(ip, ip6) {
+		k.filtered++
+		return nil
+	}
+	k.occurrences = addWeight(k.occurrences, weight)
+	if ip6.IsValid() {
+		if k.sketch6 != nil {
+			k.sketch6.add(hashIPv6(ip6.As16()))
+		} else {
+			k.v6.add(ip6)
+		}
+		return nil
+	}
+
+	ip = k.opts.key(ip)
+	if k.frequencies != nil {
+		k.frequencies.add(ip, weight)
+	}
+	if k.top != nil {
+		k.top.add(ip, weight)
+	}
+	switch {
+	case k.sketch != nil:
+		k.sketch.add(mix64(uint64(ip)))
+	case k.sparse != nil:
+		k.sparse.add(ip)
+	case k.partitions != nil:
+		if err := k.partitions.add(ip); err != nil {
+			return fmt.Errorf("failed to write external sort partition: %v", err)
+		}
+	default:
+		idx, pos := k.opts.layout.index(ip)
+		k.bitmap[idx] |= 1 << pos
+	}
+	if k.segments != nil {
+		k.segments.add(offset, ip)
+	}
+	return nil
+}
+
+// result returns what was taken as a chunk result, for the scan to fill in
+// what it read.
+func (k *chunkKeys) result() (*chunkResult, error) {
+	if k.partitions != nil {
+		if err := k.partitions.flush(); err != nil {
+			return nil, fmt.Errorf("failed to write external sort partition: %v", err)
+		}
+	}
+	return &chunkResult{bitmap: k.bitmap, filtered: k.filtered, occurrences: k.occurrences, segments: k.segments, v6: k.v6, sparse: k.sparse, sketch: k.sketch, sketch6: k.sketch6, frequencies: k.frequencies, top: k.top}, nil
+}
+
+// lineReader yields lines without their \n, and ErrLineTooLong for a line
+// that does not fit its largest buffer. The \r of a \r\n line end is kept, so that
+// a line and its \n always span len(line)+1 bytes of input; the parser
+// strips it with the rest of the surrounding whitespace.
+type lineReader interface {
+	readLine() ([]byte, error)
+}
+
+// mergeBitmaps ORs bitmaps together, splitting the words between
+// mergeWorkers goroutines.
+func mergeBitmaps(bitmaps [][]uint64, bitmapSize int, mergeWorkers int) []uint64 {
+	return mergeBitmapsInto(make([]uint64, bitmapSize), bitmaps, mergeWorkers)
+}
+
+// mergeBitmapsInto is mergeBitmaps into finalBitmap, whose contents are
+// overwritten.
+func mergeBitmapsInto(finalBitmap []uint64, bitmaps [][]uint64, mergeWorkers int) []uint64 {
+	numWorkers := len(bitmaps)
+
+	splitRange(len(finalBitmap), mergeWorkers, func(lo, hi int) error {
+		for i := lo; i < hi; i++ {
+			var word uint64
+			for j := 0; j < numWorkers; j++ {
+				word |= bitmaps[j][i]
+			}
+			finalBitmap[i] = word
+		}
+		return nil
+	})
+
+	return finalBitmap
+}
+
+// countBits returns the number of bits set in bitmap, using up to workers
+// goroutines.
+func countBits(bitmap []uint64, workers int) int {
+	var total atomic.Int64
+	splitRange(len(bitmap), workers, func(lo, hi int) error {
+		n := 0
+		for _, word := range bitmap[lo:hi] {
+			n += bits.OnesCount64(word)
+		}
+		total.Add(int64(n))
+		return nil
+	})
+	return int(total.Load())
+}
+
+// countCommonBits returns the number of bits set in both a and b.
+func countCommonBits(a, b []uint64, workers int) int {
+	var total atomic.Int64
+	splitRange(len(a), workers, func(lo, hi int) error {
+		n := 0
+		for i := lo; i < hi; i++ {
+			n += bits.OnesCount64(a[i] & b[i])
+		}
+		total.Add(int64(n))
+		return nil
+	})
+	return int(total.Load())
+}
+
+// splitRange cuts [0, n) into up to workers contiguous ranges, calls fn on
+// each in its own goroutine and returns the first error.
+func splitRange(n, workers int, fn func(lo, hi int) error) error {
+	workers = max(1, min(workers, n))
+	var g errgroup.Group
+	for w := 0; w < workers; w++ {
+		lo, hi := n*w/workers, n*(w+1)/workers
+		g.Go(func() error { return fn(lo, hi) })
+	}
+	return g.Wait()
+}
@@ -0,0 +1,54 @@
+package ipcounter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// ageMagic starts a binary age file; armored ones start with armor.Header.
+const ageMagic = "age-encryption.org/"
+
+// encryptionMagicLen is how many leading bytes isEncrypted needs.
+const encryptionMagicLen = len(armor.Header)
+
+// isEncrypted reports whether an input starting with head is age-encrypted,
+// binary or armored. Like compression, encryption is recognized by content
+// and not by file name.
+func isEncrypted(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(ageMagic)) || bytes.HasPrefix(head, []byte(armor.Header))
+}
+
+// fileEncrypted reads the start of the file at path to tell whether it is
+// age-encrypted.
+func fileEncrypted(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, encryptionMagicLen)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return isEncrypted(head[:n]), nil
+}
+
+// decrypt returns the plaintext of the age file r with the WithDecryption
+// identities. Age files have no index to seek in, so encrypted inputs are
+// always decrypted and counted as a single stream.
+func (o options) decrypt(r io.Reader, head []byte) (io.Reader, error) {
+	if len(o.identities) == 0 {
+		return nil, fmt.Errorf("input is age-encrypted, but no identities to decrypt it with were given")
+	}
+	if bytes.HasPrefix(head, []byte(armor.Header)) {
+		r = armor.NewReader(r)
+	}
+	return age.Decrypt(r, o.identities...)
+}
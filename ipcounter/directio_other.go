@@ -0,0 +1,19 @@
+//go:build !linux
+
+package ipcounter
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var errNoDirectIO = errors.New("direct I/O is only supported on Linux")
+
+func openDirect(fileName string) (*os.File, error) {
+	return nil, errNoDirectIO
+}
+
+func newDirectReader(file *os.File, offset int64) (io.Reader, error) {
+	return nil, errNoDirectIO
+}
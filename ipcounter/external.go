@@ -0,0 +1,192 @@
+package ipcounter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+const (
+	// externalPartitions splits the IPv4 keys by their top 8 bits, so that
+	// each partition spans 2^24 keys and is deduplicated in a 2 MiB
+	// bitmap.
+	externalPartitions = 256
+	externalSpan       = 1 << 24
+	// externalKeyBytes is the size of a key on disk: its low 24 bits, the
+	// top 8 being the partition's.
+	externalKeyBytes = 3
+	// externalBufferKeys is how many keys a scan buffers per partition
+	// before appending them to the partition file.
+	externalBufferKeys = 4096
+)
+
+// externalBufferBytes is the memory of the partition buffers of one scan.
+const externalBufferBytes = externalPartitions * externalBufferKeys * externalKeyBytes
+
+// externalSet is the set of WithExternalSort: every valid IPv4 key is
+// appended, duplicates and all, to the spill file of its partition, and
+// the partitions are deduplicated one at a time once the input is read.
+// Memory stays at the scan buffers and one 2 MiB bitmap per merge worker
+// however many distinct keys there are, in exchange for three bytes of
+// disk per valid line and a second pass over them.
+type externalSet struct {
+	partitions [externalPartitions]struct {
+		mu   sync.Mutex
+		file *spillFile
+		size int64
+	}
+}
+
+// createExternalSet creates the partition files in dir, unlinked as spill
+// files are.
+func createExternalSet(dir string) (*externalSet, error) {
+	s := &externalSet{}
+	for i := range s.partitions {
+		f, err := createSpillFile(dir)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.partitions[i].file = f
+	}
+	return s, nil
+}
+
+func (s *externalSet) Close() error {
+	var err error
+	for i := range s.partitions {
+		if f := s.partitions[i].file; f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// append adds the keys of one partition, externalKeyBytes each, to its
+// file.
+func (s *externalSet) append(partition int, keys []byte) error {
+	p := &s.partitions[partition]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.file.file.WriteAt(keys, p.size); err != nil {
+		return err
+	}
+	p.size += int64(len(keys))
+	return nil
+}
+
+// externalWriter buffers the keys of one scan for an externalSet.
+type externalWriter struct {
+	set     *externalSet
+	buffers [externalPartitions][]byte
+}
+
+func (s *externalSet) writer() *externalWriter {
+	return &externalWriter{set: s}
+}
+
+func (w *externalWriter) add(key uint32) error {
+	i := key >> 24
+	b := w.buffers[i]
+	if b == nil {
+		b = make([]byte, 0, externalBufferKeys*externalKeyBytes)
+	}
+	b = append(b, byte(key), byte(key>>8), byte(key>>16))
+	if len(b) == cap(b) {
+		if err := w.set.append(int(i), b); err != nil {
+			return err
+		}
+		b = b[:0]
+	}
+	w.buffers[i] = b
+	return nil
+}
+
+// flush appends what is left in the buffers.
+func (w *externalWriter) flush() error {
+	for i, b := range w.buffers {
+		if len(b) > 0 {
+			if err := w.set.append(i, b); err != nil {
+				return err
+			}
+			w.buffers[i] = b[:0]
+		}
+	}
+	return nil
+}
+
+// count deduplicates the partitions, workers at a time, and returns the
+// number of distinct keys.
+func (s *externalSet) count(workers int) (int, error) {
+	counts := make([]int, externalPartitions)
+	err := splitRange(externalPartitions, workers, func(lo, hi int) error {
+		seen := make([]uint64, externalSpan/64)
+		for i := lo; i < hi; i++ {
+			p := &s.partitions[i]
+			r := bufio.NewReaderSize(io.NewSectionReader(p.file.file, 0, p.size), spillBufferSize)
+			var key [externalKeyBytes]byte
+			for {
+				if _, err := io.ReadFull(r, key[:]); err == io.EOF {
+					break
+				} else if err != nil {
+					return fmt.Errorf("failed to read partition %d: %v", i, err)
+				}
+				low := uint32(key[0]) | uint32(key[1])<<8 | uint32(key[2])<<16
+				seen[low/64] |= 1 << (low % 64)
+			}
+			for j, word := range seen {
+				counts[i] += bits.OnesCount64(word)
+				seen[j] = 0
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n, nil
+}
+
+// size returns the bytes written to the partitions.
+func (s *externalSet) size() int64 {
+	var n int64
+	for i := range s.partitions {
+		n += s.partitions[i].size
+	}
+	return n
+}
+
+// withExternalSet creates the partitions of WithExternalSort for one count
+// by run, and replaces the unique count of its result by theirs unless the
+// input was counted as sorted, which needs no set.
+func withExternalSet(o options, run func(o options) (*Result, error)) (*Result, error) {
+	if !o.external {
+		return run(o)
+	}
+	set, err := createExternalSet(o.spillDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create external sort partitions: %v", err)
+	}
+	defer set.Close()
+	o.partitions = set
+
+	res, err := run(o)
+	if err != nil || res.Sorted {
+		return res, err
+	}
+	o.logf("deduplicating %s of partitions in %s\n", o.formatBytes(uint64(set.size())), o.spillDir)
+	unique, err := set.count(o.mergeWorkers)
+	if err != nil {
+		return nil, err
+	}
+	res.Unique = uint64(unique)
+	return res, nil
+}
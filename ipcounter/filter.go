@@ -0,0 +1,92 @@
+package ipcounter
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// cidrFilter decides which parsed addresses are counted: with include
+// prefixes, only those inside one of them, and never those inside an
+// exclude prefix. IPv4 prefixes are kept as ranges so that the common case
+// costs two comparisons per prefix.
+type cidrFilter struct {
+	include4, exclude4 []addrRange
+	include6, exclude6 []netip.Prefix
+}
+
+// addrRange is the IPv4 range [lo, hi].
+type addrRange struct {
+	lo, hi uint32
+}
+
+func (f *cidrFilter) add(p netip.Prefix, include bool) {
+	p = p.Masked()
+	if p.Addr().Is4() {
+		a := p.Addr().As4()
+		lo := binary.BigEndian.Uint32(a[:])
+		r := addrRange{lo, lo | uint32(uint64(1)<<(32-p.Bits())-1)}
+		if include {
+			f.include4 = append(f.include4, r)
+		} else {
+			f.exclude4 = append(f.exclude4, r)
+		}
+		return
+	}
+	if include {
+		f.include6 = append(f.include6, p)
+	} else {
+		f.exclude6 = append(f.exclude6, p)
+	}
+}
+
+func (f *cidrFilter) including() bool {
+	return len(f.include4) > 0 || len(f.include6) > 0
+}
+
+// allows4 reports whether the IPv4 address ip is counted.
+func (f *cidrFilter) allows4(ip uint32) bool {
+	for _, r := range f.exclude4 {
+		if ip >= r.lo && ip <= r.hi {
+			return false
+		}
+	}
+	if !f.including() {
+		return true
+	}
+	for _, r := range f.include4 {
+		if ip >= r.lo && ip <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// allows6 reports whether the IPv6 address ip is counted.
+func (f *cidrFilter) allows6(ip netip.Addr) bool {
+	for _, p := range f.exclude6 {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if !f.including() {
+		return true
+	}
+	for _, p := range f.include6 {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filtered reports whether a parsed line is left out by the CIDR filters;
+// ip6 is valid for IPv6 addresses, otherwise ip holds an IPv4 one.
+func (o options) filtered(ip uint32, ip6 netip.Addr) bool {
+	switch {
+	case o.filter == nil:
+		return false
+	case ip6.IsValid():
+		return !o.filter.allows6(ip6)
+	}
+	return !o.filter.allows4(ip)
+}
@@ -0,0 +1,33 @@
+package ipcounter
+
+// frequencyMap counts how often each IPv4 key occurs, for WithFrequencies.
+// Memory grows with the number of distinct keys, about 40 bytes each.
+type frequencyMap map[uint32]uint64
+
+func (m frequencyMap) add(ip uint32, weight uint64) {
+	m[ip] = addWeight(m[ip], weight)
+}
+
+// mergeFrequencies adds maps into the largest of them and returns it; nil
+// maps are skipped.
+func mergeFrequencies(maps []frequencyMap) frequencyMap {
+	largest := -1
+	for i, m := range maps {
+		if m != nil && (largest < 0 || len(m) > len(maps[largest])) {
+			largest = i
+		}
+	}
+	if largest < 0 {
+		return nil
+	}
+	dst := maps[largest]
+	for i, m := range maps {
+		if i == largest {
+			continue
+		}
+		for ip, n := range m {
+			dst.add(ip, n)
+		}
+	}
+	return dst
+}
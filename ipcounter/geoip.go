@@ -0,0 +1,176 @@
+package ipcounter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP maps addresses to countries and autonomous systems with MaxMind
+// DB files, such as the free GeoLite2 Country and ASN databases. It is
+// consulted after a count, over the counted set, and never while parsing.
+type GeoIP struct {
+	dbs []geoDB
+}
+
+type geoDB struct {
+	path            string
+	reader          *maxminddb.Reader
+	countries, asns bool
+}
+
+// geoRecord holds the fields of the GeoIP2 and GeoLite2 records GeoIP
+// uses. The registered country stands in for the country of addresses
+// that have none, such as those of anycast networks.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN   uint32 `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// OpenGeoIP opens the MaxMind DB files at paths, memory-mapping them. Each
+// must be a country, city or ASN database; whether it has countries or
+// ASNs is told by its database type.
+func OpenGeoIP(paths ...string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, path := range paths {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		dbType := reader.Metadata.DatabaseType
+		db := geoDB{
+			path:      path,
+			reader:    reader,
+			countries: strings.Contains(dbType, "Country") || strings.Contains(dbType, "City") || strings.Contains(dbType, "Enterprise"),
+			asns:      strings.Contains(dbType, "ASN") || strings.Contains(dbType, "ISP") || strings.Contains(dbType, "Enterprise"),
+		}
+		g.dbs = append(g.dbs, db)
+		if !db.countries && !db.asns {
+			g.Close()
+			return nil, fmt.Errorf("%s: a %q database has neither countries nor autonomous systems", path, dbType)
+		}
+	}
+	return g, nil
+}
+
+// Close unmaps the databases.
+func (g *GeoIP) Close() error {
+	var errs []error
+	for _, db := range g.dbs {
+		errs = append(errs, db.reader.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// GeoCounts are the unique keys of a set by country and by autonomous
+// system. Countries are keyed by ISO 3166-1 code and ASNs by number; keys
+// the databases do not know are counted under "" and 0. A map is nil when
+// no database has what it counts.
+type GeoCounts struct {
+	Countries map[string]uint64
+	ASNs      map[uint32]uint64
+	// ASNames are the organizations of the ASNs.
+	ASNames map[uint32]string
+}
+
+// CountByGeo looks up the keys of s in g. With WithMask, a network is
+// placed where its first address is. The IPv4 keys are visited in order
+// and each lookup covers the whole network the database has a record for,
+// so a set costs about one lookup per record it touches.
+func (s *State) CountByGeo(g *GeoIP) (*GeoCounts, error) {
+	if s.sketch != nil {
+		return nil, ErrNoKeys
+	}
+	counts := &GeoCounts{}
+	for _, db := range g.dbs {
+		// The first database with countries or ASNs is the one counted.
+		db.countries = db.countries && counts.Countries == nil
+		db.asns = db.asns && counts.ASNs == nil
+		if !db.countries && !db.asns {
+			continue
+		}
+		if db.countries {
+			counts.Countries = make(map[string]uint64)
+		}
+		if db.asns {
+			counts.ASNs = make(map[uint32]uint64)
+			counts.ASNames = make(map[uint32]string)
+		}
+		if err := counts.add(s, db); err != nil {
+			return nil, fmt.Errorf("%s: %v", db.path, err)
+		}
+	}
+	return counts, nil
+}
+
+// add counts the keys of s by what db has.
+func (c *GeoCounts) add(s *State, db geoDB) error {
+	record := func(rec *geoRecord, n uint64) {
+		if db.countries {
+			country := rec.Country.ISOCode
+			if country == "" {
+				country = rec.RegisteredCountry.ISOCode
+			}
+			c.Countries[country] += n
+		}
+		if db.asns {
+			c.ASNs[rec.ASN] += n
+			if rec.ASN != 0 {
+				c.ASNames[rec.ASN] = rec.ASOrg
+			}
+		}
+	}
+
+	// The record of the network the last lookup ended in, reused for the
+	// keys after it up to end.
+	var rec geoRecord
+	var err error
+	end, valid := uint32(0), false
+	s.v4.each(func(key uint32) {
+		if err != nil {
+			return
+		}
+		if !valid || key > end {
+			rec = geoRecord{}
+			var network *net.IPNet
+			ip := net.IPv4(byte(key>>24), byte(key>>16), byte(key>>8), byte(key)).To4()
+			if network, _, err = db.reader.LookupNetwork(ip, &rec); err != nil {
+				return
+			}
+			ones, bits := network.Mask.Size()
+			end, valid = math.MaxUint32, true
+			if bits == 32 && ones > 0 {
+				end = key | uint32(uint64(1)<<(32-ones)-1)
+			}
+		}
+		record(&rec, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	if db.reader.Metadata.IPVersion != 6 {
+		// An IPv4 database knows no IPv6 address.
+		record(&geoRecord{}, uint64(len(s.v6)))
+		return nil
+	}
+	for addr := range s.v6 {
+		rec := geoRecord{}
+		if err := db.reader.Lookup(net.IP(addr[:]), &rec); err != nil {
+			return err
+		}
+		record(&rec, 1)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package ipcounter
+
+import (
+	"hash"
+	"io"
+)
+
+// HashPieceSize is the unit of the input tree hash. The file is cut into
+// pieces of this size, each piece is hashed on its own and the root is the
+// hash of the concatenated piece digests, so workers can hash their chunks
+// in parallel and the result does not depend on the worker count.
+const HashPieceSize = 1 << 20
+
+// pieceHasher is an io.Writer that hashes the first length bytes written to
+// it in HashPieceSize pieces and ignores the rest. It is fed through an
+// io.TeeReader placed under the line reader, whose read-ahead may run past
+// the end of the chunk.
+type pieceHasher struct {
+	newHash   func() hash.Hash
+	cur       hash.Hash
+	inPiece   int64
+	remaining int64
+	digests   [][]byte
+}
+
+func newPieceHasher(newHash func() hash.Hash, length int64) *pieceHasher {
+	return &pieceHasher{newHash: newHash, cur: newHash(), remaining: length}
+}
+
+func (h *pieceHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	if int64(len(p)) > h.remaining {
+		p = p[:h.remaining]
+	}
+	h.remaining -= int64(len(p))
+
+	for len(p) > 0 {
+		take := HashPieceSize - h.inPiece
+		if int64(len(p)) < take {
+			take = int64(len(p))
+		}
+		h.cur.Write(p[:take])
+		h.inPiece += take
+		p = p[take:]
+
+		if h.inPiece == HashPieceSize {
+			h.digests = append(h.digests, h.cur.Sum(nil))
+			h.cur.Reset()
+			h.inPiece = 0
+		}
+	}
+	return n, nil
+}
+
+// finish reads whatever part of the chunk the line reader did not need from
+// src and returns the piece digests.
+func (h *pieceHasher) finish(src io.Reader) ([][]byte, error) {
+	if h.remaining > 0 {
+		if _, err := io.CopyN(io.Discard, src, h.remaining); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	if h.inPiece > 0 {
+		h.digests = append(h.digests, h.cur.Sum(nil))
+		h.cur.Reset()
+		h.inPiece = 0
+	}
+	return h.digests, nil
+}
+
+// treeDigest combines piece digests, in file order, into the root digest.
+func treeDigest(newHash func() hash.Hash, digests [][]byte) []byte {
+	root := newHash()
+	for _, d := range digests {
+		root.Write(d)
+	}
+	return root.Sum(nil)
+}
@@ -0,0 +1,140 @@
+package ipcounter
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// HyperLogLog precision bounds accepted by WithHyperLogLog. A precision of
+// p uses 2^p one-byte registers and has a standard error of about
+// 1.04/sqrt(2^p): 0.8% at the default CLI precision of 14 (16 KiB).
+const (
+	MinHLLPrecision = 4
+	MaxHLLPrecision = 18
+)
+
+// hyperLogLog estimates the number of distinct keys added to it.
+type hyperLogLog struct {
+	p         uint8
+	registers []uint8
+}
+
+func newHyperLogLog(p uint8) *hyperLogLog {
+	return &hyperLogLog{p: p, registers: make([]uint8, 1<<p)}
+}
+
+// add records a key by its 64-bit hash: the top p bits pick a register,
+// which keeps the longest run of leading zeros seen in the rest.
+func (h *hyperLogLog) add(hash uint64) {
+	idx := hash >> (64 - h.p)
+	rank := uint8(bits.LeadingZeros64(hash<<h.p|1<<(h.p-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// merge makes h estimate the union of h and other, which must have the same
+// precision.
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// intersection estimates the number of keys in both h and other by
+// inclusion-exclusion. Its error is that of the union estimate, so it is
+// only meaningful for overlaps that are not small next to the sets.
+func (h *hyperLogLog) intersection(other *hyperLogLog) uint64 {
+	union := &hyperLogLog{p: h.p, registers: slices.Clone(h.registers)}
+	union.merge(other)
+	a, b, u := h.estimate(), other.estimate(), union.estimate()
+	if a+b <= u {
+		return 0
+	}
+	return min(a+b-u, a, b)
+}
+
+// estimate uses Ertl's improved estimator ("New cardinality estimation
+// algorithms for HyperLogLog sketches", 2017), which stays unbiased from
+// empty sketches to saturated ones without the empirical bias tables of
+// HyperLogLog++.
+func (h *hyperLogLog) estimate() uint64 {
+	q := 64 - int(h.p)
+	counts := make([]float64, q+2)
+	for _, r := range h.registers {
+		counts[r]++
+	}
+
+	m := float64(len(h.registers))
+	z := m * hllTau(1-counts[q+1]/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + counts[k])
+	}
+	z += m * hllSigma(counts[0]/m)
+	return uint64(math.Round(m * m / (2 * math.Ln2) / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// mix64 is the splitmix64 finalizer, spreading keys over all 64 bits as
+// the registers need.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func hashIPv6(a [16]byte) uint64 {
+	hi := uint64(a[0])<<56 | uint64(a[1])<<48 | uint64(a[2])<<40 | uint64(a[3])<<32 |
+		uint64(a[4])<<24 | uint64(a[5])<<16 | uint64(a[6])<<8 | uint64(a[7])
+	lo := uint64(a[8])<<56 | uint64(a[9])<<48 | uint64(a[10])<<40 | uint64(a[11])<<32 |
+		uint64(a[12])<<24 | uint64(a[13])<<16 | uint64(a[14])<<8 | uint64(a[15])
+	return mix64(lo ^ mix64(hi))
+}
+
+// mergeSketch merges s into into and returns the result; either may be nil.
+func mergeSketch(into, s *hyperLogLog) *hyperLogLog {
+	if into == nil {
+		return s
+	}
+	if s != nil {
+		into.merge(s)
+	}
+	return into
+}
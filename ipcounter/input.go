@@ -0,0 +1,82 @@
+package ipcounter
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// input is an input file opened once and shared by all workers, which read
+// their chunks through ReadAt. Nothing is opened after openInput returns,
+// which is what lets WithBeforeScan drop filesystem access before the scan.
+// A remote object stands in for the file when the input is a URL.
+type input struct {
+	file inputFile
+	// remote is file for a URL input; chunks are then read by ranged GETs.
+	remote *remoteObject
+	// direct is a second descriptor opened with O_DIRECT for WithDirectIO.
+	direct *os.File
+	size   int64
+	// data maps the whole file for WithMmap; nil if it is read instead.
+	data []byte
+}
+
+func openInput(fileName string, opts options) (*input, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat input file: %v", err)
+	}
+
+	in := &input{file: file, size: fileInfo.Size()}
+	if opts.directIO {
+		in.direct, err = openDirect(fileName)
+		if err != nil && opts.autoIO {
+			opts.logf("cannot open the input for direct I/O (%v), reading it through the page cache instead\n", err)
+		} else if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open file for direct I/O: %v", err)
+		}
+	}
+	if opts.mmap {
+		if in.data, err = mapFile(file, in.size); err != nil {
+			opts.logf("cannot map the input (%v), reading it instead\n", err)
+		}
+	}
+	return in, nil
+}
+
+// inputFile is what the workers read an input through: an *os.File, or a
+// *remoteObject.
+type inputFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openChunk returns a reader positioned at offset, to be closed once the
+// chunk is read.
+func (in *input) openChunk(offset int64) (io.ReadCloser, error) {
+	switch {
+	case in.remote != nil:
+		return in.remote.openRange(offset), nil
+	case in.direct != nil:
+		r, err := newDirectReader(in.direct, offset)
+		return io.NopCloser(r), err
+	}
+	return io.NopCloser(io.NewSectionReader(in.file, offset, in.size-offset)), nil
+}
+
+func (in *input) Close() error {
+	if in.direct != nil {
+		in.direct.Close()
+	}
+	if in.data != nil {
+		unmapFile(in.data)
+	}
+	return in.file.Close()
+}
@@ -0,0 +1,73 @@
+package ipcounter
+
+import (
+	"fmt"
+	"os"
+)
+
+// autoMmapMinSize is the smallest input WithAutoIO maps: below it, setting
+// up and faulting in the mapping costs about as much as the copies saved.
+const autoMmapMinSize = 64 << 20
+
+// storageKind is what kind of device holds an input, as far as the system
+// tells; see inputStorage.
+type storageKind int
+
+const (
+	storageUnknown storageKind = iota
+	storageRotational
+	storageSolidState
+)
+
+func (s storageKind) String() string {
+	switch s {
+	case storageRotational:
+		return "a rotational disk"
+	case storageSolidState:
+		return "a solid-state device"
+	}
+	return "storage of unknown kind"
+}
+
+// chooseIO sets o.mmap or o.directIO for the input at path, as WithAutoIO
+// asks, and logs the choice:
+//   - rotational disks are read through the page cache, whose readahead
+//     keeps their access pattern as sequential as the workers allow;
+//   - inputs on solid-state devices that do not fit in the memory left
+//     beside the bitmaps use direct I/O, as caching them would only evict
+//     other data;
+//   - other inputs of at least autoMmapMinSize are mapped, saving a copy
+//     per byte;
+//   - the rest are read.
+func chooseIO(path string, o *options) {
+	o.mmap, o.directIO = false, false
+	fi, err := os.Stat(path)
+	if err != nil {
+		// Let opening the file report the error.
+		return
+	}
+	size := fi.Size()
+	storage := inputStorage(path)
+
+	available, haveAvailable := availableMemory()
+	if plan, err := planMemory(o.workers, available, haveAvailable, *o); err == nil {
+		available -= min(available, plan.peak)
+	}
+	fits := !haveAvailable || uint64(size) <= available
+
+	var why string
+	switch {
+	case storage == storageRotational:
+		why = "buffered reads, the input is on " + storage.String()
+	case storage == storageSolidState && !fits:
+		o.directIO = true
+		why = fmt.Sprintf("direct I/O, the input is on %s and larger than the %s of memory left for caching it",
+			storage, o.formatBytes(available))
+	case mmapSupported && size >= autoMmapMinSize:
+		o.mmap = true
+		why = fmt.Sprintf("memory mapping, the input is on %s and at least %s", storage, o.formatBytes(autoMmapMinSize))
+	default:
+		why = fmt.Sprintf("buffered reads, the input is on %s and %s", storage, o.formatBytes(uint64(size)))
+	}
+	o.logf("I/O strategy for %s: %s\n", path, why)
+}
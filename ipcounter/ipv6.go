@@ -0,0 +1,80 @@
+package ipcounter
+
+import "net/netip"
+
+// ipv6Set is the backend for IPv6 addresses, whose space is far too large
+// for a bitmap: a hash set keyed by the 16 address bytes. Its memory grows
+// with the number of distinct addresses, about 50 bytes each.
+type ipv6Set map[[16]byte]struct{}
+
+func (s ipv6Set) add(addr netip.Addr) {
+	s[addr.As16()] = struct{}{}
+}
+
+// intersection returns the number of addresses in both s and other.
+func (s ipv6Set) intersection(other ipv6Set) int {
+	if len(other) < len(s) {
+		s, other = other, s
+	}
+	n := 0
+	for k := range s {
+		if _, ok := other[k]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// merge adds other's addresses to s.
+func (s ipv6Set) merge(other ipv6Set) {
+	for k := range other {
+		s[k] = struct{}{}
+	}
+}
+
+// mergeIPv6Sets merges sets into the largest of them.
+func mergeIPv6Sets(sets []ipv6Set) ipv6Set {
+	largest := -1
+	for i, s := range sets {
+		if largest < 0 || len(s) > len(sets[largest]) {
+			largest = i
+		}
+	}
+	if largest < 0 || sets[largest] == nil {
+		return ipv6Set{}
+	}
+	dst := sets[largest]
+	for i, s := range sets {
+		if i != largest {
+			dst.merge(s)
+		}
+	}
+	return dst
+}
+
+// parseAny parses a line as an IPv4 address or, with WithIPv6, falls back
+// to IPv6. IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) are returned as
+// IPv4 so they are counted once with the other IPv4 addresses; for any
+// other IPv6 address ip6 is valid and ip is 0. Zones are dropped. The
+// error is the IPv4 parser's, so with WithIPv6 a line that is neither is
+// still classified by why it is not IPv4.
+func (o options) parseAny(line []byte) (ip uint32, ip6 netip.Addr, weight uint64, err error) {
+	ip, weight, err = o.parseLine(line)
+	if err == nil || !o.ipv6 || err == ErrInvalidWeight || err == ErrMissingField || err == ErrNoMatch {
+		return ip, ip6, weight, err
+	}
+
+	addr, weight, ferr := o.field(line)
+	if ferr != nil {
+		return 0, ip6, 0, err
+	}
+	parsed, perr := netip.ParseAddr(string(addr))
+	if perr != nil || !parsed.Is6() {
+		return 0, ip6, 0, err
+	}
+	if parsed.Is4In6() {
+		v4 := parsed.Unmap().As4()
+		return uint32(v4[0])<<24 | uint32(v4[1])<<16 | uint32(v4[2])<<8 | uint32(v4[3]), ip6, weight, nil
+	}
+	return 0, parsed.WithZone(""), weight, nil
+}
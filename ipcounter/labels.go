@@ -0,0 +1,114 @@
+package ipcounter
+
+import "context"
+
+// LabeledFile is an input of RunLabeled and the label it is counted under.
+type LabeledFile struct {
+	Path  string
+	Label string
+}
+
+// LabeledResult is the outcome of RunLabeled.
+type LabeledResult struct {
+	MultiResult
+	// Labels holds the counts of each label in the order the labels first
+	// appear among the files.
+	Labels []LabelResult
+}
+
+// LabelResult counts the union of the files under one label.
+type LabelResult struct {
+	Label  string
+	Result *Result
+	// Overlaps maps every other label to the number of addresses, IPv4
+	// and IPv6 together, seen under both; estimates with WithHyperLogLog.
+	Overlaps map[string]uint64
+}
+
+// RunLabeled is RunFiles with the files grouped by label: it also counts
+// the union of each label's files and the overlap of every pair of labels,
+// such as the addresses seen by both the firewall and the web servers. Each
+// label keeps a set of its own, one 512 MiB bitmap for dense counts, which
+// the memory plans of later files leave room for; the union of all files is
+// built from them at the end. WithFrequencies and WithState only fill in
+// Total.
+func (c *Counter) RunLabeled(ctx context.Context, files []LabeledFile, opts ...Option) (*LabeledResult, error) {
+	o, err := c.multiOptions(opts, len(files))
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	sets := make(map[string]*runResult)
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+		if sets[f.Label] == nil {
+			labels = append(labels, f.Label)
+			sets[f.Label] = &runResult{invalid: make(map[error]int64)}
+		}
+	}
+	multi, err := countFiles(ctx, paths, &o, func(i int, r *runResult) {
+		sets[files[i].Label].merge(r, o.mergeWorkers)
+		held := 0
+		for _, s := range sets {
+			if s.bitmap != nil {
+				held++
+			}
+		}
+		o.reserved = uint64(held) * bitmapBytes
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	o.newHash = nil
+	result := &LabeledResult{MultiResult: *multi}
+	labelOpts := o
+	labelOpts.state = false
+	for _, label := range labels {
+		set := sets[label]
+		set.countUnique(o.mergeWorkers)
+		res := newResult(set, labelOpts)
+		res.Frequencies = nil
+		result.Labels = append(result.Labels, LabelResult{Label: label, Result: res, Overlaps: make(map[string]uint64)})
+	}
+	for i, a := range labels {
+		for j := i + 1; j < len(labels); j++ {
+			b := labels[j]
+			n := sets[a].overlap(sets[b], o.mergeWorkers)
+			result.Labels[i].Overlaps[b] = n
+			result.Labels[j].Overlaps[a] = n
+		}
+	}
+
+	// The label sets are taken over from here on.
+	total := &runResult{invalid: make(map[error]int64)}
+	for _, label := range labels {
+		total.merge(sets[label], o.mergeWorkers)
+	}
+	total.countUnique(o.mergeWorkers)
+	result.Total = newResult(total, o)
+	return result, nil
+}
+
+// overlap returns the number of keys, IPv4 and IPv6, in both r and other,
+// which must come from counts with the same options.
+func (r *runResult) overlap(other *runResult, mergeWorkers int) uint64 {
+	var n uint64
+	switch {
+	case r.sketch != nil && other.sketch != nil:
+		n = r.sketch.intersection(other.sketch)
+	case r.sparse != nil && other.sparse != nil:
+		n = uint64(r.sparse.intersection(other.sparse))
+	case r.bitmap != nil && other.bitmap != nil:
+		n = uint64(countCommonBits(r.bitmap, other.bitmap, mergeWorkers))
+	}
+	switch {
+	case r.sketch6 != nil && other.sketch6 != nil:
+		n += r.sketch6.intersection(other.sketch6)
+	default:
+		n += uint64(r.v6.intersection(other.v6))
+	}
+	return n
+}
@@ -0,0 +1,51 @@
+package ipcounter
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Layout selects how an address is mapped to a bitmap word and bit.
+// The mapping is a bijection, so it never changes the count; it only changes
+// which addresses share a cache line.
+type Layout int
+
+const (
+	// LayoutLinear, the default, stores consecutive addresses in
+	// consecutive bits.
+	LayoutLinear Layout = iota
+	// LayoutRotated picks the word from the low 26 bits of the address and
+	// the bit from the top 6, so addresses in one hot prefix are spread
+	// over many cache lines instead of packed into a few.
+	LayoutRotated
+)
+
+func (l Layout) String() string {
+	switch l {
+	case LayoutRotated:
+		return "rotated"
+	default:
+		return "linear"
+	}
+}
+
+// Set parses a layout name, so that a Layout can be used with flag.Var.
+func (l *Layout) Set(s string) error {
+	switch s {
+	case "linear":
+		*l = LayoutLinear
+	case "rotated":
+		*l = LayoutRotated
+	default:
+		return fmt.Errorf("unknown bitmap layout %q (want linear or rotated)", s)
+	}
+	return nil
+}
+
+// index returns the word index and bit position of ip.
+func (l Layout) index(ip uint32) (uint32, uint32) {
+	if l == LayoutRotated {
+		ip = bits.RotateLeft32(ip, 6)
+	}
+	return ip / 64, ip % 64
+}
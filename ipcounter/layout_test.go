@@ -0,0 +1,51 @@
+package ipcounter
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+// layoutInputs returns n addresses drawn from the given number of /24
+// networks, or from the whole space if networks is 0.
+func layoutInputs(rng *rand.Rand, n, networks int) []uint32 {
+	prefixes := make([]uint32, networks)
+	for i := range prefixes {
+		prefixes[i] = rng.Uint32() &^ 0xff
+	}
+	ips := make([]uint32, n)
+	for i := range ips {
+		if networks == 0 {
+			ips[i] = rng.Uint32()
+		} else {
+			ips[i] = prefixes[rng.IntN(networks)] | rng.Uint32()&0xff
+		}
+	}
+	return ips
+}
+
+// BenchmarkLayout sets the bits of addresses in a full bitmap with each
+// layout, the way a scan worker does, on inputs concentrated in a few hot
+// prefixes and on uniform ones.
+func BenchmarkLayout(b *testing.B) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	inputs := []struct {
+		name string
+		ips  []uint32
+	}{
+		{"hot-4x24", layoutInputs(rng, 1<<20, 4)},
+		{"hot-1024x24", layoutInputs(rng, 1<<20, 1024)},
+		{"uniform", layoutInputs(rng, 1<<20, 0)},
+	}
+	bitmap := make([]uint64, bitmapWords)
+	for _, in := range inputs {
+		for _, layout := range []Layout{LayoutLinear, LayoutRotated} {
+			b.Run(in.name+"/"+layout.String(), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					ip := in.ips[i%len(in.ips)]
+					idx, pos := layout.index(ip)
+					bitmap[idx] |= 1 << pos
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ipcounter
+
+import (
+	"bytes"
+	"io"
+	"math/bits"
+)
+
+// lineStatsWindow is how much of a chunk is sampled to learn its line
+// lengths before the chunk's reader is created.
+const lineStatsWindow = 256 << 10
+
+// lineStats is a histogram of line lengths in power-of-two buckets: bucket i
+// counts lines of length in [2^(i-1), 2^i), bucket 0 empty lines.
+type lineStats struct {
+	buckets [33]int64
+	count   int64
+	max     int
+}
+
+func (s *lineStats) add(n int) {
+	s.buckets[bits.Len(uint(n))]++
+	s.count++
+	if n > s.max {
+		s.max = n
+	}
+}
+
+// percentile returns an upper bound for the length below which the fraction
+// p of sampled lines fall.
+func (s *lineStats) percentile(p float64) int {
+	target := int64(p * float64(s.count))
+	var seen int64
+	for i, n := range s.buckets {
+		seen += n
+		if seen > target {
+			return 1 << i
+		}
+	}
+	return s.max
+}
+
+// sampleLineStats reads the lineStatsWindow bytes starting at offset and
+// measures the complete lines in them, skipping the partial first line of
+// any chunk but the first.
+func sampleLineStats(r io.ReaderAt, offset int64) lineStats {
+	var s lineStats
+	buf := make([]byte, lineStatsWindow)
+	n, err := r.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return s
+	}
+	window := buf[:n]
+
+	if offset != 0 {
+		i := bytes.IndexByte(window, '\n')
+		if i < 0 {
+			// Not a single line boundary in the window: remember that lines
+			// are at least this long.
+			s.max = len(window)
+			return s
+		}
+		window = window[i+1:]
+	}
+
+	for {
+		i := bytes.IndexByte(window, '\n')
+		if i < 0 {
+			if err == io.EOF && len(window) > 0 {
+				s.add(len(window))
+			} else if len(window) > s.max {
+				s.max = len(window)
+			}
+			return s
+		}
+		s.add(i)
+		window = window[i+1:]
+	}
+}
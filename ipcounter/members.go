@@ -0,0 +1,448 @@
+package ipcounter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// memberScanBuffer is the read size when searching for gzip members.
+	memberScanBuffer = 1 << 20
+
+	// gzipVerifyBytes is how much a candidate gzip member must decompress
+	// without error, unless it ends sooner with a valid checksum, to be
+	// taken for a real member and not bytes inside compressed data that
+	// happen to look like a header.
+	gzipVerifyBytes = 64 << 10
+
+	zstdFrameMagic     = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50
+)
+
+// fileCompression reads the magic bytes at the start of the file at path.
+func fileCompression(path string) (compression, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return uncompressed, err
+	}
+	defer file.Close()
+
+	head := make([]byte, compressionMagicLen)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return uncompressed, err
+	}
+	return detectCompression(head[:n]), nil
+}
+
+// runCompressed counts a compressed file. A gzip file of several members
+// or a zstd file of several frames is split at member boundaries and the
+// ranges are decompressed by parallel workers. Anything else, and counts
+// that need offsets into the input (hashing, segment estimates, recording
+// or sampling invalid lines), are decompressed as a single stream.
+func runCompressed(ctx context.Context, path string, c compression, o options) (*runResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file: %v", err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat input file: %v", err)
+	}
+	in := &input{file: file, size: fileInfo.Size()}
+
+	splittable := (c == compressGzip || c == compressZstd) && o.workers > 1 &&
+		o.newHash == nil && o.segmentSize == 0 && o.recordPath == "" && o.invalidSamples == 0
+	if splittable {
+		boundaries, err := memberBoundaries(in, c, o.workers)
+		if err != nil {
+			o.logf("cannot split the %s input (%v), decompressing it as a single stream\n", c, err)
+		} else if len(boundaries) > 1 {
+			available, haveAvailable := availableMemory()
+			plan, planErr := planMemory(len(boundaries), available, haveAvailable, o)
+			if planErr == nil && plan.spillSlots == 0 {
+				logMemoryPlan(plan, available, haveAvailable, o)
+				if o.beforeScan != nil {
+					if err := o.beforeScan(); err != nil {
+						return nil, err
+					}
+				}
+
+				o.logf("input is %s-compressed: decompressing %d ranges of members in parallel\n", c, len(boundaries))
+				stop := o.startProgress(in.size, len(boundaries))
+				result, err := countMembers(ctx, in, c, boundaries, o)
+				stop()
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if err != nil {
+					return nil, fmt.Errorf("processing failed: %v", err)
+				}
+				return result, nil
+			}
+		}
+	}
+
+	o.directIO = false
+	return runStream(ctx, file, in.size, o)
+}
+
+// memberBoundaries splits a compressed input into at most workers ranges
+// that each start at a gzip member or zstd frame, so that each range
+// decompresses on its own. It returns the start offsets, the first being
+// 0; a single offset means the input cannot be split.
+func memberBoundaries(in *input, c compression, workers int) ([]int64, error) {
+	switch c {
+	case compressZstd:
+		starts, err := zstdFrameStarts(in)
+		if err != nil {
+			return nil, err
+		}
+		return pickBoundaries(starts, in.size, workers), nil
+	case compressGzip:
+		return gzipBoundaries(in, workers)
+	}
+	return []int64{0}, nil
+}
+
+// pickBoundaries picks for each of workers evenly spaced offsets the first
+// member start at or after it.
+func pickBoundaries(starts []int64, size int64, workers int) []int64 {
+	out := []int64{0}
+	j := 0
+	for w := 1; w < workers; w++ {
+		target := size * int64(w) / int64(workers)
+		for j < len(starts) && starts[j] < target {
+			j++
+		}
+		if j == len(starts) {
+			break
+		}
+		if starts[j] > out[len(out)-1] {
+			out = append(out, starts[j])
+		}
+	}
+	return out
+}
+
+// zstdFrameStarts lists the offsets of all zstd frames. Frame and block
+// headers carry their sizes, so this hops from header to header without
+// decompressing anything.
+func zstdFrameStarts(in *input) ([]int64, error) {
+	var starts []int64
+	var hdr [8]byte
+	for off := int64(0); off < in.size; {
+		if n, _ := in.file.ReadAt(hdr[:], off); n < len(hdr) {
+			return nil, fmt.Errorf("truncated zstd frame at offset %d", off)
+		}
+
+		magic := binary.LittleEndian.Uint32(hdr[:4])
+		if magic&^0xf == zstdSkippableMagic {
+			off += 8 + int64(binary.LittleEndian.Uint32(hdr[4:]))
+			continue
+		}
+		if magic != zstdFrameMagic {
+			return nil, fmt.Errorf("no zstd frame at offset %d", off)
+		}
+		starts = append(starts, off)
+
+		// Frame header: descriptor, optional window descriptor, dictionary
+		// ID and content size, whose sizes the descriptor encodes.
+		fhd := hdr[4]
+		singleSegment := fhd&0x20 != 0
+		pos := off + 5
+		if !singleSegment {
+			pos++
+		}
+		pos += [4]int64{0, 1, 2, 4}[fhd&3]
+		if fcs := [4]int64{0, 2, 4, 8}[fhd>>6]; fcs == 0 && singleSegment {
+			pos++
+		} else {
+			pos += fcs
+		}
+
+		for last := false; !last; {
+			var bh [3]byte
+			if _, err := in.file.ReadAt(bh[:], pos); err != nil {
+				return nil, fmt.Errorf("truncated zstd frame at offset %d", off)
+			}
+			v := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+			last = v&1 != 0
+			pos += 3
+			switch (v >> 1) & 3 {
+			case 1: // RLE: a single byte repeated
+				pos++
+			case 3:
+				return nil, fmt.Errorf("corrupt zstd block at offset %d", pos-3)
+			default:
+				pos += int64(v >> 3)
+			}
+		}
+		if fhd&0x04 != 0 {
+			pos += 4 // content checksum
+		}
+		off = pos
+	}
+	return starts, nil
+}
+
+// gzipBoundaries looks for a gzip member starting in each of workers evenly
+// sized ranges of the input. Member headers are not indexed anywhere, so
+// candidates are found by their magic bytes and confirmed by decompressing
+// the start of the member.
+func gzipBoundaries(in *input, workers int) ([]int64, error) {
+	out := []int64{0}
+	for w := 1; w < workers; w++ {
+		from := max(in.size*int64(w)/int64(workers), out[len(out)-1]+1)
+		to := in.size * int64(w+1) / int64(workers)
+		start, ok, err := findGzipMember(in, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, start)
+		}
+	}
+	return out, nil
+}
+
+// findGzipMember returns the first confirmed gzip member starting in
+// [from, to).
+func findGzipMember(in *input, from, to int64) (int64, bool, error) {
+	// ID1, ID2 and CM (deflate) of a member header.
+	magic := []byte{0x1f, 0x8b, 0x08}
+	buf := make([]byte, memberScanBuffer)
+
+	for pos := from; pos < to; pos += int64(len(buf) - len(magic)) {
+		n, err := in.file.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		data := buf[:n]
+		for i := 0; ; i++ {
+			j := bytes.Index(data[i:], magic)
+			if j < 0 {
+				break
+			}
+			i += j
+			start := pos + int64(i)
+			if start >= to {
+				return 0, false, nil
+			}
+			if gzipMemberAt(in, start) {
+				return start, true, nil
+			}
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return 0, false, nil
+}
+
+// gzipMemberAt reports whether a valid gzip member starts at offset.
+func gzipMemberAt(in *input, offset int64) bool {
+	zr, err := gzip.NewReader(io.NewSectionReader(in.file, offset, in.size-offset))
+	if err != nil {
+		return false
+	}
+	zr.Multistream(false)
+	_, err = io.CopyN(io.Discard, zr, gzipVerifyBytes)
+	return err == nil || err == io.EOF
+}
+
+// memberPart is what one worker found in its range of members. Lines do
+// not respect member boundaries, so the line fragments at both ends of a
+// range are kept and joined with their neighbours' afterwards.
+type memberPart struct {
+	// head is the text up to the first newline; newline is false if the
+	// range held none, in which case all of its text is in tail.
+	head    []byte
+	newline bool
+	// tail is the text after the last newline.
+	tail   []byte
+	result *chunkResult
+}
+
+// countMembers decompresses the ranges starting at boundaries in parallel,
+// each into its own bitmap, then counts the lines that span ranges.
+func countMembers(ctx context.Context, in *input, c compression, boundaries []int64, opts options) (*runResult, error) {
+	parts := make([]memberPart, len(boundaries))
+	// One bitmap per range and the merge target.
+	preallocated := preallocBitmaps(len(parts)+1, opts)
+	g, gctx := errgroup.WithContext(ctx)
+
+	for i := range boundaries {
+		i := i
+		g.Go(func() error {
+			end := in.size
+			if i+1 < len(boundaries) {
+				end = boundaries[i+1]
+			}
+			src := countReads(io.NewSectionReader(in.file, boundaries[i], end-boundaries[i]), opts.tracker.worker(i))
+			dr, err := decompress(c, src)
+			if err != nil {
+				return fmt.Errorf("worker %d failed to start decompressing at offset %d: %v", i, boundaries[i], err)
+			}
+			defer dr.Close()
+
+			holder := &lineHolder{r: dr}
+			reader := newBlockLines(holder, minReadSize)
+			p := &parts[i]
+			p.newline = true
+			if i > 0 {
+				line, err := reader.readLine()
+				switch {
+				case err == io.EOF:
+					p.newline = false
+				case err != nil:
+					return fmt.Errorf("worker %d failed: %v", i, err)
+				default:
+					p.head = bytes.Clone(line)
+				}
+			}
+
+			var bitmap []uint64
+			switch {
+			case preallocated != nil:
+				bitmap = preallocated[i]
+			case opts.dense():
+				bitmap = make([]uint64, bitmapWords)
+			}
+			p.result, err = scanLines(gctx, reader, 0, math.MaxInt64, opts, bitmap)
+			if err != nil {
+				return fmt.Errorf("worker %d failed: %v", i, err)
+			}
+			p.tail = holder.held
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var final []uint64
+	if opts.dense() {
+		bitmaps := make([][]uint64, len(parts))
+		for i, p := range parts {
+			bitmaps[i] = p.result.bitmap
+		}
+		if preallocated != nil {
+			final = mergeBitmapsInto(preallocated[len(parts)], bitmaps, opts.mergeWorkers)
+		} else {
+			final = mergeBitmaps(bitmaps, bitmapWords, opts.mergeWorkers)
+		}
+	}
+
+	// Rebuild the lines cut by range boundaries and count them into the
+	// merged bitmap, or their own roaring bitmap or sketch.
+	var joined, carry []byte
+	for i, p := range parts {
+		if i > 0 && p.newline {
+			joined = append(append(append(joined, carry...), p.head...), '\n')
+			carry = carry[:0]
+		}
+		carry = append(carry, p.tail...)
+	}
+	if len(carry) > 0 {
+		joined = append(append(joined, carry...), '\n')
+	}
+	spanning, err := scanLines(ctx, newBlockLines(bytes.NewReader(joined), minReadSize), 0, math.MaxInt64, opts, final)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &runResult{invalid: make(map[error]int64), bitmap: final, bytes: in.size}
+	var v6Sets []ipv6Set
+	var sparse []*roaringBitmap
+	var frequencies []frequencyMap
+	var tops []*topCounter
+	add := func(r *chunkResult) {
+		result.occurrences = addWeight(result.occurrences, r.occurrences)
+		result.lines += r.lines
+		result.filtered += r.filtered
+		result.covered += r.scanned
+		result.partial = result.partial || r.partial
+		for reason, n := range r.invalid {
+			result.invalid[reason] += n
+		}
+		v6Sets = append(v6Sets, r.v6)
+		sparse = append(sparse, r.sparse)
+		frequencies = append(frequencies, r.frequencies)
+		tops = append(tops, r.top)
+		result.sketch = mergeSketch(result.sketch, r.sketch)
+		result.sketch6 = mergeSketch(result.sketch6, r.sketch6)
+	}
+	for _, p := range parts {
+		add(p.result)
+	}
+	add(spanning)
+	result.frequencies = mergeFrequencies(frequencies)
+	result.top = mergeTop(tops)
+	if result.sketch != nil {
+		result.unique = int(result.sketch.estimate())
+		return result, nil
+	}
+	if opts.ipv6 {
+		result.v6 = mergeIPv6Sets(v6Sets)
+	}
+	if opts.roaring {
+		result.sparse = mergeRoaring(sparse, opts.mergeWorkers)
+		result.unique = result.sparse.cardinality()
+		return result, nil
+	}
+	result.unique = countBits(final, opts.mergeWorkers)
+	return result, nil
+}
+
+// lineHolder passes its input on only up to the last newline read so far.
+// At EOF, the text after the last newline, the start of a line that
+// continues in the next range, is left in held.
+type lineHolder struct {
+	r      io.Reader
+	chunk  []byte
+	outBuf []byte
+	out    []byte
+	held   []byte
+	err    error
+}
+
+func (h *lineHolder) Read(p []byte) (int, error) {
+	for len(h.out) == 0 {
+		if h.err != nil {
+			return 0, h.err
+		}
+		if h.chunk == nil {
+			h.chunk = make([]byte, memberScanBuffer)
+		}
+		n, err := h.r.Read(h.chunk)
+		h.err = err
+		data := h.chunk[:n]
+
+		i := bytes.LastIndexByte(data, '\n')
+		if i < 0 {
+			h.held = append(h.held, data...)
+			if len(h.held) > maxReadSize {
+				h.err = ErrLineTooLong
+			}
+			continue
+		}
+		h.outBuf = append(append(h.outBuf[:0], h.held...), data[:i+1]...)
+		h.out = h.outBuf
+		h.held = append(h.held[:0], data[i+1:]...)
+	}
+
+	n := copy(p, h.out)
+	h.out = h.out[n:]
+	return n, nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package ipcounter
+
+func availableMemory() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,109 @@
+package ipcounter
+
+import (
+	"fmt"
+)
+
+const (
+	// bitmapWords is the number of words in a dense bitmap covering the
+	// IPv4 space, bitmapBytes its size.
+	bitmapWords = 1 << 32 / 64
+	bitmapBytes = bitmapWords * 8
+)
+
+// memoryPlan describes how much memory a run is expected to need at peak.
+type memoryPlan struct {
+	backend string
+	peak    uint64
+	// spillSlots, when non-zero, is how many chunk bitmaps may be in memory
+	// at once. Finished chunk bitmaps are spilled to disk and merged from
+	// there instead of all being kept until the end.
+	spillSlots int
+}
+
+// planMemory estimates peak usage: one bitmap per worker, all alive at the
+// same time, plus the merged result. When the system reports less available
+// memory than that, it plans to spill finished chunks to disk and keep only
+// as many bitmaps in memory as fit; it fails only if not even one does.
+// HyperLogLog sketches are small enough to never spill, and external
+// sorting is on disk already. WithTopN adds a count-min sketch per worker,
+// which each may switch to, whatever the backend.
+func planMemory(numWorkers int, available uint64, ok bool, opts options) (memoryPlan, error) {
+	available -= min(available, opts.reserved)
+	var sketches uint64
+	if opts.topN > 0 && !opts.frequencies {
+		sketches = uint64(max(numWorkers, 1)) * cmsBytes
+		available -= min(available, sketches)
+	}
+	plan, err := planSet(numWorkers, available, ok, opts)
+	if sketches > 0 {
+		plan.peak += sketches
+		plan.backend += fmt.Sprintf(", %s count-min sketch per worker for the top N", opts.formatBytes(cmsBytes))
+	}
+	return plan, err
+}
+
+// planSet plans the memory of the counted set and its per-worker parts.
+func planSet(numWorkers int, available uint64, ok bool, opts options) (memoryPlan, error) {
+	if opts.hllPrecision > 0 {
+		sketches := uint64(numWorkers + 1)
+		if opts.ipv6 {
+			sketches *= 2
+		}
+		return memoryPlan{
+			backend: fmt.Sprintf("HyperLogLog sketch (precision %d)", opts.hllPrecision),
+			peak:    sketches << opts.hllPrecision,
+		}, nil
+	}
+	if opts.external {
+		return memoryPlan{
+			backend: fmt.Sprintf("external sort into partitions in %s", opts.spillDir),
+			peak:    uint64(max(numWorkers, 1))*externalBufferBytes + uint64(opts.mergeWorkers)*externalSpan/8,
+		}, nil
+	}
+	plan := memoryPlan{
+		backend: "dense bitmap",
+		peak:    uint64(numWorkers+1) * bitmapBytes,
+	}
+	if opts.roaring {
+		// Containers are allocated as addresses occur, so the dense peak
+		// is only a bound and there is nothing to spill.
+		plan.backend = "roaring bitmap, growing with the distinct addresses (the estimate is the dense upper bound)"
+	}
+	if opts.frequencies {
+		plan.backend += ", hash map for frequencies (not in the estimate)"
+	}
+	if opts.ipv6 {
+		// The set grows with the input, so its size cannot be planned.
+		plan.backend += ", hash set for IPv6 (not in the estimate)"
+	}
+	if !ok || plan.peak <= available || opts.roaring {
+		return plan, nil
+	}
+
+	slots := int(available / bitmapBytes)
+	if slots < 1 {
+		return plan, fmt.Errorf("need at least %s but only %s is available",
+			opts.formatBytes(bitmapBytes), opts.formatBytes(available))
+	}
+	plan.spillSlots = min(slots, numWorkers)
+	plan.peak = uint64(plan.spillSlots) * bitmapBytes
+	return plan, nil
+}
+
+// logMemoryPlan logs the plan next to the memory the system reports as
+// available (as returned by availableMemory).
+func logMemoryPlan(plan memoryPlan, available uint64, ok bool, opts options) {
+	if !ok {
+		opts.logf("backend: %s, expected peak memory: %s, available memory: unknown\n",
+			plan.backend, opts.formatBytes(plan.peak))
+		return
+	}
+
+	opts.logf("backend: %s, expected peak memory: %s, available memory: %s\n",
+		plan.backend, opts.formatBytes(plan.peak), opts.formatBytes(available))
+	if plan.spillSlots > 0 {
+		opts.logf("not enough memory for all workers: spilling chunk bitmaps to disk, at most %d in memory\n",
+			plan.spillSlots)
+	}
+}
@@ -0,0 +1,91 @@
+package ipcounter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// mappedProgressStep is how many bytes mappedLines scans between updates
+// of its progress counter.
+const mappedProgressStep = 1 << 20
+
+// mappedLines yields the lines of a memory-mapped input, slicing them
+// straight out of the mapping.
+type mappedLines struct {
+	data []byte
+	pos  int
+	// counter, if set, receives the bytes scanned, counted from counted.
+	counter *atomic.Int64
+	counted int
+}
+
+func (m *mappedLines) readLine() ([]byte, error) {
+	if m.pos >= len(m.data) {
+		m.count()
+		return nil, io.EOF
+	}
+	rest := m.data[m.pos:]
+	line := rest
+	if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+		line = rest[:i]
+		m.pos += i + 1
+	} else {
+		m.pos = len(m.data)
+	}
+	if m.counter != nil && m.pos-m.counted >= mappedProgressStep {
+		m.count()
+	}
+	// The same limit as the largest read buffer, so that an input is
+	// rejected or not whichever way it is read.
+	if len(line) > maxReadSize {
+		return nil, ErrLineTooLong
+	}
+	return line, nil
+}
+
+func (m *mappedLines) count() {
+	if m.counter != nil {
+		m.counter.Add(int64(m.pos - m.counted))
+		m.counted = m.pos
+	}
+}
+
+// processMappedChunk is processChunk for a memory-mapped input.
+func processMappedChunk(ctx context.Context, data []byte, startOffset, endOffset int64, opts options, bitmap []uint64) (*chunkResult, error) {
+	if opts.inputFormat == InputBinary4 {
+		r := countReads(bytes.NewReader(data[startOffset:endOffset]), opts.readCounter)
+		return processRecordChunk(ctx, r, startOffset, endOffset, opts, bitmap)
+	}
+
+	// As in processChunk, skip the end of a line owned by the previous
+	// chunk.
+	pos := startOffset
+	if startOffset != 0 && data[startOffset-1] != '\n' {
+		if i := bytes.IndexByte(data[startOffset:], '\n'); i >= 0 {
+			pos += int64(i) + 1
+		} else {
+			pos = int64(len(data))
+		}
+	}
+
+	if bitmap == nil && opts.dense() {
+		bitmap = make([]uint64, bitmapWords)
+	}
+	lines := &mappedLines{data: data, pos: int(pos), counter: opts.readCounter, counted: int(startOffset)}
+	result, err := scanLines(ctx, lines, pos, endOffset, opts, bitmap)
+	if err != nil {
+		return nil, err
+	}
+	lines.count()
+
+	if opts.newHash != nil {
+		hasher := newPieceHasher(opts.newHash, endOffset-startOffset)
+		hasher.Write(data[startOffset:endOffset])
+		if result.digests, err = hasher.finish(bytes.NewReader(nil)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
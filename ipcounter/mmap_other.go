@@ -0,0 +1,20 @@
+//go:build !linux
+
+package ipcounter
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+var errNoMmap = errors.New("memory-mapped input is only supported on Linux")
+
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errNoMmap
+}
+
+func unmapFile(data []byte) error {
+	return errNoMmap
+}
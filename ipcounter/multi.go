@@ -0,0 +1,145 @@
+package ipcounter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MultiResult is the outcome of counting several files with RunFiles.
+type MultiResult struct {
+	// Files holds each file's own result in the order the paths were
+	// given, and Elapsed the time each took.
+	Files   []*Result
+	Elapsed []time.Duration
+	// Total counts the union of the files. Its Lines, Bytes, Occurrences,
+	// Filtered and Invalid are sums; Digest, Segments and SpotCheck are
+	// only reported per file.
+	Total *Result
+}
+
+// RunFiles counts each of several files and their union. The files are
+// counted one after another, each split into chunks across all workers as
+// Run does, while the union is kept in a set of its own: one more 512 MiB
+// bitmap for dense counts, which the memory plan of every file after the
+// first leaves room for. Sorted files are counted into a bitmap as well, so
+// that they can be merged. WithInvalidRecording and WithBeforeScan are
+// rejected, as they expect a single input, and WithFrequencies and
+// WithState only fill in Total.
+func (c *Counter) RunFiles(ctx context.Context, paths []string, opts ...Option) (*MultiResult, error) {
+	o, err := c.multiOptions(opts, len(paths))
+	if err != nil {
+		return nil, err
+	}
+
+	total := &runResult{invalid: make(map[error]int64)}
+	multi, err := countFiles(ctx, paths, &o, func(i int, r *runResult) {
+		total.merge(r, o.mergeWorkers)
+		if total.bitmap != nil {
+			o.reserved = bitmapBytes
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total.countUnique(o.mergeWorkers)
+	// The files were hashed separately; there is no digest of the union.
+	o.newHash = nil
+	multi.Total = newResult(total, o)
+	return multi, nil
+}
+
+// multiOptions applies the options of a count over several files.
+func (c *Counter) multiOptions(opts []Option, files int) (options, error) {
+	o, err := c.options(opts)
+	switch {
+	case err != nil:
+		return o, err
+	case files == 0:
+		return o, errors.New("no input files")
+	case o.recordPath != "":
+		return o, errors.New("recording invalid lines needs a single input file")
+	case o.beforeScan != nil:
+		return o, errors.New("a before-scan hook needs a single input file")
+	case o.external:
+		return o, errors.New("external sorting counts a single input file")
+	}
+	o.keepSet = true
+	return o, nil
+}
+
+// countFiles counts the files one after another and hands each one's set
+// to merge, which may take it over and update o.reserved. The per-file
+// results leave out Frequencies, whose maps merge takes over too, and
+// State, which only the union needs.
+func countFiles(ctx context.Context, paths []string, o *options, merge func(i int, r *runResult)) (*MultiResult, error) {
+	multi := &MultiResult{}
+	for i, path := range paths {
+		o.logf("counting %s (file %d of %d)\n", path, i+1, len(paths))
+		start := time.Now()
+		fileOpts := *o
+		fileOpts.state = false
+		res, result, err := runFile(ctx, path, fileOpts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		res.Frequencies = nil
+		multi.Files = append(multi.Files, res)
+		multi.Elapsed = append(multi.Elapsed, time.Since(start))
+		merge(i, result)
+	}
+	return multi, nil
+}
+
+// countUnique sets r.unique from whichever set r holds.
+func (r *runResult) countUnique(mergeWorkers int) {
+	switch {
+	case r.sketch != nil:
+		r.unique = int(r.sketch.estimate())
+	case r.sparse != nil:
+		r.unique = r.sparse.cardinality()
+	case r.bitmap != nil:
+		r.unique = countBits(r.bitmap, mergeWorkers)
+	}
+}
+
+// merge adds the counts and set of r, which it may take over, to total.
+func (total *runResult) merge(r *runResult, mergeWorkers int) {
+	total.lines += r.lines
+	total.filtered += r.filtered
+	total.bytes += r.bytes
+	total.covered += r.covered
+	total.partial = total.partial || r.partial
+	total.occurrences = addWeight(total.occurrences, r.occurrences)
+	for reason, n := range r.invalid {
+		total.invalid[reason] += n
+	}
+	switch {
+	case r.bitmap == nil:
+	case total.bitmap == nil:
+		total.bitmap = r.bitmap
+	default:
+		splitRange(len(total.bitmap), mergeWorkers, func(lo, hi int) error {
+			for i := lo; i < hi; i++ {
+				total.bitmap[i] |= r.bitmap[i]
+			}
+			return nil
+		})
+	}
+	if r.sparse != nil {
+		total.sparse = mergeRoaring([]*roaringBitmap{total.sparse, r.sparse}, mergeWorkers)
+	}
+	if r.frequencies != nil {
+		total.frequencies = mergeFrequencies([]frequencyMap{total.frequencies, r.frequencies})
+	}
+	if r.top != nil {
+		total.top = mergeTop([]*topCounter{total.top, r.top})
+	}
+	if r.v6 != nil {
+		total.v6 = mergeIPv6Sets([]ipv6Set{total.v6, r.v6})
+	}
+	total.sketch = mergeSketch(total.sketch, r.sketch)
+	total.sketch6 = mergeSketch(total.sketch6, r.sketch6)
+}
@@ -0,0 +1,604 @@
+package ipcounter
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"net/netip"
+	"os"
+	"regexp"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"filippo.io/age"
+)
+
+// Option configures a count.
+type Option func(*options)
+
+// options holds the settings that change how chunks are read and counted.
+type options struct {
+	// workers is the number of chunks scanned in parallel.
+	workers int
+	// trim strips padding around the address before parsing.
+	trim bool
+	// weighted reads lines as "address,count" pairs.
+	weighted bool
+	// column, when non-zero, is the 1-based field of delimiter-separated
+	// lines that holds the address; see WithField.
+	column    int
+	delimiter byte
+	// extract, when set, is the WithExtract pattern, and extractGroup the
+	// submatch holding the address.
+	extract      *regexp.Regexp
+	extractGroup int
+	// pcap, when non-zero, reads inputs as packet captures and selects
+	// the addresses taken from their packets.
+	pcap        PcapAddresses
+	inputFormat InputFormat
+	// ipv6 counts IPv6 addresses in a hash set instead of rejecting them.
+	ipv6 bool
+	// hllPrecision, when non-zero, counts into HyperLogLog sketches of
+	// 2^hllPrecision registers instead of bitmaps.
+	hllPrecision uint8
+	// roaring counts into compressed roaring bitmaps instead of dense ones.
+	roaring bool
+	// external writes the IPv4 keys to the partitions of an externalSet
+	// instead of counting them in memory; partitions is the set of the
+	// count under way.
+	external   bool
+	partitions *externalSet
+	// filter, when set, leaves out addresses by prefix; see WithIncludeCIDR.
+	filter *cidrFilter
+	// hostMask holds the address bits cleared by key before counting.
+	hostMask uint32
+	directIO bool
+	// mmap scans chunks from a memory mapping of the input.
+	mmap bool
+	// autoIO picks directIO or mmap per input; see chooseIO.
+	autoIO bool
+	// identities decrypt age-encrypted inputs.
+	identities []age.Identity
+	// preload reads the input into the page cache before the scan.
+	preload bool
+	// prealloc commits the memory of the dense bitmaps before the scan.
+	prealloc bool
+	layout   Layout
+	// blockSize is the filesystem's preferred I/O size; chunk boundaries
+	// are aligned to it and reads are issued in multiples of it.
+	blockSize int64
+	// newHash, when set, hashes the input during the scan.
+	newHash func() hash.Hash
+	// recordPath, when set, names the recording of rejected lines, and
+	// recorder writes it during the count.
+	recordPath string
+	recorder   *invalidRecorder
+	// invalidSamples is how many invalid lines Result.InvalidSamples keeps.
+	invalidSamples int
+	// segmentSize, when non-zero, enables the per-segment unique estimate.
+	segmentSize int64
+	// mergeWorkers is the parallelism of the merge and count phase, which
+	// is CPU-bound and tuned separately from the I/O-bound scan.
+	mergeWorkers int
+	spillDir     string
+	// cacheDir, when set, names the chunk cache directory, and cache
+	// reads and fills it during the count.
+	cacheDir string
+	cache    *chunkCache
+	// frequencies counts the occurrences of each key in Result.Frequencies.
+	frequencies bool
+	// topN, when non-zero, lists the most frequent keys in Result.Top.
+	topN int
+	// summary builds Result.Summary, and state Result.State.
+	summary bool
+	state   bool
+	// keepSet skips the sorted-input path, which builds no set, so that
+	// RunFiles can merge every file's set and WithState save it; reserved
+	// is the memory RunFiles holds for the merged set, left out of the
+	// memory plan.
+	keepSet  bool
+	reserved uint64
+	// spotCheck is the fraction of the input to cross-check, or 0.
+	spotCheck float64
+	// beforeScan runs once every file the count needs is open.
+	beforeScan func() error
+	// stop, when closed, ends the count early with a partial result.
+	stop <-chan struct{}
+	// throttle is called by the workers between batches of lines.
+	throttle func(ctx context.Context) error
+	// progress is called every progressInterval with what tracker counted;
+	// readCounter is the count of the worker holding this copy.
+	progress         func(Progress)
+	progressInterval time.Duration
+	tracker          *progressTracker
+	readCounter      *atomic.Int64
+	logFunc          func(format string, args ...any)
+	formatBytes      func(n uint64) string
+	// err is set by an option given an invalid value.
+	err error
+}
+
+func defaultOptions() options {
+	return options{
+		spillDir:    os.TempDir(),
+		formatBytes: formatIEC,
+	}
+}
+
+// WithWorkers sets how many chunks are scanned in parallel, each into its
+// own 512 MiB bitmap. 0, the default, uses one per CPU.
+func WithWorkers(n int) Option {
+	return func(o *options) { o.workers = n }
+}
+
+// WithMergeWorkers sets the goroutines merging and counting the worker
+// bitmaps. 0, the default, uses one per CPU.
+func WithMergeWorkers(n int) Option {
+	return func(o *options) { o.mergeWorkers = n }
+}
+
+// WithTrim strips surrounding quotes, no-break spaces and byte order marks
+// from each line before parsing, on top of the ASCII whitespace that is
+// always stripped.
+func WithTrim(trim bool) Option {
+	return func(o *options) { o.trim = trim }
+}
+
+// WithField extracts the address from the nth field, counted from 1, of
+// lines split at delimiter, as in CSV or TSV files. A delimiter of ' '
+// splits at runs of whitespace and ignores leading ones, like awk.
+// Quoted fields are not unquoted first, so a quoted delimiter still splits.
+// Lines with fewer than n fields are invalid with ErrMissingField.
+func WithField(delimiter byte, n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			o.err = fmt.Errorf("field number must be at least 1, got %d", n)
+			return
+		}
+		o.column, o.delimiter = n, delimiter
+	}
+}
+
+// WithWeights reads lines as "address,count" pairs from pre-aggregated
+// input, where count is how often the address occurred. Lines with a count
+// of 0 do not make an address present; Result.Occurrences sums the counts.
+func WithWeights(weighted bool) Option {
+	return func(o *options) { o.weighted = weighted }
+}
+
+// WithIPv6 counts IPv6 addresses too, in a hash set whose memory grows
+// with the number of distinct addresses; Result.UniqueIPv6 reports them.
+// IPv4-mapped addresses count as IPv4. WithMask, segment estimates and the
+// spot check cover IPv4 only.
+func WithIPv6(ipv6 bool) Option {
+	return func(o *options) { o.ipv6 = ipv6 }
+}
+
+// WithRoaring counts into compressed roaring bitmaps, which store only the
+// 65536-address blocks that occur, instead of a 512 MiB bitmap per worker.
+// Memory grows with the number of distinct addresses, to at most about the
+// dense size, so it suits inputs with up to some tens of millions of them;
+// WithLayout does not apply.
+func WithRoaring(roaring bool) Option {
+	return func(o *options) { o.roaring = roaring }
+}
+
+// WithExternalSort counts the IPv4 addresses on disk instead of in a
+// bitmap: every valid line appends its address to one of 256 partition
+// files in the WithSpillDir directory, and once the input is read each
+// partition is deduplicated on its own in a 2 MiB bitmap. Memory stays at a
+// few MiB however many distinct addresses there are, at the cost of three
+// bytes of disk per valid line and a second pass over them. Sorted input is
+// still counted without a set. The set is not kept, so it cannot be
+// combined with WithRoaring, WithHyperLogLog, WithState, WithSummary or a
+// spot check, nor used by RunFiles.
+func WithExternalSort(external bool) Option {
+	return func(o *options) { o.external = external }
+}
+
+// WithHyperLogLog estimates the unique counts with HyperLogLog sketches of
+// 2^precision one-byte registers instead of counting them exactly in
+// bitmaps, so each worker needs a few KiB instead of 512 MiB. precision must
+// be between MinHLLPrecision and MaxHLLPrecision; the standard error is about
+// 1.04/sqrt(2^precision). Sorted input is still counted exactly, and there is
+// no spot check. Result.Approximate reports an estimate.
+func WithHyperLogLog(precision int) Option {
+	return func(o *options) {
+		if precision < MinHLLPrecision || precision > MaxHLLPrecision {
+			o.err = fmt.Errorf("invalid HyperLogLog precision %d: want %d to %d", precision, MinHLLPrecision, MaxHLLPrecision)
+			return
+		}
+		o.hllPrecision = uint8(precision)
+	}
+}
+
+// WithIncludeCIDR counts only the addresses inside at least one of the
+// prefixes given here, over all WithIncludeCIDR options. Once any prefix is
+// included, addresses of the other family are left out unless prefixes of
+// theirs are included too. Lines left out are counted in Result.Filtered,
+// not as occurrences; masking with WithMask applies after filtering.
+func WithIncludeCIDR(prefixes ...netip.Prefix) Option {
+	return func(o *options) { o.addFilter(prefixes, true) }
+}
+
+// WithExcludeCIDR leaves out the addresses inside any of the prefixes, such
+// as private ranges, even if WithIncludeCIDR includes them.
+func WithExcludeCIDR(prefixes ...netip.Prefix) Option {
+	return func(o *options) { o.addFilter(prefixes, false) }
+}
+
+func (o *options) addFilter(prefixes []netip.Prefix, include bool) {
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			o.err = fmt.Errorf("invalid prefix %v", p)
+			return
+		}
+		if o.filter == nil {
+			o.filter = &cidrFilter{}
+		}
+		o.filter.add(p, include)
+	}
+}
+
+// WithMask counts unique networks of the given prefix length instead of
+// unique addresses.
+func WithMask(prefixLen int) Option {
+	return func(o *options) {
+		if prefixLen < 0 || prefixLen > 32 {
+			o.err = fmt.Errorf("invalid mask /%d: want a prefix length between /0 and /32", prefixLen)
+			return
+		}
+		o.hostMask = uint32(uint64(1)<<(32-prefixLen) - 1)
+	}
+}
+
+// WithDirectIO reads the input with O_DIRECT, bypassing the page cache. It
+// is only supported on Linux.
+func WithDirectIO(direct bool) Option {
+	return func(o *options) { o.directIO = direct }
+}
+
+// WithMmap maps the input into memory and scans chunks from the mapping,
+// without copying them through read buffers. If the input cannot be mapped
+// it is read as usual. It is only supported on Linux, and the input must
+// not be truncated during the count.
+func WithMmap(mmap bool) Option {
+	return func(o *options) { o.mmap = mmap }
+}
+
+// WithAutoIO chooses between buffered reads, WithMmap and WithDirectIO for
+// each input from its size, whether the device holding it is rotational and
+// the memory available, and logs the choice. It cannot be combined with
+// WithMmap or WithDirectIO, and does not apply to compressed input or
+// streams.
+func WithAutoIO(auto bool) Option {
+	return func(o *options) { o.autoIO = auto }
+}
+
+// WithPrealloc allocates every dense bitmap the count will need, the
+// workers' and the merged one, and touches all of their pages before the
+// scan, so that a host short of memory fails at the start rather than
+// hours in. Roaring bitmaps, sketches, IPv6 sets and frequency maps grow
+// with the input and are not preallocated.
+func WithPrealloc(prealloc bool) Option {
+	return func(o *options) { o.prealloc = prealloc }
+}
+
+// WithPreload reads the input into the page cache with readahead(2) before
+// the workers start, when it fits next to the bitmaps and is not cached
+// already, which speeds up repeated counts of the same input. It is only
+// supported on Linux, and skipped with WithDirectIO and for compressed input
+// and streams.
+func WithPreload(preload bool) Option {
+	return func(o *options) { o.preload = preload }
+}
+
+// WithLayout selects the bitmap layout.
+func WithLayout(l Layout) Option {
+	return func(o *options) { o.layout = l }
+}
+
+// WithHash hashes the input while counting; Result.Digest is the root of a
+// tree hash over HashPieceSize pieces.
+func WithHash(newHash func() hash.Hash) Option {
+	return func(o *options) { o.newHash = newHash }
+}
+
+// WithInvalidRecording writes the raw bytes and offsets of lines that fail
+// to parse to a new file at path; see NewRecordingReader.
+func WithInvalidRecording(path string) Option {
+	return func(o *options) { o.recordPath = path }
+}
+
+// WithInvalidSamples keeps the first n lines that fail to parse, with
+// their offsets, in Result.InvalidSamples, to find where an input is
+// corrupt without recording every invalid line.
+func WithInvalidSamples(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			o.err = fmt.Errorf("invalid sample count must not be negative, got %d", n)
+			return
+		}
+		o.invalidSamples = n
+	}
+}
+
+// WithSegmentSize estimates unique addresses per input segment of size
+// bytes into Result.Segments.
+func WithSegmentSize(size int64) Option {
+	return func(o *options) { o.segmentSize = size }
+}
+
+// WithDecryption decrypts age-encrypted inputs, binary or armored, with
+// the first of identities that fits, as they are read; no plaintext is
+// written anywhere. An encrypted input is counted as a single stream, and
+// one without a fitting identity fails the count.
+func WithDecryption(identities ...age.Identity) Option {
+	return func(o *options) { o.identities = identities }
+}
+
+// WithSpillDir sets where chunk bitmaps are spilled when memory is short,
+// and where WithExternalSort writes its partitions. It defaults to
+// os.TempDir().
+func WithSpillDir(dir string) Option {
+	return func(o *options) { o.spillDir = dir }
+}
+
+// WithChunkCache keeps the set and line counts of every chunk in dir,
+// which must exist, and reuses them when a later count meets the same
+// chunk: the same bytes at the same offsets, counted with the same parsing,
+// mask, filter and counting mode. Re-running with other reports, a saved
+// state or a summary then only reads and hashes the input. Chunks change
+// with WithWorkers. The cache is not used for streams, compressed and
+// remote inputs, nor with WithHash, WithSegmentSize, WithInvalidRecording,
+// WithFrequencies or WithTopN, which need more than the set.
+func WithChunkCache(dir string) Option {
+	return func(o *options) { o.cacheDir = dir }
+}
+
+// WithStop stops the count early when stop is closed, as on an interrupt
+// from the user: the workers stop within 65,536 lines each, and what
+// they counted so far is merged and returned as a partial result, with
+// Result.Partial set and Result.Covered telling how much of the input it
+// covers. Cancelling the context instead abandons the count. A partial
+// count is not spot-checked, and its chunks are not cached.
+func WithStop(stop <-chan struct{}) Option {
+	return func(o *options) { o.stop = stop }
+}
+
+// WithSpotCheck re-parses this fraction of the input with a reference
+// parser and checks that the addresses found are in the result. It detects
+// undercounting in the sample, not overcounting; see SpotCheck.
+func WithSpotCheck(fraction float64) Option {
+	return func(o *options) { o.spotCheck = fraction }
+}
+
+// WithFrequencies counts how often each IPv4 address (or network, with
+// WithMask) occurs, in Result.Frequencies. Each worker keeps a hash map of
+// the keys in its chunk, merged at the end, so memory grows with the number
+// of distinct keys: some 40 bytes each, on top of the unique count's own
+// bitmaps or sketches.
+func WithFrequencies(frequencies bool) Option {
+	return func(o *options) { o.frequencies = frequencies }
+}
+
+// WithTopN lists the n most frequent IPv4 addresses (or networks, with
+// WithMask) in Result.Top. The counts are exact while the input holds at
+// most about a million distinct keys in total: a worker switches to a
+// 64 MiB count-min sketch, which tracks the keys with the highest
+// estimates, once its own keys pass that, and so does the merge once the
+// workers' keys together do. The counts are then upper bounds and
+// Result.TopApproximate is set. With WithFrequencies the list comes from
+// the exact counts instead.
+func WithTopN(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			o.err = fmt.Errorf("top N must not be negative, got %d", n)
+			return
+		}
+		o.topN = n
+	}
+}
+
+// WithSummary describes the counted IPv4 set in Result.Summary, so that
+// runs in different environments can be compared region by region. It
+// takes a pass over the final set, and is skipped for estimates.
+func WithSummary(summary bool) Option {
+	return func(o *options) { o.summary = summary }
+}
+
+// WithState returns the counted set, or the sketches with
+// WithHyperLogLog, in Result.State, to be saved and merged into later
+// counts or those of other machines. The sorted-input path, which builds
+// no set, is skipped.
+func WithState(state bool) Option {
+	return func(o *options) { o.state = state }
+}
+
+// WithBeforeScan sets a function called once every file the count needs
+// (input, recording, spill file) is open and before the scan starts. An
+// error aborts the count. The CLI drops its privileges here.
+func WithBeforeScan(fn func() error) Option {
+	return func(o *options) { o.beforeScan = fn }
+}
+
+// WithThrottle sets a function the workers call every few thousand lines.
+// It may block to pause the scan, for example while the host is under
+// pressure, and must return ctx's error once ctx is done.
+func WithThrottle(wait func(ctx context.Context) error) Option {
+	return func(o *options) { o.throttle = wait }
+}
+
+// WithProgress calls report every interval while the input is read, with
+// the bytes read so far overall and by each worker. report runs on its own
+// goroutine and is not called after the count returns.
+func WithProgress(interval time.Duration, report func(Progress)) Option {
+	return func(o *options) {
+		if interval <= 0 {
+			o.err = fmt.Errorf("progress interval must be positive, got %v", interval)
+			return
+		}
+		o.progress, o.progressInterval = report, interval
+	}
+}
+
+// WithLogf sets where progress messages go; by default there are none.
+func WithLogf(logf func(format string, args ...any)) Option {
+	return func(o *options) { o.logFunc = logf }
+}
+
+// WithBytesFormat sets how byte sizes in progress messages and errors are
+// formatted; the default uses IEC units.
+func WithBytesFormat(format func(n uint64) string) Option {
+	return func(o *options) { o.formatBytes = format }
+}
+
+// formatIEC formats a byte size in IEC units with one decimal place.
+func formatIEC(n uint64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(1024), 0
+	for m := n / 1024; m >= 1024; m /= 1024 {
+		div *= 1024
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// dense reports whether addresses are counted in dense bitmaps.
+func (o options) dense() bool {
+	return o.hllPrecision == 0 && !o.roaring && !o.external
+}
+
+// checkpoint is called by the workers every cancelCheckLines lines.
+func (o options) checkpoint(ctx context.Context) error {
+	if o.throttle != nil {
+		return o.throttle(ctx)
+	}
+	return ctx.Err()
+}
+
+// stopped reports whether WithStop's channel is closed.
+func (o options) stopped() bool {
+	select {
+	case <-o.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o options) logf(format string, args ...any) {
+	if o.logFunc != nil {
+		o.logFunc(format, args...)
+	}
+}
+
+func (o *options) validate() error {
+	if o.workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", o.workers)
+	}
+	if o.err != nil {
+		return o.err
+	}
+	if o.mmap && o.directIO {
+		return fmt.Errorf("memory-mapped input and direct I/O are mutually exclusive")
+	}
+	if o.autoIO && (o.mmap || o.directIO) {
+		return fmt.Errorf("automatic I/O selection cannot be combined with memory-mapped input or direct I/O")
+	}
+	if o.roaring && o.hllPrecision > 0 {
+		return fmt.Errorf("roaring bitmaps and HyperLogLog sketches are mutually exclusive")
+	}
+	if o.external && (o.roaring || o.hllPrecision > 0) {
+		return fmt.Errorf("external sorting cannot be combined with roaring bitmaps or HyperLogLog sketches")
+	}
+	if o.external && (o.state || o.summary || o.spotCheck > 0) {
+		return fmt.Errorf("external sorting keeps no set for a state, summary or spot check")
+	}
+	if o.extract != nil && (o.column > 0 || o.weighted) {
+		return fmt.Errorf("pattern extraction cannot be combined with field extraction or weighted input")
+	}
+	if o.pcap != 0 && (o.column > 0 || o.weighted || o.extract != nil) {
+		return fmt.Errorf("packet captures cannot be combined with field or pattern extraction or weighted input")
+	}
+	if o.pcap != 0 && o.segmentSize > 0 {
+		return fmt.Errorf("segment reports need line offsets, which packet captures have not")
+	}
+	if o.inputFormat == InputBinary4 && (o.column > 0 || o.weighted || o.extract != nil || o.pcap != 0) {
+		return fmt.Errorf("binary input cannot be combined with field or pattern extraction, weighted input or packet captures")
+	}
+	if o.inputFormat == InputBinary4 && o.spotCheck > 0 {
+		return fmt.Errorf("the spot check re-parses text lines, which binary input has not")
+	}
+	if o.column > 0 && o.weighted {
+		return fmt.Errorf("field extraction cannot be combined with weighted input")
+	}
+	if o.state {
+		o.keepSet = true
+	}
+	if o.mergeWorkers < 0 {
+		return fmt.Errorf("merge workers must not be negative, got %d", o.mergeWorkers)
+	}
+	if o.spotCheck < 0 || o.spotCheck > 1 {
+		return fmt.Errorf("spot check fraction %v out of range", o.spotCheck)
+	}
+	if o.segmentSize < 0 {
+		return fmt.Errorf("segment size must not be negative, got %d", o.segmentSize)
+	}
+	if o.workers == 0 {
+		o.workers = runtime.NumCPU()
+	}
+	if o.mergeWorkers == 0 {
+		o.mergeWorkers = runtime.NumCPU()
+	}
+	return nil
+}
+
+const (
+	minReadSize = 1 << 20
+	maxReadSize = 16 << 20
+
+	// linesPerRead is how many typical lines a reader buffer should hold.
+	linesPerRead = 1024
+)
+
+// readSize picks the block size a chunk's lines are read in from its sampled
+// line lengths: room for linesPerRead lines at the 99th percentile length
+// and for twice the longest line seen, between minReadSize and maxReadSize,
+// rounded up to a multiple of the block size. blockLines grows it for
+// longer lines.
+func (o options) readSize(stats lineStats) int {
+	n := int64(minReadSize)
+	if stats.count > 0 {
+		n = max(n, int64(stats.percentile(0.99))*linesPerRead)
+	}
+	n = min(max(n, 2*int64(stats.max)), maxReadSize)
+
+	if o.blockSize > 0 {
+		n = (n + o.blockSize - 1) / o.blockSize * o.blockSize
+	}
+	return int(n)
+}
+
+// chunkAlign is the granularity chunk boundaries must be aligned to, or 0.
+func (o options) chunkAlign() int64 {
+	align := o.blockSize
+	if o.newHash != nil {
+		if align <= 0 {
+			align = HashPieceSize
+		} else {
+			align = align / gcd(align, HashPieceSize) * HashPieceSize
+		}
+	}
+	return align
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
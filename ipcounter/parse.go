@@ -0,0 +1,315 @@
+package ipcounter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Errors ParseIPv4 classifies malformed addresses with. Result.Invalid is
+// keyed by them.
+var (
+	ErrInvalidOctet    = errors.New("invalid octet value")
+	ErrTooManyOctets   = errors.New("too many octets")
+	ErrNotEnoughOctets = errors.New("not enough octets")
+	ErrInvalidChar     = errors.New("invalid character in IP")
+)
+
+// ErrInvalidWeight classifies WithWeights lines whose count column is
+// missing or not a decimal number.
+var ErrInvalidWeight = errors.New("invalid weight")
+
+// ErrMissingField classifies WithField lines with too few fields.
+var ErrMissingField = errors.New("missing field")
+
+// ErrNoMatch classifies WithExtract lines the pattern does not match.
+var ErrNoMatch = errors.New("no match")
+
+// ErrLineTooLong is returned for a line longer than the largest reader
+// buffer, 16 MiB. It aborts the count rather than being counted as an
+// invalid line.
+var ErrLineTooLong = errors.New("line too long")
+
+// InvalidReasons lists the parse errors in the order reports should use.
+var InvalidReasons = []error{ErrInvalidOctet, ErrTooManyOctets, ErrNotEnoughOctets, ErrInvalidChar, ErrInvalidWeight, ErrMissingField, ErrNoMatch}
+
+// ParseLine parses one input line the way a count with the same options
+// would, returning the address and how many occurrences the line stands
+// for.
+func ParseLine(line []byte, opts ...Option) (uint32, uint64, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.parseLine(line)
+}
+
+// parseLine extracts and parses the address on one input line according to
+// the parsing options. The weight is 1 unless WithWeights is set; lines of
+// weight 0 are valid but stand for no occurrence.
+func (o options) parseLine(line []byte) (uint32, uint64, error) {
+	addr, weight, err := o.field(line)
+	if err != nil {
+		return 0, 0, err
+	}
+	ip, err := ParseIPv4(addr)
+	return ip, weight, err
+}
+
+// field splits a line into the address field and its weight. Surrounding
+// ASCII whitespace, such as the \r of a \r\n line end, is always stripped
+// from both; WithTrim strips quotes and the rest of fieldPadding as well.
+func (o options) field(line []byte) ([]byte, uint64, error) {
+	addr, weight := line, uint64(1)
+	if o.extract != nil {
+		var ok bool
+		if addr, ok = o.extracted(line); !ok {
+			return nil, 0, ErrNoMatch
+		}
+	}
+	if o.column > 0 {
+		var ok bool
+		if addr, ok = o.nthField(line); !ok {
+			return nil, 0, ErrMissingField
+		}
+	}
+	if o.weighted {
+		var count []byte
+		var ok bool
+		if addr, count, ok = bytes.Cut(line, []byte(",")); !ok {
+			return nil, 0, ErrInvalidWeight
+		}
+		if o.trim {
+			count = TrimField(count)
+		} else {
+			count = trimSpace(count)
+		}
+		if weight, ok = parseWeight(count); !ok {
+			return nil, 0, ErrInvalidWeight
+		}
+	}
+	if o.trim {
+		addr = TrimField(addr)
+	} else {
+		addr = trimSpace(addr)
+	}
+	return addr, weight, nil
+}
+
+// nthField returns the WithField field of line, or false if the line has
+// fewer fields.
+func (o options) nthField(line []byte) ([]byte, bool) {
+	if o.delimiter == ' ' {
+		for n := 1; ; n++ {
+			line = bytes.TrimLeft(line, lineSpace)
+			if len(line) == 0 {
+				return nil, false
+			}
+			end := bytes.IndexAny(line, lineSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			if n == o.column {
+				return line[:end], true
+			}
+			line = line[end:]
+		}
+	}
+	for n := 1; n < o.column; n++ {
+		i := bytes.IndexByte(line, o.delimiter)
+		if i < 0 {
+			return nil, false
+		}
+		line = line[i+1:]
+	}
+	if i := bytes.IndexByte(line, o.delimiter); i >= 0 {
+		line = line[:i]
+	}
+	return line, true
+}
+
+// lineSpace is the whitespace every field is stripped of.
+const lineSpace = " \t\r\v\f"
+
+// trimSpace strips lineSpace from both ends of b. Nearly every field has
+// none, so the two end bytes are checked before calling bytes.Trim.
+func trimSpace(b []byte) []byte {
+	if len(b) == 0 || b[0] > ' ' && b[len(b)-1] > ' ' {
+		return b
+	}
+	return bytes.Trim(b, lineSpace)
+}
+
+// parseWeight parses a non-empty run of decimal digits that fits in a
+// uint64.
+func parseWeight(b []byte) (uint64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		hi, lo := bits.Mul64(n, 10)
+		lo, carry := bits.Add64(lo, uint64(c-'0'), 0)
+		if hi != 0 || carry != 0 {
+			return 0, false
+		}
+		n = lo
+	}
+	return n, true
+}
+
+// addWeight adds weights, saturating instead of wrapping around.
+func addWeight(a, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
+
+// key maps a parsed address to what is actually deduplicated: the address
+// itself, or its network when WithMask is set.
+func (o options) key(ip uint32) uint32 {
+	return ip &^ o.hostMask
+}
+
+// fieldPadding is what TrimField strips: ASCII whitespace, single and double
+// quotes, and the no-break space and byte order mark that spreadsheet
+// exports tend to leave around values.
+const fieldPadding = " \t\r\v\f\"'\u00a0\ufeff"
+
+// TrimField strips the padding WithTrim removes from each line.
+func TrimField(b []byte) []byte {
+	return bytes.Trim(b, fieldPadding)
+}
+
+// ParseIPv4 parses a dotted-quad address. Well-formed input is handled by
+// parseIPv4Fast; anything it rejects goes through parseIPv4Slow, which is
+// also the only place that decides which error a malformed line gets.
+func ParseIPv4(ipStr []byte) (uint32, error) {
+	if ip, ok := parseIPv4Fast(ipStr); ok {
+		return ip, nil
+	}
+	return parseIPv4Slow(ipStr)
+}
+
+// SWAR (SIMD within a register) constants used by parseIPv4Fast to classify
+// eight input bytes at a time.
+const (
+	swarOnes = 0x0101010101010101
+	swarHigh = 0x8080808080808080
+	swarLow7 = 0x7f7f7f7f7f7f7f7f
+)
+
+// octetWeights[n] holds the decimal place values of the last three bytes of
+// an n-digit octet; positions before the octet get weight 0.
+var octetWeights = [4][3]uint32{{}, {0, 0, 1}, {0, 10, 1}, {100, 10, 1}}
+
+// swarEq sets the high bit of every byte of x equal to c.
+func swarEq(x uint64, c byte) uint64 {
+	v := x ^ (swarOnes * uint64(c))
+	return ^(((v & swarLow7) + swarLow7) | v | swarLow7)
+}
+
+// swarDigits sets the high bit of every byte of x in '0'..'9'.
+func swarDigits(x uint64) uint64 {
+	ge := (x | swarHigh) - swarOnes*'0'
+	le := swarOnes*('9'|0x80) - (x & swarLow7)
+	return ge & le &^ x & swarHigh
+}
+
+// swarMask packs the high bits of the eight bytes of x into the low byte of
+// the result, first byte in bit 0.
+func swarMask(x uint64) uint32 {
+	return uint32(((x >> 7) * 0x0102040810204080) >> 56)
+}
+
+// parseIPv4Fast parses the canonical form "a.b.c.d" with 1-3 digits per
+// octet. Bytes are classified with SWAR masks and octets are computed from
+// the dot positions, so there is no per-character branching. It reports
+// ok=false for any anomaly, including inputs parseIPv4Slow still accepts
+// (empty octets, more than three digits), so callers must fall back.
+func parseIPv4Fast(ipStr []byte) (uint32, bool) {
+	n := len(ipStr)
+	if n < 7 || n > 15 {
+		return 0, false
+	}
+
+	// Two bytes of leading padding let octetAt read three bytes back from
+	// the end of the first octet.
+	var buf [32]byte
+	copy(buf[2:], ipStr)
+	lo := binary.LittleEndian.Uint64(buf[2:])
+	hi := binary.LittleEndian.Uint64(buf[10:])
+
+	dots := swarMask(swarEq(lo, '.')) | swarMask(swarEq(hi, '.'))<<8
+	digits := swarMask(swarDigits(lo)) | swarMask(swarDigits(hi))<<8
+	if dots|digits != 1<<n-1 || bits.OnesCount32(dots) != 3 {
+		return 0, false
+	}
+
+	p1 := bits.TrailingZeros32(dots)
+	dots &= dots - 1
+	p2 := bits.TrailingZeros32(dots)
+	dots &= dots - 1
+	p3 := bits.TrailingZeros32(dots)
+
+	l1, l2, l3, l4 := p1, p2-p1-1, p3-p2-1, n-p3-1
+	if uint(l1-1) >= 3 || uint(l2-1) >= 3 || uint(l3-1) >= 3 || uint(l4-1) >= 3 {
+		return 0, false
+	}
+
+	a := octetAt(&buf, p1, l1)
+	b := octetAt(&buf, p2, l2)
+	c := octetAt(&buf, p3, l3)
+	d := octetAt(&buf, n, l4)
+	if (a|b|c|d)>>8 != 0 {
+		return 0, false
+	}
+	return a<<24 | b<<16 | c<<8 | d, true
+}
+
+// octetAt returns the value of the length-byte octet ending at end (exclusive,
+// relative to the unpadded input).
+func octetAt(buf *[32]byte, end, length int) uint32 {
+	w := &octetWeights[length&3]
+	e := end + 2
+	return w[0]*uint32(buf[(e-3)&31]-'0') + w[1]*uint32(buf[(e-2)&31]-'0') + w[2]*uint32(buf[(e-1)&31]-'0')
+}
+
+func parseIPv4Slow(ipStr []byte) (uint32, error) {
+	var ip uint32
+	var octet uint32
+	var shift uint
+	parts := 0
+
+	for i := 0; i < len(ipStr); i++ {
+		c := ipStr[i]
+		if c >= '0' && c <= '9' {
+			octet = octet*10 + uint32(c-'0')
+			if octet > 255 {
+				return 0, ErrInvalidOctet
+			}
+		} else if c == '.' {
+			if parts >= 3 {
+				return 0, ErrTooManyOctets
+			}
+			ip |= octet << (24 - shift)
+			octet = 0
+			shift += 8
+			parts++
+		} else {
+			return 0, ErrInvalidChar
+		}
+	}
+	ip |= octet << (24 - shift)
+	if parts != 3 {
+		return 0, ErrNotEnoughOctets
+	}
+	return ip, nil
+}
@@ -0,0 +1,108 @@
+package ipcounter
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Inputs for the parser benchmarks: addresses of every octet length, and
+// lines each parser has to reject, the fast one either at once or after
+// classifying the bytes.
+var (
+	wellFormedIPv4 = [][]byte{
+		[]byte("1.2.3.4"),
+		[]byte("10.0.0.1"),
+		[]byte("192.168.1.254"),
+		[]byte("203.0.113.7"),
+		[]byte("255.255.255.255"),
+		[]byte("8.8.4.4"),
+		[]byte("172.16.254.1"),
+		[]byte("100.64.10.200"),
+	}
+	malformedIPv4 = [][]byte{
+		[]byte(""),
+		[]byte("1.2.3"),
+		[]byte("1.2.3.4.5"),
+		[]byte("256.1.1.1"),
+		[]byte("1.2.3.x"),
+		[]byte("1..2.3"),
+		[]byte("0001.2.3.4"),
+		[]byte("192.168.1.1 "),
+		[]byte("2001:db8::1"),
+		[]byte("not an address at all"),
+	}
+)
+
+func benchmarkParse(b *testing.B, inputs [][]byte, parse func([]byte) bool) {
+	var size int
+	for _, in := range inputs {
+		size += len(in)
+	}
+	b.SetBytes(int64(size / len(inputs)))
+	for i := 0; i < b.N; i++ {
+		parse(inputs[i%len(inputs)])
+	}
+}
+
+func BenchmarkParseIPv4Fast(b *testing.B) {
+	fast := func(in []byte) bool {
+		_, ok := parseIPv4Fast(in)
+		return ok
+	}
+	b.Run("well-formed", func(b *testing.B) { benchmarkParse(b, wellFormedIPv4, fast) })
+	b.Run("malformed", func(b *testing.B) { benchmarkParse(b, malformedIPv4, fast) })
+}
+
+func BenchmarkParseIPv4Slow(b *testing.B) {
+	slow := func(in []byte) bool {
+		_, err := parseIPv4Slow(in)
+		return err == nil
+	}
+	b.Run("well-formed", func(b *testing.B) { benchmarkParse(b, wellFormedIPv4, slow) })
+	b.Run("malformed", func(b *testing.B) { benchmarkParse(b, malformedIPv4, slow) })
+}
+
+// canonicalIPv4 reports whether s has the form parseIPv4Fast handles: four
+// dot-separated octets of one to three digits.
+func canonicalIPv4(s []byte) bool {
+	octets := bytes.Split(s, []byte("."))
+	if len(octets) != 4 {
+		return false
+	}
+	for _, octet := range octets {
+		if len(octet) < 1 || len(octet) > 3 {
+			return false
+		}
+		for _, c := range octet {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FuzzParseIPv4 checks that the fast parser agrees with the slow one: what
+// it accepts, the slow one accepts as the same address, and it accepts
+// every canonical address the slow one does, so that it only hands
+// anomalies on.
+func FuzzParseIPv4(f *testing.F) {
+	for _, in := range wellFormedIPv4 {
+		f.Add(in)
+	}
+	for _, in := range malformedIPv4 {
+		f.Add(in)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		fast, ok := parseIPv4Fast(in)
+		slow, err := parseIPv4Slow(in)
+		switch {
+		case ok && err != nil:
+			t.Fatalf("%q: fast parser accepted %#x, slow one failed with %v", in, fast, err)
+		case ok && fast != slow:
+			t.Fatalf("%q: fast parser returned %#x, slow one %#x", in, fast, slow)
+		case !ok && err == nil && canonicalIPv4(in):
+			t.Fatalf("%q: fast parser rejected an address the slow one parsed as %#x", in, slow)
+		}
+	})
+}
@@ -0,0 +1,334 @@
+package ipcounter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// PcapAddresses selects the addresses WithPcap takes from each packet.
+type PcapAddresses uint8
+
+const (
+	PcapSource PcapAddresses = 1 << iota
+	PcapDestination
+)
+
+// WithPcap reads inputs as packet captures, in the pcap or pcapng format,
+// and counts the source or destination addresses, or both, of their IPv4
+// packets, and with WithIPv6 of their IPv6 packets too. Captures are read
+// as a single stream, compressed or not, and packets that are not IP or are
+// cut short before the addresses are skipped. Each address taken counts as
+// a line of the input. It cannot be combined with WithField, WithExtract,
+// WithWeights or WithSegmentSize.
+func WithPcap(addrs PcapAddresses) Option {
+	return func(o *options) { o.pcap = addrs }
+}
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapngSection   = 0x0a0d0d0a
+	pcapngByteOrder = 0x1a2b3c4d
+
+	pcapngInterface      = 1
+	pcapngPacketObsolete = 2
+	pcapngSimplePacket   = 3
+	pcapngEnhancedPacket = 6
+
+	// pcapMaxRecord bounds the packet records and blocks read, so that a
+	// corrupt length does not allocate gigabytes.
+	pcapMaxRecord = 1 << 24
+)
+
+// Link types of the captures pcapLines understands, from the tcpdump.org
+// list of LINKTYPE_ values; 12 and 14 are DLT_RAW values some systems
+// write as is.
+const (
+	linkNull      = 0
+	linkEthernet  = 1
+	linkRaw12     = 12
+	linkRaw14     = 14
+	linkRaw       = 101
+	linkLoop      = 108
+	linkLinuxSLL  = 113
+	linkIPv4      = 228
+	linkIPv6      = 229
+	linkLinuxSLL2 = 276
+)
+
+var errTruncatedCapture = errors.New("truncated packet capture")
+
+// pcapLines reads a packet capture as lines of text, one per address taken
+// from a packet, so that the line scanner counts them like any other input.
+type pcapLines struct {
+	r     *bufio.Reader
+	addrs PcapAddresses
+	ipv6  bool
+	// ng is set for pcapng, whose byte order and interfaces each section
+	// header sets anew; classic pcap has a single link type.
+	ng       bool
+	order    binary.ByteOrder
+	linkType uint32
+	links    []uint32
+
+	record []byte
+	// pending holds the addresses of the last packet, of which next is
+	// the one readLine returns next.
+	pending []netip.Addr
+	next    int
+	line    []byte
+}
+
+// newPcapLines reads the file header of the capture in r.
+func newPcapLines(r *bufio.Reader, addrs PcapAddresses, ipv6 bool) (*pcapLines, error) {
+	p := &pcapLines{r: r, addrs: addrs, ipv6: ipv6}
+	head, err := r.Peek(4)
+	if err != nil {
+		return nil, errTruncatedCapture
+	}
+	switch {
+	case binary.BigEndian.Uint32(head) == pcapngSection:
+		p.ng = true
+		return p, nil
+	case binary.BigEndian.Uint32(head) == pcapMagicMicros, binary.BigEndian.Uint32(head) == pcapMagicNanos:
+		p.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(head) == pcapMagicMicros, binary.LittleEndian.Uint32(head) == pcapMagicNanos:
+		p.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("not a pcap or pcapng file (magic %x)", head)
+	}
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errTruncatedCapture
+	}
+	// The upper bits of the link type field carry FCS information.
+	p.linkType = p.order.Uint32(hdr[20:]) & 0xffff
+	if !linkSupported(p.linkType) {
+		return nil, fmt.Errorf("unsupported link type %d", p.linkType)
+	}
+	return p, nil
+}
+
+func (p *pcapLines) readLine() ([]byte, error) {
+	for p.next == len(p.pending) {
+		packet, linkType, err := p.packet()
+		if err != nil {
+			return nil, err
+		}
+		p.pending, p.next = p.pending[:0], 0
+		p.take(packet, linkType)
+	}
+	p.line = p.pending[p.next].AppendTo(p.line[:0])
+	p.next++
+	return p.line, nil
+}
+
+// packet returns the data of the next packet and its link type.
+func (p *pcapLines) packet() ([]byte, uint32, error) {
+	if p.ng {
+		return p.nextBlock()
+	}
+	var hdr [16]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err == io.EOF {
+		return nil, 0, io.EOF
+	} else if err != nil {
+		return nil, 0, errTruncatedCapture
+	}
+	n := p.order.Uint32(hdr[8:])
+	if n > pcapMaxRecord {
+		return nil, 0, fmt.Errorf("packet record of %d bytes", n)
+	}
+	if err := p.readRecord(int(n)); err != nil {
+		return nil, 0, err
+	}
+	return p.record, p.linkType, nil
+}
+
+// nextBlock returns the next packet of a pcapng capture, reading the
+// section headers and interface descriptions before it.
+func (p *pcapLines) nextBlock() ([]byte, uint32, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(p.r, hdr[:]); err == io.EOF {
+			return nil, 0, io.EOF
+		} else if err != nil {
+			return nil, 0, errTruncatedCapture
+		}
+		if binary.BigEndian.Uint32(hdr[:]) == pcapngSection {
+			// The byte order magic follows the block length, which is in
+			// the byte order it tells.
+			bom, err := p.r.Peek(4)
+			if err != nil {
+				return nil, 0, errTruncatedCapture
+			}
+			switch {
+			case binary.BigEndian.Uint32(bom) == pcapngByteOrder:
+				p.order = binary.BigEndian
+			case binary.LittleEndian.Uint32(bom) == pcapngByteOrder:
+				p.order = binary.LittleEndian
+			default:
+				return nil, 0, fmt.Errorf("invalid pcapng byte order magic %x", bom)
+			}
+			p.links = p.links[:0]
+		} else if p.order == nil {
+			return nil, 0, errors.New("pcapng block before the section header")
+		}
+
+		blockType, length := p.order.Uint32(hdr[:]), p.order.Uint32(hdr[4:])
+		if length < 12 || length%4 != 0 || length > pcapMaxRecord {
+			return nil, 0, fmt.Errorf("invalid pcapng block length %d", length)
+		}
+		if err := p.readRecord(int(length) - 8); err != nil {
+			return nil, 0, err
+		}
+		body := p.record[:len(p.record)-4]
+
+		switch blockType {
+		case pcapngInterface:
+			if len(body) < 8 {
+				return nil, 0, errTruncatedCapture
+			}
+			p.links = append(p.links, uint32(p.order.Uint16(body)))
+		case pcapngEnhancedPacket, pcapngPacketObsolete:
+			// The obsolete packet block has a 16-bit interface ID and a
+			// drop count where the enhanced one has a 32-bit ID.
+			if len(body) < 20 {
+				return nil, 0, errTruncatedCapture
+			}
+			iface := p.order.Uint32(body)
+			if blockType == pcapngPacketObsolete {
+				iface = uint32(p.order.Uint16(body))
+			}
+			n := p.order.Uint32(body[12:])
+			if int64(n) > int64(len(body)-20) {
+				return nil, 0, errTruncatedCapture
+			}
+			linkType, err := p.link(iface)
+			if err != nil {
+				return nil, 0, err
+			}
+			return body[20 : 20+n], linkType, nil
+		case pcapngSimplePacket:
+			if len(body) < 4 {
+				return nil, 0, errTruncatedCapture
+			}
+			// The captured length is what the padded block holds, up to
+			// the original length.
+			n := min(int64(p.order.Uint32(body)), int64(len(body)-4))
+			linkType, err := p.link(0)
+			if err != nil {
+				return nil, 0, err
+			}
+			return body[4 : 4+n], linkType, nil
+		}
+	}
+}
+
+// link returns the link type of pcapng interface i.
+func (p *pcapLines) link(i uint32) (uint32, error) {
+	if int64(i) >= int64(len(p.links)) {
+		return 0, fmt.Errorf("packet of undescribed interface %d", i)
+	}
+	if !linkSupported(p.links[i]) {
+		return 0, fmt.Errorf("unsupported link type %d", p.links[i])
+	}
+	return p.links[i], nil
+}
+
+// readRecord reads the next n bytes into p.record.
+func (p *pcapLines) readRecord(n int) error {
+	if cap(p.record) < n {
+		p.record = make([]byte, n)
+	}
+	p.record = p.record[:n]
+	if _, err := io.ReadFull(p.r, p.record); err != nil {
+		return errTruncatedCapture
+	}
+	return nil
+}
+
+func linkSupported(linkType uint32) bool {
+	switch linkType {
+	case linkNull, linkLoop, linkEthernet, linkRaw, linkRaw12, linkRaw14, linkIPv4, linkIPv6, linkLinuxSLL, linkLinuxSLL2:
+		return true
+	}
+	return false
+}
+
+// take queues the addresses of packet, if it is an IP packet.
+func (p *pcapLines) take(packet []byte, linkType uint32) {
+	ip := networkLayer(packet, linkType)
+	if len(ip) == 0 {
+		return
+	}
+	var src, dst netip.Addr
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return
+		}
+		src, dst = netip.AddrFrom4([4]byte(ip[12:16])), netip.AddrFrom4([4]byte(ip[16:20]))
+	case 6:
+		if len(ip) < 40 || !p.ipv6 {
+			return
+		}
+		src, dst = netip.AddrFrom16([16]byte(ip[8:24])), netip.AddrFrom16([16]byte(ip[24:40]))
+	default:
+		return
+	}
+	if p.addrs&PcapSource != 0 {
+		p.pending = append(p.pending, src)
+	}
+	if p.addrs&PcapDestination != 0 {
+		p.pending = append(p.pending, dst)
+	}
+}
+
+// networkLayer returns the IP header and what follows it in packet, or nil
+// if the packet is not an IP packet.
+func networkLayer(packet []byte, linkType uint32) []byte {
+	var etherType uint16
+	switch linkType {
+	case linkRaw, linkRaw12, linkRaw14, linkIPv4, linkIPv6:
+		return packet
+	case linkNull, linkLoop:
+		// A 4-byte address family, in host or network byte order; the IP
+		// version tells the families apart.
+		if len(packet) < 4 {
+			return nil
+		}
+		return packet[4:]
+	case linkEthernet:
+		if len(packet) < 14 {
+			return nil
+		}
+		etherType, packet = binary.BigEndian.Uint16(packet[12:]), packet[14:]
+		// 802.1Q and 802.1ad tags, possibly stacked.
+		for etherType == 0x8100 || etherType == 0x88a8 || etherType == 0x9100 {
+			if len(packet) < 4 {
+				return nil
+			}
+			etherType, packet = binary.BigEndian.Uint16(packet[2:]), packet[4:]
+		}
+	case linkLinuxSLL:
+		if len(packet) < 16 {
+			return nil
+		}
+		etherType, packet = binary.BigEndian.Uint16(packet[14:]), packet[16:]
+	case linkLinuxSLL2:
+		if len(packet) < 20 {
+			return nil
+		}
+		etherType, packet = binary.BigEndian.Uint16(packet), packet[20:]
+	default:
+		return nil
+	}
+	if etherType != 0x0800 && etherType != 0x86dd {
+		return nil
+	}
+	return packet
+}
@@ -0,0 +1,33 @@
+package ipcounter
+
+import (
+	"os"
+	"time"
+)
+
+// preallocBitmaps allocates n dense bitmaps, or none unless WithPrealloc is
+// set and the count is dense, and writes to every page of them, so that the
+// memory is committed before the scan instead of page by page as the
+// bitmaps fill up. A host that cannot provide it fails now, not hours into
+// the run when the last pages are first touched.
+func preallocBitmaps(n int, opts options) [][]uint64 {
+	if !opts.prealloc || !opts.dense() {
+		return nil
+	}
+	start := time.Now()
+	stride := os.Getpagesize() / 8
+	bitmaps := make([][]uint64, n)
+	for i := range bitmaps {
+		b := make([]uint64, bitmapWords)
+		splitRange(len(b), opts.mergeWorkers, func(lo, hi int) error {
+			for w := lo; w < hi; w += stride {
+				b[w] = 0
+			}
+			return nil
+		})
+		bitmaps[i] = b
+	}
+	opts.logf("preallocated %s for %d bitmaps in %v\n",
+		opts.formatBytes(uint64(n)*bitmapBytes), n, time.Since(start).Round(time.Millisecond))
+	return bitmaps
+}
@@ -0,0 +1,60 @@
+package ipcounter
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// preloadStep is how much of the input each readahead call asks for, so
+// that a cancelled count stops preloading promptly.
+const preloadStep = 16 << 20
+
+// preload pulls the input into the page cache before the workers start, as
+// WithPreload asks, when the page cache can hold it next to the bitmaps.
+// Inputs already cached are left alone; failures only cost the speedup and
+// are logged.
+func preload(ctx context.Context, in *input, o options) error {
+	switch {
+	case in.size == 0:
+		return nil
+	case o.directIO:
+		o.logf("not preloading the input: direct I/O bypasses the page cache\n")
+		return nil
+	}
+	file, ok := in.file.(*os.File)
+	if !ok {
+		return nil
+	}
+	available, haveAvailable := availableMemory()
+	if plan, err := planMemory(o.workers, available, haveAvailable, o); err == nil {
+		available -= min(available, plan.peak)
+	}
+	if haveAvailable && uint64(in.size) > available {
+		o.logf("not preloading the input: %s does not fit in the %s of memory left for the page cache\n",
+			o.formatBytes(uint64(in.size)), o.formatBytes(available))
+		return nil
+	}
+
+	cached, err := residentFraction(file, in.size)
+	if err != nil {
+		o.logf("cannot tell how much of the input is cached (%v), preloading all of it\n", err)
+	} else if cached >= 1 {
+		o.logf("input is already in the page cache, not preloading it\n")
+		return nil
+	}
+
+	start := time.Now()
+	for offset := int64(0); offset < in.size; offset += preloadStep {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := readahead(file, offset, min(preloadStep, in.size-offset)); err != nil {
+			o.logf("preloading the input failed (%v), continuing without it\n", err)
+			return nil
+		}
+	}
+	o.logf("preloaded %s into the page cache (%.0f%% was cached before) in %v\n",
+		o.formatBytes(uint64(in.size)), 100*max(cached, 0), time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,40 @@
+package ipcounter
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// residentFraction reports which part of the first size bytes of file is in
+// the page cache, from mincore(2) on a mapping of it.
+func residentFraction(file *os.File, size int64) (float64, error) {
+	data, err := mapFile(file, size)
+	if err != nil {
+		return 0, err
+	}
+	defer unmapFile(data)
+
+	pageSize := int64(os.Getpagesize())
+	vec := make([]byte, (size+pageSize-1)/pageSize)
+	_, _, errno := syscall.Syscall(syscall.SYS_MINCORE,
+		uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return 0, errno
+	}
+	resident := 0
+	for _, v := range vec {
+		resident += int(v & 1)
+	}
+	return float64(resident) / float64(len(vec)), nil
+}
+
+// readahead asks the kernel to read [offset, offset+n) of file into the
+// page cache with readahead(2).
+func readahead(file *os.File, offset, n int64) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_READAHEAD, file.Fd(), uintptr(offset), uintptr(n))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
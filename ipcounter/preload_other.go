@@ -0,0 +1,18 @@
+//go:build !linux
+
+package ipcounter
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoPreload = errors.New("preloading is only supported on Linux")
+
+func residentFraction(file *os.File, size int64) (float64, error) {
+	return 0, errNoPreload
+}
+
+func readahead(file *os.File, offset, n int64) error {
+	return errNoPreload
+}
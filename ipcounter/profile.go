@@ -0,0 +1,443 @@
+package ipcounter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+)
+
+const (
+	// profileWindows and profileWindowSize place the windows Profile reads
+	// from a plain file, spread evenly over it like looksSorted's.
+	profileWindows    = 64
+	profileWindowSize = 64 << 10
+	// profileStreamSize is how much of the start of a compressed, encrypted
+	// or piped input Profile reads, after decompression.
+	profileStreamSize = profileWindows * profileWindowSize
+)
+
+// profileDelimiters are the field delimiters Profile tries, ' ' meaning
+// runs of whitespace as for WithField.
+var profileDelimiters = []byte{',', '\t', ';', '|', ' '}
+
+// profileMinSorted is how many IPv4 addresses a sample needs for Profile
+// to call it sorted.
+const profileMinSorted = 100
+
+// profileMaxFields bounds the field numbers Profile tries for each
+// delimiter.
+const profileMaxFields = 16
+
+// DatasetProfile describes an input as seen in a sample of it, to choose
+// the parser flags and backend of a count before running it.
+type DatasetProfile struct {
+	Path string
+	// Size is the size of the input in bytes, or -1 when it is not known,
+	// as for stdin.
+	Size        int64
+	Compression string
+	Encrypted   bool
+
+	// SampledBytes and Lines are the decompressed bytes read and the
+	// complete lines in them; Windows is how many places they were read
+	// from, 1 for the start of a stream.
+	Windows      int
+	SampledBytes int64
+	Lines        int64
+	// EstimatedLines extrapolates Lines to the whole input when its size
+	// is known and it is not compressed; it is 0 otherwise.
+	EstimatedLines int64
+
+	// CRLFLines end in \r\n, the rest in \n. PaddedLines have whitespace
+	// around the address and QuotedLines quotes, no-break spaces or byte
+	// order marks, which only WithTrim strips.
+	CRLFLines   int64
+	PaddedLines int64
+	QuotedLines int64
+
+	// Format is the line layout that parses the most lines: "plain",
+	// "weighted", or "field N" with the delimiter in Delimiter.
+	Format    string
+	Column    int
+	Delimiter byte
+	Weighted  bool
+	Trim      bool
+
+	// Valid lines hold an address in Format, IPv6 of them IPv6 ones;
+	// Invalid counts the rest by cause, keyed by the InvalidReasons
+	// messages.
+	Valid   int64
+	IPv6    int64
+	Invalid map[string]int64
+	// FirstOctets counts the valid IPv4 addresses by their first octet.
+	FirstOctets [256]int64
+
+	// Distinct is how many different addresses the sample holds; Sorted is
+	// set when the addresses in each window are in ascending order.
+	Distinct int64
+	Sorted   bool
+
+	// Flags and Backend are the command-line flags and the counting
+	// backend suggested for the input.
+	Flags   []string
+	Backend string
+}
+
+// InvalidRate is the share of the sampled lines that are invalid.
+func (p *DatasetProfile) InvalidRate() float64 {
+	if p.Lines == 0 {
+		return 0
+	}
+	return float64(p.Lines-p.Valid) / float64(p.Lines)
+}
+
+// DuplicateRate is the share of the valid sampled lines that repeat an
+// address seen earlier in the sample. Over a sample it underestimates the
+// duplication of the whole input, where repeats may lie far apart.
+func (p *DatasetProfile) DuplicateRate() float64 {
+	if p.Valid == 0 {
+		return 0
+	}
+	return 1 - float64(p.Distinct)/float64(p.Valid)
+}
+
+// Profile samples the input at path, "-" for stdin, and reports its format
+// and what is in it. Plain files are sampled in windows spread over them;
+// other inputs from their start. Compressed inputs are decompressed and,
+// with WithDecryption, encrypted ones decrypted; the other options are
+// ignored, since the parsing options are what the profile is for.
+func Profile(ctx context.Context, path string, opts ...Option) (*DatasetProfile, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	p := &DatasetProfile{Path: path, Size: -1, Compression: uncompressed.String()}
+	windows, err := p.sample(ctx, path, o)
+	if err != nil {
+		return nil, err
+	}
+	p.analyze(windows)
+	return p, nil
+}
+
+// sample reads the sample of the input as windows of complete lines.
+func (p *DatasetProfile) sample(ctx context.Context, path string, o options) ([][][]byte, error) {
+	var r io.ReaderAt
+	switch {
+	case path == "-":
+		return p.sampleStream(os.Stdin, o)
+	case IsRemote(path):
+		obj, err := openRemote(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		defer obj.Close()
+		p.Size = obj.size
+		if !obj.ranges {
+			body := obj.openRange(0)
+			defer body.Close()
+			return p.sampleStream(body, o)
+		}
+		r = obj
+	default:
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return p.sampleStream(file, o)
+		}
+		p.Size = info.Size()
+		r = file
+	}
+
+	head := make([]byte, encryptionMagicLen)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	if isEncrypted(head) || detectCompression(head) != uncompressed || p.Size <= profileStreamSize {
+		return p.sampleStream(io.NewSectionReader(r, 0, p.Size), o)
+	}
+
+	windows := make([][][]byte, profileWindows)
+	for w := range windows {
+		offset := p.Size * int64(w) / profileWindows
+		buf := make([]byte, profileWindowSize)
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = buf[:n]
+		if offset > 0 {
+			// Skip the line the window starts in the middle of.
+			i := bytes.IndexByte(buf, '\n')
+			if i < 0 {
+				continue
+			}
+			buf = buf[i+1:]
+		}
+		p.SampledBytes += int64(len(buf))
+		windows[w] = sampleLines(buf, offset+int64(n) >= p.Size)
+	}
+	p.Windows = profileWindows
+	p.EstimatedLines = p.Size * int64(sampledLines(windows)) / max(p.SampledBytes, 1)
+	return windows, nil
+}
+
+// sampleStream reads the first profileStreamSize bytes of r, after
+// decrypting and decompressing it, as one window.
+func (p *DatasetProfile) sampleStream(r io.Reader, o options) ([][][]byte, error) {
+	reader := bufio.NewReader(r)
+	if head, _ := reader.Peek(encryptionMagicLen); isEncrypted(head) {
+		p.Encrypted = true
+		dr, err := o.decrypt(reader, head)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt: %v", err)
+		}
+		reader = bufio.NewReader(dr)
+	}
+	head, _ := reader.Peek(compressionMagicLen)
+	c := detectCompression(head)
+	p.Compression = c.String()
+	if c != uncompressed {
+		dr, err := decompress(c, reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start decompressing: %v", err)
+		}
+		defer dr.Close()
+		reader = bufio.NewReader(dr)
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(reader, profileStreamSize+1))
+	if err != nil {
+		return nil, err
+	}
+	complete := len(buf) <= profileStreamSize
+	if !complete {
+		buf = buf[:profileStreamSize]
+	}
+	p.Windows = 1
+	windows := [][][]byte{sampleLines(buf, complete)}
+	for _, line := range windows[0] {
+		p.SampledBytes += int64(len(line)) + 1
+	}
+	if complete {
+		p.SampledBytes = int64(len(buf))
+		if c == uncompressed && !p.Encrypted {
+			p.EstimatedLines = int64(sampledLines(windows))
+		}
+	} else if c == uncompressed && !p.Encrypted && p.Size > 0 {
+		p.EstimatedLines = p.Size * int64(sampledLines(windows)) / max(p.SampledBytes, 1)
+	}
+	return windows, nil
+}
+
+// sampleLines splits buf into lines without their \n, dropping the last
+// one unless it is complete or buf ends the input.
+func sampleLines(buf []byte, last bool) [][]byte {
+	lines := bytes.Split(buf, []byte("\n"))
+	if n := len(lines); len(lines[n-1]) == 0 || !last {
+		lines = lines[:n-1]
+	}
+	return lines
+}
+
+func sampledLines(windows [][][]byte) int {
+	n := 0
+	for _, lines := range windows {
+		n += len(lines)
+	}
+	return n
+}
+
+// profileCandidates returns the parsing options Profile tries, simplest
+// first so that a tie goes to the layout needing the fewest flags.
+func profileCandidates(windows [][][]byte) []options {
+	candidates := []options{{ipv6: true}, {ipv6: true, weighted: true}}
+	for _, delim := range profileDelimiters {
+		fields := 0
+		for _, lines := range windows {
+			for _, line := range lines {
+				o := options{column: 1, delimiter: delim}
+				for o.column <= profileMaxFields {
+					if _, ok := o.nthField(line); !ok {
+						break
+					}
+					o.column++
+				}
+				fields = max(fields, o.column-1)
+			}
+		}
+		if fields < 2 {
+			continue
+		}
+		for column := 1; column <= fields; column++ {
+			candidates = append(candidates, options{ipv6: true, column: column, delimiter: delim})
+		}
+	}
+	return candidates
+}
+
+// analyze picks the layout that parses the most sampled lines, with and
+// without WithTrim, and profiles the lines with it.
+func (p *DatasetProfile) analyze(windows [][][]byte) {
+	valid := func(o options) (n int64) {
+		for _, lines := range windows {
+			for _, line := range lines {
+				if _, _, _, err := o.parseAny(line); err == nil {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	var best options
+	bestValid := int64(-1)
+	for _, o := range profileCandidates(windows) {
+		if n := valid(o); n > bestValid {
+			best, bestValid = o, n
+		}
+	}
+	trimmed := best
+	trimmed.trim = true
+	if valid(trimmed) > bestValid {
+		best = trimmed
+	}
+	p.Column, p.Delimiter, p.Weighted, p.Trim = best.column, best.delimiter, best.weighted, best.trim
+	switch {
+	case best.weighted:
+		p.Format = "weighted"
+	case best.column > 0:
+		p.Format = fmt.Sprintf("field %d", best.column)
+	default:
+		p.Format = "plain"
+	}
+
+	p.Invalid = make(map[string]int64)
+	plain := best
+	plain.trim = false
+	seen4 := make(map[uint32]struct{})
+	seen6 := make(map[netip.Addr]struct{})
+	p.Sorted = true
+	ordered := 0
+	for _, lines := range windows {
+		var prev uint32
+		first := true
+		for _, line := range lines {
+			p.Lines++
+			if bytes.HasSuffix(line, []byte("\r")) {
+				p.CRLFLines++
+			}
+			if addr, _, err := plain.field(line); err == nil {
+				switch raw := p.rawField(line, best); {
+				case !bytes.Equal(TrimField(addr), addr):
+					p.QuotedLines++
+				case len(raw) != len(addr):
+					p.PaddedLines++
+				}
+			}
+
+			ip, ip6, _, err := best.parseAny(line)
+			if err != nil {
+				p.Invalid[err.Error()]++
+				continue
+			}
+			p.Valid++
+			if ip6.IsValid() {
+				p.IPv6++
+				seen6[ip6] = struct{}{}
+				continue
+			}
+			p.FirstOctets[ip>>24]++
+			seen4[ip] = struct{}{}
+			if !first && ip < prev {
+				p.Sorted = false
+			}
+			prev, first = ip, false
+			ordered++
+		}
+	}
+	p.Distinct = int64(len(seen4) + len(seen6))
+	// A sample of a few lines says nothing about the order.
+	p.Sorted = p.Sorted && ordered >= profileMinSorted
+	p.suggest()
+}
+
+// rawField is the address field of line in layout o before any whitespace
+// is stripped from it.
+func (p *DatasetProfile) rawField(line []byte, o options) []byte {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if o.column > 0 {
+		f, _ := o.nthField(line)
+		return f
+	}
+	if o.weighted {
+		f, _, _ := bytes.Cut(line, []byte(","))
+		return f
+	}
+	return line
+}
+
+// suggest fills in Flags and Backend. Sorted inputs are detected and
+// counted without a bitmap; otherwise a sparse roaring bitmap is suggested when the sample
+// points to fewer distinct addresses than the dense bitmap's break-even,
+// a 512 MiB bitmap holding 2^32 bits against about two bytes per address.
+func (p *DatasetProfile) suggest() {
+	p.Flags = nil
+	switch {
+	case p.Weighted:
+		p.Flags = append(p.Flags, "-weighted")
+	case p.Column > 0:
+		p.Flags = append(p.Flags, fmt.Sprintf("-field=%d", p.Column))
+		if p.Delimiter != ',' {
+			p.Flags = append(p.Flags, "-delimiter="+delimiterName(p.Delimiter))
+		}
+	}
+	if p.Trim {
+		p.Flags = append(p.Flags, "-trim")
+	}
+	if p.IPv6 > 0 {
+		p.Flags = append(p.Flags, "-ipv6")
+	}
+
+	const roaringBreakEven = 1 << 28
+	lines := p.EstimatedLines
+	if lines == 0 {
+		lines = p.Lines
+	}
+	switch {
+	case p.Sorted:
+		p.Backend = "sorted"
+	case p.Valid > 0 && float64(lines)*float64(p.Distinct)/float64(p.Valid) < roaringBreakEven && p.EstimatedLines > 0:
+		p.Backend = "roaring"
+		p.Flags = append(p.Flags, "-mode=roaring")
+	default:
+		p.Backend = "dense"
+	}
+}
+
+// delimiterName spells a delimiter the way the -delimiter flag takes it.
+func delimiterName(d byte) string {
+	switch d {
+	case '\t':
+		return "tab"
+	case ' ':
+		return "space"
+	}
+	return string(d)
+}
@@ -0,0 +1,141 @@
+package ipcounter
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a snapshot of a running count, passed to the WithProgress
+// callback. Byte counts are of the input as stored, before decompression.
+type Progress struct {
+	// Read is the number of input bytes read so far.
+	Read int64
+	// Size is the input size, or -1 for a stream of unknown length.
+	Size int64
+	// Workers holds the bytes read by each worker.
+	Workers []int64
+	Elapsed time.Duration
+}
+
+// Fraction returns the part of the input read, between 0 and 1, or -1 if
+// the size is unknown.
+func (p Progress) Fraction() float64 {
+	switch {
+	case p.Size < 0:
+		return -1
+	case p.Size == 0:
+		return 1
+	}
+	return min(1, float64(p.Read)/float64(p.Size))
+}
+
+// Rate returns the average throughput so far in bytes per second.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Read) / p.Elapsed.Seconds()
+}
+
+// Remaining estimates the time left at the average rate so far, or returns
+// -1 if it cannot be estimated yet.
+func (p Progress) Remaining() time.Duration {
+	rate := p.Rate()
+	if p.Size < 0 || rate == 0 {
+		return -1
+	}
+	return time.Duration(float64(max(0, p.Size-p.Read)) / rate * float64(time.Second))
+}
+
+// progressTracker counts the bytes each worker reads. Readers read ahead of
+// the lines being scanned by at most one buffer, which is close enough.
+type progressTracker struct {
+	size    int64
+	start   time.Time
+	workers []atomic.Int64
+}
+
+// startProgress calls the WithProgress callback every interval until the
+// returned function is called, and sets o.tracker for the workers to count
+// their reads in. size is the input size or -1.
+func (o *options) startProgress(size int64, workers int) (stop func()) {
+	if o.progress == nil {
+		return func() {}
+	}
+	t := &progressTracker{size: size, start: time.Now(), workers: make([]atomic.Int64, workers)}
+	o.tracker = t
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(o.progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				o.progress(t.snapshot())
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// worker returns the read counter of worker i, or nil if progress is not
+// tracked.
+func (t *progressTracker) worker(i int) *atomic.Int64 {
+	if t == nil || i >= len(t.workers) {
+		return nil
+	}
+	return &t.workers[i]
+}
+
+// reset forgets the bytes read so far, when a pass is abandoned and the
+// input is read again.
+func (t *progressTracker) reset() {
+	if t == nil {
+		return
+	}
+	for i := range t.workers {
+		t.workers[i].Store(0)
+	}
+}
+
+func (t *progressTracker) snapshot() Progress {
+	p := Progress{Size: t.size, Workers: make([]int64, len(t.workers)), Elapsed: time.Since(t.start)}
+	for i := range t.workers {
+		p.Workers[i] = t.workers[i].Load()
+		p.Read += p.Workers[i]
+	}
+	if t.size >= 0 {
+		p.Read = min(p.Read, t.size)
+	}
+	return p
+}
+
+// countReads wraps r to add the bytes read from it to n, if n is not nil.
+func countReads(r io.Reader, n *atomic.Int64) io.Reader {
+	if n == nil {
+		return r
+	}
+	return &countingReader{r: r, n: n}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
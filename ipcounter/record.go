@@ -0,0 +1,121 @@
+package ipcounter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// InvalidLine is a line that failed to parse: its byte offset in the input,
+// decompressed if it was compressed, the line without its line end, and
+// why it was rejected, one of InvalidReasons.
+type InvalidLine struct {
+	Offset int64
+	Line   []byte
+	Reason error
+}
+
+// Invalid-line recordings start with recordMagic, followed by one record per
+// line that failed to parse: the line's byte offset in the input (uint64),
+// its length (uint32), both little-endian, and the raw line without its
+// terminating newline.
+const recordMagic = "IPCINV1\n"
+
+// invalidRecorder appends rejected lines to a recording. It is shared by all
+// workers, so records are in no particular order.
+type invalidRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+func createInvalidRecorder(fileName string) (*invalidRecorder, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	// The magic goes straight to the file, as reset truncates back to it
+	// and drops whatever is still buffered.
+	if _, err := file.WriteString(recordMagic); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &invalidRecorder{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (r *invalidRecorder) record(offset int64, line []byte) error {
+	var hdr [12]byte
+	binary.LittleEndian.PutUint64(hdr[:8], uint64(offset))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(line)))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := r.w.Write(line)
+	return err
+}
+
+// reset drops everything recorded so far, for when a pass is abandoned and
+// the input is scanned again.
+func (r *invalidRecorder) reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Reset(r.file)
+	if err := r.file.Truncate(int64(len(recordMagic))); err != nil {
+		return err
+	}
+	_, err := r.file.Seek(int64(len(recordMagic)), io.SeekStart)
+	return err
+}
+
+func (r *invalidRecorder) Close() error {
+	err := r.w.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ErrNotRecording is returned by NewRecordingReader for input that does not
+// start with the recording magic.
+var ErrNotRecording = errors.New("not an invalid-line recording")
+
+// RecordingReader reads back a recording made with WithInvalidRecording.
+type RecordingReader struct {
+	r *bufio.Reader
+}
+
+// NewRecordingReader checks the recording header and returns a reader
+// positioned at the first record.
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != recordMagic {
+		return nil, ErrNotRecording
+	}
+	return &RecordingReader{r: reader}, nil
+}
+
+// Next returns the offset and raw bytes of the next recorded line. It
+// returns io.EOF at a clean end of the recording.
+func (r *RecordingReader) Next() (int64, []byte, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated record header")
+		}
+		return 0, nil, err
+	}
+
+	line := make([]byte, binary.LittleEndian.Uint32(hdr[8:]))
+	if _, err := io.ReadFull(r.r, line); err != nil {
+		return 0, nil, fmt.Errorf("truncated record: %v", err)
+	}
+	return int64(binary.LittleEndian.Uint64(hdr[:8])), line, nil
+}
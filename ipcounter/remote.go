@@ -0,0 +1,252 @@
+package ipcounter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsRemote reports whether path names a remote object, an http://,
+// https:// or s3:// URL, rather than a local file.
+func IsRemote(path string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://"} {
+		if len(path) > len(scheme) && strings.EqualFold(path[:len(scheme)], scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// remoteRetries is how often a read of a remote object is resumed after
+	// a failed request or a dropped connection, remoteRetryDelay the wait
+	// before the first retry, doubling each time.
+	remoteRetries    = 5
+	remoteRetryDelay = 500 * time.Millisecond
+)
+
+// remoteObject reads an object over HTTP with ranged GETs: ReadAt fetches
+// just the bytes asked for, and each chunk is streamed by a GET of its own
+// from its offset on, so that the workers read their chunks in parallel as
+// they would from a local file. S3 objects are fetched from their HTTPS
+// endpoint, with requests signed when credentials are configured.
+type remoteObject struct {
+	// ctx bounds every request; ReadAt has no context of its own.
+	ctx  context.Context
+	url  string
+	sign func(*http.Request)
+	size int64
+	// ranges is false when the server ignores Range headers; the object
+	// can then only be read as a stream.
+	ranges bool
+}
+
+// openRemote finds the size of the object at url and whether the server
+// serves byte ranges, with a GET of its first byte.
+func openRemote(ctx context.Context, url string) (*remoteObject, error) {
+	obj := &remoteObject{ctx: ctx, url: url}
+	if strings.HasPrefix(strings.ToLower(url), "s3://") {
+		var err error
+		if obj.url, obj.sign, err = s3Endpoint(url); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := obj.get(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/size
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if obj.size, err = strconv.ParseInt(total, 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: unexpected Content-Range %q", obj.url, resp.Header.Get("Content-Range"))
+		}
+		obj.ranges = true
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Only an empty object has no first byte.
+		obj.size = 0
+	default:
+		obj.size = resp.ContentLength
+	}
+	return obj, nil
+}
+
+// get requests the bytes from from to to, inclusive, or to the end for a
+// negative to. Any status other than 200, 206 and 416 is an error.
+func (obj *remoteObject) get(from, to int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(obj.ctx, http.MethodGet, obj.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if to < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to))
+	}
+	if obj.sign != nil {
+		obj.sign(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("GET %s: %s", obj.url, resp.Status)
+}
+
+func (obj *remoteObject) ReadAt(p []byte, off int64) (int, error) {
+	if off >= obj.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), obj.size)
+	r := obj.openRangeTo(off, end-1)
+	defer r.Close()
+	n, err := io.ReadFull(r, p[:end-off])
+	if err == nil && end-off < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (obj *remoteObject) Close() error {
+	return nil
+}
+
+// openRange returns a reader of the object from offset to its end.
+func (obj *remoteObject) openRange(offset int64) io.ReadCloser {
+	return obj.openRangeTo(offset, -1)
+}
+
+func (obj *remoteObject) openRangeTo(from, to int64) io.ReadCloser {
+	return &remoteReader{obj: obj, pos: from, to: to}
+}
+
+// remoteReader streams a range of a remote object. The request is sent on
+// the first Read; a request that fails or a body that breaks off is
+// resumed from where it stopped, up to remoteRetries times in a row.
+type remoteReader struct {
+	obj     *remoteObject
+	pos, to int64
+	body    io.ReadCloser
+	retries int
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	for {
+		if r.to >= 0 && r.pos > r.to {
+			return 0, io.EOF
+		}
+		if r.body == nil {
+			resp, err := r.obj.get(r.pos, r.to)
+			if err == nil && resp.StatusCode == http.StatusOK && r.pos > 0 {
+				resp.Body.Close()
+				return 0, fmt.Errorf("%s: the server does not serve byte ranges", r.obj.url)
+			}
+			if err == nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				resp.Body.Close()
+				return 0, io.EOF
+			}
+			if err != nil {
+				if rerr := r.retry(err); rerr != nil {
+					return 0, rerr
+				}
+				continue
+			}
+			r.body = resp.Body
+		}
+
+		n, err := r.body.Read(p)
+		r.pos += int64(n)
+		if n > 0 {
+			r.retries = 0
+		}
+		done := r.to >= 0 && r.pos > r.to || r.to < 0 && r.pos >= r.obj.size
+		switch {
+		case err == nil:
+			return n, nil
+		case err == io.EOF && done:
+			return n, io.EOF
+		case err == io.EOF:
+			err = io.ErrUnexpectedEOF
+		}
+		r.body.Close()
+		r.body = nil
+		if rerr := r.retry(err); rerr != nil {
+			return n, rerr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// retry waits before the next attempt after err, or returns err once the
+// retries are used up or the context is done.
+func (r *remoteReader) retry(err error) error {
+	if r.retries >= remoteRetries || r.obj.ctx.Err() != nil {
+		return err
+	}
+	delay := remoteRetryDelay << r.retries
+	r.retries++
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-r.obj.ctx.Done():
+		return errors.Join(err, r.obj.ctx.Err())
+	}
+}
+
+func (r *remoteReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// runRemote counts the object at a URL: in chunks read by ranged GETs like
+// a local file, or as a single stream when it is compressed or encrypted or
+// the server ignores ranges. Direct I/O, memory mapping and preloading do not apply.
+func runRemote(ctx context.Context, url string, o options) (*Result, *runResult, error) {
+	o.directIO, o.mmap, o.autoIO, o.preload = false, false, false, false
+	obj, err := openRemote(ctx, url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open input: %v", err)
+	}
+
+	head := make([]byte, max(compressionMagicLen, encryptionMagicLen))
+	n := 0
+	if obj.ranges {
+		if n, err = obj.ReadAt(head, 0); err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("failed to read input: %v", err)
+		}
+	}
+	if !obj.ranges || o.pcap != 0 || detectCompression(head[:n]) != uncompressed || isEncrypted(head[:n]) {
+		if !obj.ranges {
+			o.logf("warning: %s does not serve byte ranges, reading it as a single stream\n", url)
+		}
+		body := obj.openRange(0)
+		defer body.Close()
+		result, err := runStream(ctx, body, obj.size, o)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newResult(result, o), result, nil
+	}
+
+	o.logf("reading %s of %s with ranged GETs\n", o.formatBytes(uint64(obj.size)), url)
+	in := &input{file: obj, remote: obj, size: obj.size}
+	defer in.Close()
+	return countInput(ctx, in, o)
+}
@@ -0,0 +1,351 @@
+package ipcounter
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+)
+
+const (
+	roaringContainers = 1 << 16
+	// roaringArrayMax is the most addresses a container keeps in a sorted
+	// array; at 2 bytes each, that is the size of its bitmap form.
+	roaringArrayMax = 4096
+	roaringWords    = 1 << 16 / 64
+)
+
+// roaringBitmap is a compressed bitmap in the style of Roaring: the IPv4
+// space is split by the top 16 bits into containers allocated on first use,
+// each holding the low 16 bits of its addresses in a sorted array while it
+// has at most roaringArrayMax of them and in an 8 KiB bitmap beyond that.
+// An input with a few million distinct addresses needs a few MiB instead of
+// the dense bitmap's 512 MiB. Layouts do not apply.
+type roaringBitmap struct {
+	containers []*roaringContainer
+}
+
+type roaringContainer struct {
+	array []uint16
+	// bitmap replaces array once the container is full; n counts its bits.
+	bitmap *[roaringWords]uint64
+	n      int
+}
+
+func newRoaringBitmap() *roaringBitmap {
+	return &roaringBitmap{containers: make([]*roaringContainer, roaringContainers)}
+}
+
+func (r *roaringBitmap) add(ip uint32) {
+	c := r.containers[ip>>16]
+	if c == nil {
+		c = &roaringContainer{}
+		r.containers[ip>>16] = c
+	}
+	c.add(uint16(ip))
+}
+
+func (r *roaringBitmap) contains(ip uint32) bool {
+	c := r.containers[ip>>16]
+	if c == nil {
+		return false
+	}
+	low := uint16(ip)
+	if c.bitmap != nil {
+		return c.bitmap[low/64]&(1<<(low%64)) != 0
+	}
+	_, found := slices.BinarySearch(c.array, low)
+	return found
+}
+
+// each calls fn with the addresses in r in ascending order.
+func (r *roaringBitmap) each(fn func(ip uint32)) {
+	r.eachRange(0, math.MaxUint32, fn)
+}
+
+// eachRange calls fn for the addresses of r in [lo, hi] in ascending order.
+func (r *roaringBitmap) eachRange(lo, hi uint32, fn func(ip uint32)) {
+	for key := lo >> 16; key <= hi>>16; key++ {
+		c := r.containers[key]
+		switch {
+		case c == nil:
+		case c.bitmap != nil:
+			for i, word := range c.bitmap {
+				for ; word != 0; word &= word - 1 {
+					if ip := key<<16 | uint32(i*64+bits.TrailingZeros64(word)); ip >= lo && ip <= hi {
+						fn(ip)
+					}
+				}
+			}
+		default:
+			for _, low := range c.array {
+				if ip := key<<16 | uint32(low); ip >= lo && ip <= hi {
+					fn(ip)
+				}
+			}
+		}
+	}
+}
+
+// cardinality returns the number of addresses in r.
+func (r *roaringBitmap) cardinality() int {
+	n := 0
+	for _, c := range r.containers {
+		if c != nil {
+			n += c.cardinality()
+		}
+	}
+	return n
+}
+
+// rangeCardinality returns the number of addresses of r in [lo, hi]:
+// containers inside the range add their cardinality, and those it cuts
+// count the part inside.
+func (r *roaringBitmap) rangeCardinality(lo, hi uint32) int {
+	n := 0
+	for key := lo >> 16; key <= hi>>16; key++ {
+		c := r.containers[key]
+		if c == nil {
+			continue
+		}
+		from, to := uint16(0), uint16(0xffff)
+		if key == lo>>16 {
+			from = uint16(lo)
+		}
+		if key == hi>>16 {
+			to = uint16(hi)
+		}
+		n += c.rangeCardinality(from, to)
+	}
+	return n
+}
+
+// intersection returns the number of addresses in both r and other.
+func (r *roaringBitmap) intersection(other *roaringBitmap) int {
+	n := 0
+	for key, c := range r.containers {
+		if o := other.containers[key]; c != nil && o != nil {
+			n += c.intersection(o)
+		}
+	}
+	return n
+}
+
+// and keeps the addresses of r that are also in other or, with not, those
+// that are not in other.
+func (r *roaringBitmap) and(other *roaringBitmap, not bool) {
+	var block, mask [roaringWords]uint64
+	for key, c := range r.containers {
+		o := other.containers[key]
+		switch {
+		case c == nil:
+			continue
+		case o == nil:
+			if !not {
+				r.containers[key] = nil
+			}
+			continue
+		}
+		c.fill(&block)
+		o.fill(&mask)
+		for i := range block {
+			if not {
+				block[i] &^= mask[i]
+			} else {
+				block[i] &= mask[i]
+			}
+		}
+		r.containers[key] = containerOf(&block)
+	}
+}
+
+// fill sets block to the bitmap form of c.
+func (c *roaringContainer) fill(block *[roaringWords]uint64) {
+	if c.bitmap != nil {
+		*block = *c.bitmap
+		return
+	}
+	clear(block[:])
+	for _, low := range c.array {
+		block[low/64] |= 1 << (low % 64)
+	}
+}
+
+func (c *roaringContainer) add(low uint16) {
+	if c.bitmap != nil {
+		word, bit := &c.bitmap[low/64], uint64(1)<<(low%64)
+		if *word&bit == 0 {
+			*word |= bit
+			c.n++
+		}
+		return
+	}
+	i, found := slices.BinarySearch(c.array, low)
+	if found {
+		return
+	}
+	if len(c.array) < roaringArrayMax {
+		c.array = slices.Insert(c.array, i, low)
+		return
+	}
+	c.toBitmap()
+	c.add(low)
+}
+
+func (c *roaringContainer) cardinality() int {
+	if c.bitmap != nil {
+		return c.n
+	}
+	return len(c.array)
+}
+
+// rangeCardinality returns the number of low bits of c in [from, to], by
+// binary search in an array and by popcounts over the words of the range
+// in a bitmap, the first and last masked to it.
+func (c *roaringContainer) rangeCardinality(from, to uint16) int {
+	if from == 0 && to == 0xffff {
+		return c.cardinality()
+	}
+	if c.bitmap == nil {
+		i, _ := slices.BinarySearch(c.array, from)
+		j, found := slices.BinarySearch(c.array, to)
+		if found {
+			j++
+		}
+		return j - i
+	}
+	first, last := from/64, to/64
+	n := 0
+	for w := first; w <= last; w++ {
+		word := c.bitmap[w]
+		if w == first {
+			word &= ^uint64(0) << (from % 64)
+		}
+		if w == last {
+			word &= ^uint64(0) >> (63 - to%64)
+		}
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+func (c *roaringContainer) intersection(other *roaringContainer) int {
+	n := 0
+	switch {
+	case c.bitmap != nil && other.bitmap != nil:
+		for i, word := range c.bitmap {
+			n += bits.OnesCount64(word & other.bitmap[i])
+		}
+	case c.bitmap != nil:
+		return other.intersection(c)
+	case other.bitmap != nil:
+		for _, low := range c.array {
+			n += int(other.bitmap[low/64] >> (low % 64) & 1)
+		}
+	default:
+		for i, j := 0, 0; i < len(c.array) && j < len(other.array); {
+			switch {
+			case c.array[i] < other.array[j]:
+				i++
+			case c.array[i] > other.array[j]:
+				j++
+			default:
+				n++
+				i++
+				j++
+			}
+		}
+	}
+	return n
+}
+
+// toBitmap converts an array container to its bitmap form.
+func (c *roaringContainer) toBitmap() {
+	c.bitmap = new([roaringWords]uint64)
+	for _, low := range c.array {
+		c.bitmap[low/64] |= 1 << (low % 64)
+	}
+	c.n = len(c.array)
+	c.array = nil
+}
+
+// or adds other's addresses to c. Two arrays are merged as sorted lists
+// while the union fits an array; anything else is ORed as bitmaps.
+func (c *roaringContainer) or(other *roaringContainer) {
+	if c.bitmap == nil && other.bitmap == nil && len(c.array)+len(other.array) <= roaringArrayMax {
+		c.array = unionSorted(c.array, other.array)
+		return
+	}
+	if c.bitmap == nil {
+		c.toBitmap()
+	}
+	if other.bitmap == nil {
+		for _, low := range other.array {
+			c.bitmap[low/64] |= 1 << (low % 64)
+		}
+	} else {
+		for i, word := range other.bitmap {
+			c.bitmap[i] |= word
+		}
+	}
+	c.n = 0
+	for _, word := range c.bitmap {
+		c.n += bits.OnesCount64(word)
+	}
+}
+
+// unionSorted merges two sorted, duplicate-free lists.
+func unionSorted(a, b []uint16) []uint16 {
+	out := make([]uint16, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+// mergeRoaring ORs roaring bitmaps together into the first non-nil one,
+// splitting the containers between mergeWorkers goroutines.
+func mergeRoaring(bitmaps []*roaringBitmap, mergeWorkers int) *roaringBitmap {
+	var dst *roaringBitmap
+	var rest []*roaringBitmap
+	for _, b := range bitmaps {
+		switch {
+		case b == nil:
+		case dst == nil:
+			dst = b
+		default:
+			rest = append(rest, b)
+		}
+	}
+	if dst == nil {
+		return newRoaringBitmap()
+	}
+
+	splitRange(roaringContainers, mergeWorkers, func(lo, hi int) error {
+		for key := lo; key < hi; key++ {
+			for _, b := range rest {
+				c := b.containers[key]
+				switch {
+				case c == nil:
+				case dst.containers[key] == nil:
+					dst.containers[key] = c
+				default:
+					dst.containers[key].or(c)
+				}
+			}
+		}
+		return nil
+	})
+	return dst
+}
@@ -0,0 +1,112 @@
+package ipcounter
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// segmentSketchBits is the size of the linear-counting bitset kept per
+// segment. 2^23 bits (1 MiB) estimates up to tens of millions of distinct
+// addresses per segment within a few percent.
+const segmentSketchBits = 1 << 23
+
+// segmentSketch estimates the distinct addresses within one fixed-size byte
+// range of the input by linear counting.
+type segmentSketch struct {
+	bits  []uint64
+	lines int64
+}
+
+func (s *segmentSketch) add(ip uint32) {
+	h := (ip * 0x9e3779b1) >> (32 - 23)
+	s.bits[h/64] |= 1 << (h % 64)
+	s.lines++
+}
+
+func (s *segmentSketch) estimate() float64 {
+	set := 0
+	for _, w := range s.bits {
+		set += bits.OnesCount64(w)
+	}
+	if set == segmentSketchBits {
+		return math.Inf(1)
+	}
+	m := float64(segmentSketchBits)
+	return -m * math.Log(1-float64(set)/m)
+}
+
+// segmentStats tracks a segmentSketch per input segment touched by one
+// worker; the workers' stats are merged at the end because segments do not
+// line up with chunks.
+type segmentStats struct {
+	size     int64
+	segments map[int64]*segmentSketch
+
+	cur    *segmentSketch
+	curEnd int64
+}
+
+func newSegmentStats(size int64) *segmentStats {
+	return &segmentStats{size: size, segments: make(map[int64]*segmentSketch)}
+}
+
+// add records the address of the line starting at offset.
+func (s *segmentStats) add(offset int64, ip uint32) {
+	if s.cur == nil || offset >= s.curEnd || offset < s.curEnd-s.size {
+		idx := offset / s.size
+		s.cur = s.segments[idx]
+		if s.cur == nil {
+			s.cur = &segmentSketch{bits: make([]uint64, segmentSketchBits/64)}
+			s.segments[idx] = s.cur
+		}
+		s.curEnd = (idx + 1) * s.size
+	}
+	s.cur.add(ip)
+}
+
+func (s *segmentStats) merge(other *segmentStats) {
+	for idx, o := range other.segments {
+		seg := s.segments[idx]
+		if seg == nil {
+			s.segments[idx] = o
+			continue
+		}
+		for i, w := range o.bits {
+			seg.bits[i] |= w
+		}
+		seg.lines += o.lines
+	}
+}
+
+// Segment is the estimate for one fixed-size byte range of the input.
+type Segment struct {
+	// Start and End delimit the segment; lines are assigned to the segment
+	// they start in.
+	Start, End int64
+	Lines      int64
+	// Unique is the estimated number of distinct addresses, +Inf if the
+	// segment holds too many to estimate.
+	Unique float64
+}
+
+// summary returns the segments seen, in file order.
+func (s *segmentStats) summary() []Segment {
+	idxs := make([]int64, 0, len(s.segments))
+	for idx := range s.segments {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+
+	out := make([]Segment, 0, len(idxs))
+	for _, idx := range idxs {
+		seg := s.segments[idx]
+		out = append(out, Segment{
+			Start:  idx * s.size,
+			End:    (idx + 1) * s.size,
+			Lines:  seg.lines,
+			Unique: seg.estimate(),
+		})
+	}
+	return out
+}
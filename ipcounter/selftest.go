@@ -0,0 +1,490 @@
+package ipcounter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// SelfTestCheck is the outcome of one check run by SelfTest.
+type SelfTestCheck struct {
+	Name string
+	// Cases is how many inputs were compared.
+	Cases int
+	// Err describes the first mismatch; nil means the check passed.
+	Err error
+}
+
+// SelfTest compares the code paths a count relies on against simple
+// reference implementations on this machine: the SWAR and fallback IPv4
+// parsers, the bitmap merge and popcount, roaring bitmaps, the decompressors
+// and the splitting of gzip and zstd input at member boundaries, and the
+// on-disk formats of invalid-line recordings and spill files. seed picks the
+// random inputs, so a failure can be reproduced; scratch files go to dir.
+func SelfTest(seed uint64, dir string) []SelfTestCheck {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	checks := []struct {
+		name string
+		run  func(rng *rand.Rand, dir string) (int, error)
+	}{
+		{"IPv4 parsers", checkParsers},
+		{"bitmap merge and popcount", checkBitmaps},
+		{"roaring bitmaps", checkRoaring},
+		{"gzip members", func(rng *rand.Rand, dir string) (int, error) {
+			return checkMembers(rng, dir, compressGzip)
+		}},
+		{"zstd frames", func(rng *rand.Rand, dir string) (int, error) {
+			return checkMembers(rng, dir, compressZstd)
+		}},
+		{"bzip2 decoder", checkBzip2},
+		{"invalid-line recording", checkRecording},
+		{"spill file", checkSpill},
+	}
+
+	results := make([]SelfTestCheck, len(checks))
+	for i, c := range checks {
+		cases, err := c.run(rng, dir)
+		results[i] = SelfTestCheck{Name: c.name, Cases: cases, Err: err}
+	}
+	return results
+}
+
+const selfTestParserCases = 1 << 20
+
+// checkParsers runs well-formed and mangled addresses through
+// parseIPv4Fast, parseIPv4Slow and ParseIPv4 and compares their verdicts with
+// parseReference. parseIPv4Fast may decline any input, but must accept
+// every valid address of 1-3 digits per octet.
+func checkParsers(rng *rand.Rand, _ string) (int, error) {
+	for i := 0; i < selfTestParserCases; i++ {
+		s := randomAddress(rng)
+		want, wantOK := parseReference(string(s))
+
+		got, ok := parseIPv4Fast(s)
+		if ok && (!wantOK || got != want) {
+			return i + 1, fmt.Errorf("parseIPv4Fast(%q) = %s, reference: %s", s, verdict(got, nil), verdict(want, wantOK))
+		}
+		if !ok && wantOK && canonicalShape(s) {
+			return i + 1, fmt.Errorf("parseIPv4Fast(%q) declined a canonical address", s)
+		}
+		for _, p := range []struct {
+			name  string
+			parse func([]byte) (uint32, error)
+		}{{"parseIPv4Slow", parseIPv4Slow}, {"ParseIPv4", ParseIPv4}} {
+			got, err := p.parse(s)
+			if (err == nil) != wantOK || wantOK && got != want {
+				return i + 1, fmt.Errorf("%s(%q) = %s, reference: %s", p.name, s, verdict(got, err), verdict(want, wantOK))
+			}
+		}
+	}
+	return selfTestParserCases, nil
+}
+
+// verdict formats a parse result; v is an error or the reference's ok.
+func verdict(ip uint32, v any) string {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case bool:
+		if !v {
+			return "invalid"
+		}
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", ip>>24, ip>>16&0xff, ip>>8&0xff, ip&0xff)
+}
+
+// canonicalShape reports whether s is four dot-separated runs of 1-3
+// characters, the shape parseIPv4Fast handles.
+func canonicalShape(s []byte) bool {
+	parts := strings.Split(string(s), ".")
+	if len(parts) != 4 {
+		return false
+	}
+	for _, p := range parts {
+		if len(p) < 1 || len(p) > 3 {
+			return false
+		}
+	}
+	return true
+}
+
+// randomAddress returns a dotted quad, sometimes with out-of-range octets or
+// leading zeros, and about half the time mangled by a few edits.
+func randomAddress(rng *rand.Rand) []byte {
+	var b []byte
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			b = append(b, '.')
+		}
+		octet := rng.IntN(256)
+		if rng.IntN(8) == 0 {
+			octet = rng.IntN(1000)
+		}
+		if rng.IntN(16) == 0 {
+			b = append(b, strings.Repeat("0", rng.IntN(3)+1)...)
+		}
+		b = fmt.Appendf(b, "%d", octet)
+	}
+	if rng.IntN(2) == 0 {
+		return b
+	}
+
+	const alphabet = "0123456789...x :-\x00\xff"
+	for n := rng.IntN(3) + 1; n > 0; n-- {
+		c := alphabet[rng.IntN(len(alphabet))]
+		switch i := rng.IntN(len(b) + 1); rng.IntN(3) {
+		case 0:
+			b = slices.Insert(b, i, c)
+		case 1:
+			if i < len(b) {
+				b = slices.Delete(b, i, i+1)
+			}
+		default:
+			if i < len(b) {
+				b[i] = c
+			}
+		}
+	}
+	return b
+}
+
+// checkBitmaps merges and counts random bitmaps with every worker count up
+// to 8 and compares with a bit-by-bit count of their union.
+func checkBitmaps(rng *rand.Rand, _ string) (int, error) {
+	const words = 1 << 16
+	bitmaps := make([][]uint64, 3)
+	for i := range bitmaps {
+		bitmaps[i] = randomBitmap(rng, words)
+	}
+
+	want := make([]uint64, words)
+	wantCount := 0
+	for i := range want {
+		for _, b := range bitmaps {
+			want[i] |= b[i]
+		}
+		for bit := 0; bit < 64; bit++ {
+			wantCount += int(want[i] >> bit & 1)
+		}
+	}
+
+	const maxWorkers = 8
+	for workers := 1; workers <= maxWorkers; workers++ {
+		merged := mergeBitmaps(bitmaps, words, workers)
+		if i := firstDifference(merged, want); i >= 0 {
+			return workers, fmt.Errorf("merge with %d workers: word %d is %#x, want %#x", workers, i, merged[i], want[i])
+		}
+		if got := countBits(merged, workers); got != wantCount {
+			return workers, fmt.Errorf("popcount with %d workers: %d bits, want %d", workers, got, wantCount)
+		}
+	}
+	return maxWorkers, nil
+}
+
+// checkRoaring adds random addresses to roaring bitmaps, dense enough in
+// places to turn array containers into bitmaps, merges them and compares
+// the result with a map.
+func checkRoaring(rng *rand.Rand, _ string) (int, error) {
+	const cases = 1 << 18
+	want := make(map[uint32]bool)
+	bitmaps := make([]*roaringBitmap, 3)
+	for i := range bitmaps {
+		bitmaps[i] = newRoaringBitmap()
+	}
+	for i := 0; i < cases; i++ {
+		ip := rng.Uint32()
+		if rng.IntN(2) == 0 {
+			// A few crowded containers.
+			ip = uint32(rng.IntN(4))<<16 | ip&0xffff
+		}
+		bitmaps[rng.IntN(len(bitmaps))].add(ip)
+		want[ip] = true
+	}
+
+	merged := mergeRoaring(bitmaps, 4)
+	if got := merged.cardinality(); got != len(want) {
+		return cases, fmt.Errorf("merged cardinality %d, want %d", got, len(want))
+	}
+	for ip := range want {
+		if !merged.contains(ip) {
+			return cases, fmt.Errorf("merged bitmap lost %s", verdict(ip, nil))
+		}
+	}
+	return cases, nil
+}
+
+// randomBitmap returns words of varying density, including empty and full
+// ones.
+func randomBitmap(rng *rand.Rand, words int) []uint64 {
+	b := make([]uint64, words)
+	for i := range b {
+		switch rng.IntN(4) {
+		case 0:
+		case 1:
+			b[i] = ^uint64(0)
+		case 2:
+			b[i] = rng.Uint64() & rng.Uint64() & rng.Uint64()
+		default:
+			b[i] = rng.Uint64()
+		}
+	}
+	return b
+}
+
+func firstDifference(got, want []uint64) int {
+	for i := range want {
+		if got[i] != want[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkMembers compresses random input as several gzip members or zstd
+// frames cut at arbitrary bytes, then checks that it decompresses as a
+// whole and that memberBoundaries splits it only at member starts into
+// ranges that decompress on their own.
+func checkMembers(rng *rand.Rand, dir string, c compression) (int, error) {
+	text := selfTestText(rng)
+	const members = 8
+	cuts := []int{0, len(text)}
+	for i := 1; i < members; i++ {
+		cuts = append(cuts, rng.IntN(len(text)))
+	}
+	slices.Sort(cuts)
+
+	var enc *zstd.Encoder
+	if c == compressZstd {
+		var err error
+		if enc, err = zstd.NewWriter(nil); err != nil {
+			return 0, err
+		}
+		defer enc.Close()
+	}
+	var data []byte
+	var starts []int64
+	for i := 0; i < members; i++ {
+		part := text[cuts[i]:cuts[i+1]]
+		starts = append(starts, int64(len(data)))
+		if enc != nil {
+			data = enc.EncodeAll(part, data)
+			continue
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(part)
+		if err := zw.Close(); err != nil {
+			return 0, err
+		}
+		data = append(data, buf.Bytes()...)
+	}
+
+	if got := detectCompression(data); got != c {
+		return 0, fmt.Errorf("input detected as %s", got)
+	}
+	if err := expectDecompressed(c, bytes.NewReader(data), text); err != nil {
+		return 0, err
+	}
+
+	file, err := os.CreateTemp(dir, "ip-addr-counter-selftest-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return 0, err
+	}
+	in := &input{file: file, size: int64(len(data))}
+
+	boundaries, err := memberBoundaries(in, c, 4)
+	if err != nil {
+		return 0, fmt.Errorf("finding member boundaries: %v", err)
+	}
+	if len(boundaries) < 2 {
+		return members, fmt.Errorf("no member boundaries found in %d members", members)
+	}
+	var joined []byte
+	for i, start := range boundaries {
+		if !slices.Contains(starts, start) {
+			return members, fmt.Errorf("boundary at offset %d is not a member start", start)
+		}
+		end := in.size
+		if i+1 < len(boundaries) {
+			end = boundaries[i+1]
+		}
+		dr, err := decompress(c, io.NewSectionReader(file, start, end-start))
+		if err != nil {
+			return members, fmt.Errorf("decompressing from offset %d: %v", start, err)
+		}
+		b, err := io.ReadAll(dr)
+		dr.Close()
+		if err != nil {
+			return members, fmt.Errorf("decompressing from offset %d: %v", start, err)
+		}
+		joined = append(joined, b...)
+	}
+	if !bytes.Equal(joined, text) {
+		return members, fmt.Errorf("ranges split at %v decompress to different text", boundaries)
+	}
+	return members, nil
+}
+
+// selfTestText returns some thousands of random address lines.
+func selfTestText(rng *rand.Rand) []byte {
+	var b []byte
+	for i := 0; i < 20000; i++ {
+		ip := rng.Uint32()
+		b = fmt.Appendf(b, "%d.%d.%d.%d\n", ip>>24, ip>>16&0xff, ip>>8&0xff, ip&0xff)
+	}
+	return b
+}
+
+func expectDecompressed(c compression, r io.Reader, want []byte) error {
+	dr, err := decompress(c, r)
+	if err != nil {
+		return fmt.Errorf("starting to decompress: %v", err)
+	}
+	defer dr.Close()
+	got, err := io.ReadAll(dr)
+	if err != nil {
+		return fmt.Errorf("decompressing: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("decompressed %d bytes that differ from the %d compressed", len(got), len(want))
+	}
+	return nil
+}
+
+// selfTestBzip2 is "10.0.0.0\n" to "10.0.0.99\n" compressed by bzip2 -9; the
+// standard library has no bzip2 encoder to produce it at run time.
+var selfTestBzip2 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x6d, 0xd1, 0x2a, 0xbf, 0x00, 0x01,
+	0x68, 0xd8, 0x00, 0x00, 0x10, 0x00, 0x01, 0x7f, 0xe0, 0x30, 0x00, 0xc6, 0x90, 0xd2, 0x01, 0x4f,
+	0xff, 0x54, 0xa4, 0x20, 0x68, 0x1a, 0x02, 0x45, 0x41, 0x9b, 0xd5, 0x4d, 0x3e, 0xd6, 0x31, 0xbe,
+	0x77, 0xdf, 0x97, 0xf7, 0x8c, 0x80, 0xe8, 0xd0, 0x1c, 0x0d, 0x83, 0x60, 0xe0, 0x68, 0x0e, 0x8c,
+	0x80, 0xf1, 0x80, 0x0f, 0xc8, 0x00, 0x60, 0x48, 0x40, 0xe2, 0xaa, 0xaf, 0xc8, 0x84, 0x09, 0x49,
+	0x00, 0x96, 0xaa, 0xaa, 0xe7, 0x02, 0xa4, 0xac, 0x54, 0x97, 0x79, 0xbb, 0xbb, 0xbb, 0xbf, 0x4a,
+	0x83, 0x40, 0x76, 0x54, 0x0d, 0x83, 0x92, 0xa0, 0x38, 0x1b, 0x95, 0x00, 0xe8, 0xd4, 0xa8, 0x03,
+	0xc6, 0x65, 0x40, 0x0c, 0x69, 0x0b, 0x55, 0x55, 0x70, 0x87, 0xe2, 0xee, 0x48, 0xa7, 0x0a, 0x12,
+	0x0d, 0xba, 0x25, 0x57, 0xe0,
+}
+
+func checkBzip2(*rand.Rand, string) (int, error) {
+	var want []byte
+	for i := 0; i < 100; i++ {
+		want = fmt.Appendf(want, "10.0.0.%d\n", i)
+	}
+	if got := detectCompression(selfTestBzip2); got != compressBzip2 {
+		return 0, fmt.Errorf("input detected as %s", got)
+	}
+	// Two concatenated streams, as pbzip2 writes them.
+	data := append(slices.Clone(selfTestBzip2), selfTestBzip2...)
+	return 2, expectDecompressed(compressBzip2, bytes.NewReader(data), append(slices.Clone(want), want...))
+}
+
+// checkRecording writes random lines to a recording, including some that
+// are reset away, and reads them back.
+func checkRecording(rng *rand.Rand, dir string) (int, error) {
+	file, err := os.CreateTemp(dir, "ip-addr-counter-selftest-*")
+	if err != nil {
+		return 0, err
+	}
+	name := file.Name()
+	file.Close()
+	defer os.Remove(name)
+
+	r, err := createInvalidRecorder(name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if err := r.record(1, []byte("dropped by reset")); err != nil {
+		return 0, err
+	}
+	if err := r.reset(); err != nil {
+		return 0, err
+	}
+
+	type record struct {
+		offset int64
+		line   []byte
+	}
+	const records = 1000
+	var want []record
+	for i := 0; i < records; i++ {
+		line := make([]byte, rng.IntN(100))
+		for j := range line {
+			line[j] = byte(rng.Uint32())
+		}
+		rec := record{rng.Int64(), line}
+		if err := r.record(rec.offset, rec.line); err != nil {
+			return i, err
+		}
+		want = append(want, rec)
+	}
+	if err := r.Close(); err != nil {
+		return 0, err
+	}
+
+	file, err = os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader, err := NewRecordingReader(file)
+	if err != nil {
+		return 0, err
+	}
+	for i, rec := range want {
+		offset, line, err := reader.Next()
+		if err != nil {
+			return i, fmt.Errorf("reading record %d: %v", i, err)
+		}
+		if offset != rec.offset || !bytes.Equal(line, rec.line) {
+			return i + 1, fmt.Errorf("record %d read back as offset %d, %q; want offset %d, %q", i, offset, line, rec.offset, rec.line)
+		}
+	}
+	if _, _, err := reader.Next(); err != io.EOF {
+		return records, fmt.Errorf("after the last record: got %v, want EOF", err)
+	}
+	return records, nil
+}
+
+// checkSpill spills a few short bitmaps and merges them back. The file is
+// sparse: each slot is bitmapBytes apart but only its start is written.
+func checkSpill(rng *rand.Rand, dir string) (int, error) {
+	s, err := createSpillFile(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	const words, chunks = 1 << 16, 3
+	want := make([]uint64, words)
+	for i := 0; i < chunks; i++ {
+		b := randomBitmap(rng, words)
+		if err := s.write(i, b); err != nil {
+			return i, err
+		}
+		for j := range want {
+			want[j] |= b[j]
+		}
+	}
+
+	got := make([]uint64, words)
+	if err := s.mergeInto(got, chunks, 4); err != nil {
+		return chunks, err
+	}
+	if i := firstDifference(got, want); i >= 0 {
+		return chunks, fmt.Errorf("merged word %d is %#x, want %#x", i, got[i], want[i])
+	}
+	return chunks, nil
+}
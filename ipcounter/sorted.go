@@ -0,0 +1,196 @@
+package ipcounter
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+const (
+	sortSampleWindows    = 16
+	sortSampleWindowSize = 64 << 10
+)
+
+// looksSorted reads a few windows spread evenly over the file and reports
+// whether the valid addresses in them appear in non-decreasing order. It is
+// only a hint: countSorted still verifies the order of every line.
+func looksSorted(in *input, opts options) bool {
+	fileSize := in.size
+	if fileSize == 0 {
+		return false
+	}
+
+	buf := make([]byte, sortSampleWindowSize)
+	var prev uint32
+	seen := 0
+
+	for w := int64(0); w < sortSampleWindows; w++ {
+		offset := fileSize * w / sortSampleWindows
+		n, err := in.file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return false
+		}
+		window := buf[:n]
+
+		// Drop the partial lines at both ends of the window.
+		if offset != 0 {
+			i := bytes.IndexByte(window, '\n')
+			if i < 0 {
+				continue
+			}
+			window = window[i+1:]
+		}
+		if offset+int64(n) < fileSize {
+			window = window[:bytes.LastIndexByte(window, '\n')+1]
+		}
+
+		for len(window) > 0 {
+			line := window
+			if i := bytes.IndexByte(window, '\n'); i >= 0 {
+				line, window = window[:i], window[i+1:]
+			} else {
+				window = nil
+			}
+
+			ip, _, err := opts.parseLine(line)
+			if err != nil {
+				continue
+			}
+			if seen > 0 && ip < prev {
+				return false
+			}
+			prev = ip
+			seen++
+		}
+	}
+
+	// A couple of addresses are trivially "sorted"; require a real sample.
+	return seen >= 2*sortSampleWindows
+}
+
+// countSorted counts unique addresses in a single sequential pass by
+// comparing each address with the previous one, which needs no bitmap. It
+// returns sorted=false as soon as an address is smaller than its
+// predecessor, in which case the result is nil.
+func countSorted(ctx context.Context, in *input, opts options) (*runResult, bool, error) {
+	chunk, err := in.openChunk(0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer chunk.Close()
+	file := countReads(chunk, opts.tracker.worker(0))
+
+	readSize := opts.readSize(sampleLineStats(in.file, 0))
+	reader, hasher, src := newChunkReader(file, 0, in.size, readSize, opts)
+	invalid := make(map[error]int64)
+	unique := 0
+	var occurrences uint64
+	var v6 ipv6Set
+	if opts.ipv6 {
+		v6 = ipv6Set{}
+	}
+	var prev uint32
+	var segments *segmentStats
+	if opts.segmentSize > 0 {
+		segments = newSegmentStats(opts.segmentSize)
+	}
+
+	var frequencies frequencyMap
+	var top *topCounter
+	switch {
+	case opts.frequencies:
+		frequencies = frequencyMap{}
+	case opts.topN > 0:
+		top = newTopCounter(opts.topN)
+	}
+
+	var summary *summaryBuilder
+	if opts.summary {
+		summary = newSummaryBuilder()
+	}
+
+	var offset, lines, filtered int64
+	var samples []InvalidLine
+	partial := opts.stopped()
+	for !partial {
+		line, err := reader.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if lines++; lines%cancelCheckLines == 0 {
+			if err := opts.checkpoint(ctx); err != nil {
+				return nil, false, err
+			}
+			if partial = opts.stopped(); partial {
+				lines--
+				break
+			}
+		}
+		lineOffset := offset
+		offset += int64(len(line)) + 1
+
+		ip, ip6, weight, err := opts.parseAny(line)
+		if err != nil {
+			invalid[err]++
+			if len(samples) < opts.invalidSamples {
+				samples = append(samples, InvalidLine{lineOffset, bytes.Clone(line), err})
+			}
+			if opts.recorder != nil {
+				if err := opts.recorder.record(lineOffset, line); err != nil {
+					return nil, false, err
+				}
+			}
+			continue
+		}
+		if weight == 0 {
+			continue
+		}
+		if opts.filtered(ip, ip6) {
+			filtered++
+			continue
+		}
+		occurrences = addWeight(occurrences, weight)
+		if ip6.IsValid() {
+			v6.add(ip6)
+			continue
+		}
+
+		ip = opts.key(ip)
+		if frequencies != nil {
+			frequencies.add(ip, weight)
+		}
+		if top != nil {
+			top.add(ip, weight)
+		}
+		if segments != nil {
+			segments.add(lineOffset, ip)
+		}
+		if unique > 0 {
+			if ip < prev {
+				return nil, false, nil
+			}
+			if ip == prev {
+				continue
+			}
+		}
+		prev = ip
+		unique++
+		if summary != nil {
+			summary.add(ip)
+		}
+	}
+
+	result := &runResult{unique: unique, lines: lines, filtered: filtered, bytes: in.size, occurrences: occurrences, invalid: invalid, samples: samples, partial: partial, covered: offset, segments: segments, v6: v6, frequencies: frequencies, top: top}
+	if summary != nil {
+		result.summary = summary.finish()
+	}
+	if hasher != nil {
+		if result.digests, err = hasher.finish(src); err != nil {
+			return nil, false, err
+		}
+	}
+	return result, true, nil
+}
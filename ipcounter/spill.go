@@ -0,0 +1,81 @@
+package ipcounter
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// spillBufferSize is the I/O unit for writing and merging spilled bitmaps.
+const spillBufferSize = 1 << 20
+
+// spillFile holds finished chunk bitmaps on disk, chunk i at offset
+// i*bitmapBytes. The file is unlinked as soon as it is created where the OS
+// allows it, so it disappears even if the process is killed.
+type spillFile struct {
+	file *os.File
+	// name is set when the file could not be unlinked right away.
+	name string
+}
+
+func createSpillFile(dir string) (*spillFile, error) {
+	file, err := os.CreateTemp(dir, "ip-addr-counter-spill-*")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spillFile{file: file}
+	if err := os.Remove(file.Name()); err != nil {
+		s.name = file.Name()
+	}
+	return s, nil
+}
+
+// write stores the bitmap of chunk i.
+func (s *spillFile) write(i int, bitmap []uint64) error {
+	buf := make([]byte, spillBufferSize)
+	offset := int64(i) * bitmapBytes
+
+	for len(bitmap) > 0 {
+		n := min(len(bitmap), spillBufferSize/8)
+		for j, word := range bitmap[:n] {
+			binary.LittleEndian.PutUint64(buf[j*8:], word)
+		}
+		if _, err := s.file.WriteAt(buf[:n*8], offset); err != nil {
+			return err
+		}
+		bitmap = bitmap[n:]
+		offset += int64(n) * 8
+	}
+	return nil
+}
+
+// mergeInto ORs the bitmaps of chunks 0..n-1 into dst, splitting the words
+// between workers goroutines.
+func (s *spillFile) mergeInto(dst []uint64, n int, workers int) error {
+	return splitRange(len(dst), workers, func(lo, hi int) error {
+		buf := make([]byte, spillBufferSize)
+		for i := 0; i < n; i++ {
+			offset := int64(i)*bitmapBytes + int64(lo)*8
+			for w := lo; w < hi; {
+				words := min(hi-w, spillBufferSize/8)
+				if _, err := s.file.ReadAt(buf[:words*8], offset); err != nil {
+					return err
+				}
+				for j := 0; j < words; j++ {
+					dst[w+j] |= binary.LittleEndian.Uint64(buf[j*8:])
+				}
+				w += words
+				offset += int64(words) * 8
+			}
+		}
+		return nil
+	})
+}
+
+func (s *spillFile) Close() error {
+	err := s.file.Close()
+	if s.name != "" {
+		os.Remove(s.name)
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+package ipcounter
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// spotCheckWindow is the size of each randomly placed input window the spot
+// check re-reads.
+const spotCheckWindow = 64 << 10
+
+// SpotCheck is the outcome of re-parsing a random sample of the input with
+// a deliberately naive reference parser. It catches sampled addresses the
+// count misparsed or missed, but not keys the count holds that no line
+// gave it, such as bits set for lines it should have rejected: finding
+// those takes a full re-count, so a passing spot check does not verify the
+// count, only that it is missing nothing from the sample.
+type SpotCheck struct {
+	Windows int
+	Lines   int64
+	// ReferenceUnique and ParserUnique are the unique keys found in the
+	// sample by the reference parser and by ParseIPv4.
+	ReferenceUnique int
+	ParserUnique    int
+	// MissingInResult counts sampled keys absent from the final bitmap.
+	MissingInResult int
+	// Passed is set when both parsers agree and nothing is missing.
+	Passed bool
+}
+
+// runSpotCheck reads windows covering about fraction of the input, collects
+// the addresses on the complete lines in them with both parseReference and
+// the real parser, deduplicates each by sorting (the moral equivalent of
+// `sort -u`) and checks that both agree and that every address is in the
+// final result, as reported by contains.
+func runSpotCheck(in *input, fraction float64, opts options, contains func(ip uint32) bool) (*SpotCheck, error) {
+	windows := max(1, int(fraction*float64(in.size)/spotCheckWindow))
+	c := &SpotCheck{Windows: windows}
+	var referenceIPs, parserIPs []uint32
+	buf := make([]byte, spotCheckWindow)
+
+	for w := 0; w < windows; w++ {
+		var offset int64
+		if in.size > spotCheckWindow {
+			offset = rand.Int64N(in.size - spotCheckWindow + 1)
+		}
+		n, err := in.file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		window := buf[:n]
+
+		if offset != 0 {
+			i := bytes.IndexByte(window, '\n')
+			if i < 0 {
+				continue
+			}
+			window = window[i+1:]
+		}
+		if offset+int64(n) < in.size {
+			window = window[:bytes.LastIndexByte(window, '\n')+1]
+		}
+
+		for len(window) > 0 {
+			line := window
+			if i := bytes.IndexByte(window, '\n'); i >= 0 {
+				line, window = window[:i], window[i+1:]
+			} else {
+				window = nil
+			}
+			c.Lines++
+			if field, ok := referenceField(line, opts); ok {
+				if ip, ok := parseReference(string(field)); ok && !opts.filtered(ip, netip.Addr{}) {
+					referenceIPs = append(referenceIPs, opts.key(ip))
+				}
+			}
+			if ip, weight, err := opts.parseLine(line); err == nil && weight > 0 && !opts.filtered(ip, netip.Addr{}) {
+				parserIPs = append(parserIPs, opts.key(ip))
+			}
+		}
+	}
+
+	slices.Sort(referenceIPs)
+	referenceIPs = slices.Compact(referenceIPs)
+	slices.Sort(parserIPs)
+	parserIPs = slices.Compact(parserIPs)
+
+	for _, ip := range referenceIPs {
+		if !contains(ip) {
+			c.MissingInResult++
+		}
+	}
+	c.ReferenceUnique, c.ParserUnique = len(referenceIPs), len(parserIPs)
+	c.Passed = slices.Equal(referenceIPs, parserIPs) && c.MissingInResult == 0
+	return c, nil
+}
+
+// referenceField returns the address field of line, with ok=false when the
+// line stands for no occurrence: a WithExtract pattern that does not match,
+// a WithField field that is missing, or a weight column that is missing, 0
+// or not a number.
+func referenceField(line []byte, opts options) ([]byte, bool) {
+	field := line
+	if opts.extract != nil {
+		m := opts.extract.FindSubmatch(line)
+		if m == nil || m[opts.extractGroup] == nil {
+			return nil, false
+		}
+		field = m[opts.extractGroup]
+	}
+	if opts.column > 0 {
+		var fields []string
+		if opts.delimiter == ' ' {
+			fields = strings.FieldsFunc(string(line), func(r rune) bool {
+				return strings.ContainsRune(" \t\r\v\f", r)
+			})
+		} else {
+			fields = strings.Split(string(line), string([]byte{opts.delimiter}))
+		}
+		if len(fields) < opts.column {
+			return nil, false
+		}
+		field = []byte(fields[opts.column-1])
+	}
+	if opts.weighted {
+		addr, count, ok := bytes.Cut(line, []byte(","))
+		if !ok {
+			return nil, false
+		}
+		if opts.trim {
+			count = TrimField(count)
+		}
+		count = bytes.Trim(count, " \t\r\v\f")
+		n, err := strconv.ParseUint(string(count), 10, 64)
+		if err != nil || n == 0 {
+			return nil, false
+		}
+		field = addr
+	}
+	if opts.trim {
+		field = TrimField(field)
+	}
+	return bytes.Trim(field, " \t\r\v\f"), true
+}
+
+// parseReference is a straightforward, independent implementation of the
+// address syntax ParseIPv4 accepts: four dot-separated runs of decimal
+// digits, each at most 255. Like ParseIPv4 it tolerates leading zeros and
+// treats an empty run as 0.
+func parseReference(s string) (uint32, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return 0, false
+	}
+
+	var ip uint32
+	for _, p := range parts {
+		if strings.Trim(p, "0123456789") != "" {
+			return 0, false
+		}
+		v := uint64(0)
+		if p = strings.TrimLeft(p, "0"); p != "" {
+			var err error
+			if v, err = strconv.ParseUint(p, 10, 8); err != nil {
+				return 0, false
+			}
+		}
+		ip = ip<<8 | uint32(v)
+	}
+	return ip, true
+}
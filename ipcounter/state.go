@@ -0,0 +1,565 @@
+package ipcounter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// State is a counted set saved for later runs: the IPv4 keys in a roaring
+// bitmap and the IPv6 addresses, with the mask the keys were counted
+// under. Merging the state of earlier inputs into a new count gives the
+// unique count of all of them without reading the earlier inputs again.
+// Counts with WithHyperLogLog keep their sketches instead, a few KiB that
+// merge into an estimate of the union.
+type State struct {
+	prefixLen int
+	v4        *roaringBitmap
+	v6        ipv6Set
+	// sketch and sketch6 replace v4 and v6 for estimates; sketch6 is nil
+	// unless IPv6 was counted.
+	sketch, sketch6 *hyperLogLog
+}
+
+// newState returns the set of a result as a State. A roaring set and
+// sketches are taken over; a dense bitmap is copied into containers.
+func newState(r *runResult, o options) *State {
+	s := &State{prefixLen: 32 - bits.OnesCount32(o.hostMask), v6: r.v6}
+	switch {
+	case r.sketch != nil:
+		return &State{prefixLen: s.prefixLen, sketch: r.sketch, sketch6: r.sketch6}
+	case r.sparse != nil:
+		s.v4 = r.sparse
+	case r.bitmap != nil:
+		s.v4 = newRoaringBitmap()
+		var block [roaringWords]uint64
+		for hi := range s.v4.containers {
+			s.v4.containers[hi] = containerOf(denseBlock(r.bitmap, o.layout, hi, &block))
+		}
+	}
+	if s.v6 == nil {
+		s.v6 = ipv6Set{}
+	}
+	return s
+}
+
+// NewState returns an empty state of keys with the given prefix length, 32
+// for addresses, to which AddLine adds one line at a time.
+func NewState(prefixLen int) (*State, error) {
+	if prefixLen < 0 || prefixLen > 32 {
+		return nil, fmt.Errorf("invalid prefix length /%d: want /0 to /32", prefixLen)
+	}
+	return &State{prefixLen: prefixLen, v4: newRoaringBitmap(), v6: ipv6Set{}}, nil
+}
+
+// AddLine parses a line as a count with WithTrim and WithIPv6 does and adds
+// its address, or returns why the line is invalid, one of InvalidReasons.
+func (s *State) AddLine(line []byte) error {
+	o := options{trim: true, ipv6: true, hostMask: uint32(uint64(1)<<(32-s.prefixLen) - 1)}
+	ip, ip6, _, err := o.parseAny(line)
+	switch {
+	case err != nil:
+		return err
+	case ip6.IsValid() && s.sketch != nil:
+		if s.sketch6 == nil {
+			s.sketch6 = newHyperLogLog(s.sketch.p)
+		}
+		s.sketch6.add(hashIPv6(ip6.As16()))
+	case ip6.IsValid():
+		s.v6.add(ip6)
+	case s.sketch != nil:
+		s.sketch.add(mix64(uint64(o.key(ip))))
+	default:
+		s.v4.add(o.key(ip))
+	}
+	return nil
+}
+
+// containerOf returns a container holding the bits of block, in an array
+// when there are few enough, or nil when there are none.
+func containerOf(block *[roaringWords]uint64) *roaringContainer {
+	n := 0
+	for _, word := range block {
+		n += bits.OnesCount64(word)
+	}
+	switch {
+	case n == 0:
+		return nil
+	case n > roaringArrayMax:
+		c := &roaringContainer{bitmap: new([roaringWords]uint64), n: n}
+		*c.bitmap = *block
+		return c
+	}
+	c := &roaringContainer{array: make([]uint16, 0, n)}
+	for i, word := range block {
+		for ; word != 0; word &= word - 1 {
+			c.array = append(c.array, uint16(i*64+bits.TrailingZeros64(word)))
+		}
+	}
+	return c
+}
+
+// PrefixLen returns the prefix length the IPv4 keys were counted with: 32
+// unless WithMask was set.
+func (s *State) PrefixLen() int {
+	return s.prefixLen
+}
+
+// Approximate reports whether s holds sketches, whose counts are
+// estimates.
+func (s *State) Approximate() bool {
+	return s.sketch != nil
+}
+
+// Precision returns the HyperLogLog precision of the sketches, or 0 for an
+// exact set.
+func (s *State) Precision() int {
+	if s.sketch == nil {
+		return 0
+	}
+	return int(s.sketch.p)
+}
+
+// Unique returns the number of distinct IPv4 keys.
+func (s *State) Unique() uint64 {
+	if s.sketch != nil {
+		return s.sketch.estimate()
+	}
+	return uint64(s.v4.cardinality())
+}
+
+// UniqueIPv6 returns the number of distinct IPv6 addresses.
+func (s *State) UniqueIPv6() uint64 {
+	if s.sketch != nil {
+		if s.sketch6 == nil {
+			return 0
+		}
+		return s.sketch6.estimate()
+	}
+	return uint64(len(s.v6))
+}
+
+// Summary describes the IPv4 set like Result.Summary, or returns nil for
+// sketches.
+func (s *State) Summary() *SetSummary {
+	if s.sketch != nil {
+		return nil
+	}
+	return summarize(&runResult{sparse: s.v4}, options{})
+}
+
+// Merge adds other's keys to s. other is taken over and must not be used
+// afterwards. States counted with different masks cannot be merged, nor
+// exact sets with sketches or sketches of different precisions.
+func (s *State) Merge(other *State) error {
+	switch {
+	case s.prefixLen != other.prefixLen:
+		return fmt.Errorf("cannot merge a state of /%d keys with one of /%d keys", other.prefixLen, s.prefixLen)
+	case s.Approximate() != other.Approximate():
+		return errors.New("cannot merge an exact set with a HyperLogLog sketch")
+	case s.sketch != nil && s.sketch.p != other.sketch.p:
+		return fmt.Errorf("cannot merge a sketch of precision %d with one of precision %d", other.sketch.p, s.sketch.p)
+	case s.sketch != nil:
+		s.sketch.merge(other.sketch)
+		s.sketch6 = mergeSketch(s.sketch6, other.sketch6)
+		return nil
+	}
+	s.v4 = mergeRoaring([]*roaringBitmap{s.v4, other.v4}, 1)
+	s.v6 = mergeIPv6Sets([]ipv6Set{s.v6, other.v6})
+	return nil
+}
+
+// Intersect keeps only the keys of s that other holds as well. Both must be
+// exact sets of keys counted with the same mask; other is left as it is.
+func (s *State) Intersect(other *State) error {
+	return s.and(other, false)
+}
+
+// Subtract removes the keys other holds from s, as Intersect keeps them.
+func (s *State) Subtract(other *State) error {
+	return s.and(other, true)
+}
+
+func (s *State) and(other *State, not bool) error {
+	switch {
+	case s.prefixLen != other.prefixLen:
+		return fmt.Errorf("cannot combine a state of /%d keys with one of /%d keys", other.prefixLen, s.prefixLen)
+	case s.Approximate() || other.Approximate():
+		return errors.New("HyperLogLog sketches can only be merged, not intersected or subtracted")
+	}
+	s.v4.and(other.v4, not)
+	for addr := range s.v6 {
+		if _, ok := other.v6[addr]; ok == not {
+			delete(s.v6, addr)
+		}
+	}
+	return nil
+}
+
+// PrefixCount is the number of unique keys in one network.
+type PrefixCount struct {
+	Prefix netip.Prefix
+	Unique uint64
+}
+
+// CountByPrefix returns how many unique IPv4 keys of s fall in each network
+// of the given prefix length that holds any, in ascending order. The
+// prefix length must not be longer than the one s was counted with.
+func (s *State) CountByPrefix(prefixLen int) ([]PrefixCount, error) {
+	switch {
+	case s.sketch != nil:
+		return nil, ErrNoKeys
+	case prefixLen < 0 || prefixLen > s.prefixLen:
+		return nil, fmt.Errorf("invalid prefix length /%d: want /0 to /%d", prefixLen, s.prefixLen)
+	}
+	var counts []PrefixCount
+	var last uint32
+	add := func(key uint32, n int) {
+		network := key &^ uint32(uint64(1)<<(32-prefixLen)-1)
+		if len(counts) > 0 && network == last {
+			counts[len(counts)-1].Unique += uint64(n)
+			return
+		}
+		addr := netip.AddrFrom4([4]byte{byte(network >> 24), byte(network >> 16), byte(network >> 8), byte(network)})
+		counts = append(counts, PrefixCount{netip.PrefixFrom(addr, prefixLen), uint64(n)})
+		last = network
+	}
+	if prefixLen <= 16 {
+		// Whole containers fall in one network.
+		for hi, c := range s.v4.containers {
+			if c != nil && c.cardinality() > 0 {
+				add(uint32(hi)<<16, c.cardinality())
+			}
+		}
+		return counts, nil
+	}
+	s.v4.each(func(key uint32) { add(key, 1) })
+	return counts, nil
+}
+
+// CountPrefix returns how many unique keys of s are in prefix. An IPv4
+// prefix is answered with popcounts over the bitmap words it covers, in
+// microseconds however many keys s holds, and must not be longer than the
+// prefix length s was counted with; an IPv6 prefix is answered by a pass
+// over the IPv6 addresses.
+func (s *State) CountPrefix(prefix netip.Prefix) (uint64, error) {
+	if s.sketch != nil {
+		return 0, ErrNoKeys
+	}
+	if prefix.Addr().Is6() {
+		var n uint64
+		for addr := range s.v6 {
+			if prefix.Contains(netip.AddrFrom16(addr)) {
+				n++
+			}
+		}
+		return n, nil
+	}
+	lo, hi, err := s.prefixRange(prefix)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(s.v4.rangeCardinality(lo, hi)), nil
+}
+
+// prefixRange returns the first and last IPv4 key in prefix.
+func (s *State) prefixRange(prefix netip.Prefix) (uint32, uint32, error) {
+	switch {
+	case !prefix.IsValid() || !prefix.Addr().Is4():
+		return 0, 0, fmt.Errorf("invalid IPv4 prefix %v", prefix)
+	case prefix.Bits() > s.prefixLen:
+		return 0, 0, fmt.Errorf("prefix %v is longer than the /%d keys of the set", prefix, s.prefixLen)
+	}
+	a := prefix.Masked().Addr().As4()
+	lo := binary.BigEndian.Uint32(a[:])
+	return lo, lo | uint32(uint64(1)<<(32-prefix.Bits())-1), nil
+}
+
+// ErrNoKeys is returned by WriteList for sketches, which keep no keys.
+var ErrNoKeys = errors.New("HyperLogLog sketches hold no addresses to list")
+
+// WriteList writes the keys of s as text, one per line: the IPv4 keys in
+// ascending order, as networks in CIDR notation when they were counted
+// under a mask, then the IPv6 addresses in ascending order. It returns how
+// many lines it wrote.
+func (s *State) WriteList(w io.Writer) (int64, error) {
+	if s.sketch != nil {
+		return 0, ErrNoKeys
+	}
+	return s.writeList(w, func(fn func(uint32)) { s.v4.each(fn) }, func(netip.Addr) bool { return true })
+}
+
+// WritePrefixList writes the keys of s in prefix as WriteList does. An
+// IPv4 prefix walks only the containers it covers, and must not be longer
+// than the prefix length s was counted with.
+func (s *State) WritePrefixList(w io.Writer, prefix netip.Prefix) (int64, error) {
+	if s.sketch != nil {
+		return 0, ErrNoKeys
+	}
+	if prefix.Addr().Is6() {
+		return s.writeList(w, func(func(uint32)) {}, prefix.Contains)
+	}
+	lo, hi, err := s.prefixRange(prefix)
+	if err != nil {
+		return 0, err
+	}
+	return s.writeList(w, func(fn func(uint32)) { s.v4.eachRange(lo, hi, fn) }, func(netip.Addr) bool { return false })
+}
+
+// writeList writes the IPv4 keys that eachV4 yields and the IPv6 addresses
+// keepV6 accepts.
+func (s *State) writeList(w io.Writer, eachV4 func(func(uint32)), keepV6 func(netip.Addr) bool) (int64, error) {
+	bw := bufio.NewWriterSize(w, 1<<20)
+	var n int64
+	buf := make([]byte, 0, 64)
+	eachV4(func(key uint32) {
+		buf = strconv.AppendUint(buf[:0], uint64(key>>24), 10)
+		for shift := 16; shift >= 0; shift -= 8 {
+			buf = append(buf, '.')
+			buf = strconv.AppendUint(buf, uint64(key>>shift&0xff), 10)
+		}
+		if s.prefixLen < 32 {
+			buf = append(buf, '/')
+			buf = strconv.AppendInt(buf, int64(s.prefixLen), 10)
+		}
+		bw.Write(append(buf, '\n'))
+		n++
+	})
+
+	var v6 [][16]byte
+	for addr := range s.v6 {
+		if keepV6(netip.AddrFrom16(addr)) {
+			v6 = append(v6, addr)
+		}
+	}
+	slices.SortFunc(v6, func(a, b [16]byte) int { return bytes.Compare(a[:], b[:]) })
+	for _, addr := range v6 {
+		buf = netip.AddrFrom16(addr).AppendTo(buf[:0])
+		bw.Write(append(buf, '\n'))
+		n++
+	}
+	return n, bw.Flush()
+}
+
+// Exact states are stored as stateMagic and the prefix length (uint8),
+// followed by a zstd stream of: the number of non-empty containers (uint32); per
+// container its top 16 bits (uint16), its count (uint32) and either its
+// low 16 bits sorted (uint16 each) when the count is at most 4096 or its
+// 8 KiB bitmap (uint64 words); the number of IPv6 addresses (uint64) and
+// their 16 bytes each. Integers are little-endian.
+const stateMagic = "IPCSTAT1"
+
+// Sketch states are stored as sketchStateMagic, the prefix length (uint8),
+// the precision (uint8) and whether there is an IPv6 sketch (uint8, 0 or
+// 1), followed by a zstd stream of the registers of the IPv4 sketch and
+// those of the IPv6 sketch, one byte each.
+const sketchStateMagic = "IPCSTHL1"
+
+// ErrNotState is returned by ReadState for input that is not a state.
+var ErrNotState = errors.New("not a saved state")
+
+// WriteTo writes s in its compressed binary form.
+func (s *State) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	header := append([]byte(stateMagic), byte(s.prefixLen))
+	if s.sketch != nil {
+		header = append([]byte(sketchStateMagic), byte(s.prefixLen), s.sketch.p, 0)
+		if s.sketch6 != nil {
+			header[len(header)-1] = 1
+		}
+	}
+	if _, err := cw.Write(header); err != nil {
+		return cw.n, err
+	}
+	enc, err := zstd.NewWriter(cw)
+	if err != nil {
+		return cw.n, err
+	}
+	bw := bufio.NewWriter(enc)
+	if s.sketch != nil {
+		s.writeSketches(bw)
+	} else {
+		s.writeSets(bw)
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	err = enc.Close()
+	return cw.n, err
+}
+
+func (s *State) writeSketches(bw *bufio.Writer) {
+	bw.Write(s.sketch.registers)
+	if s.sketch6 != nil {
+		bw.Write(s.sketch6.registers)
+	}
+}
+
+func (s *State) writeSets(bw *bufio.Writer) {
+	nonEmpty := 0
+	for _, c := range s.v4.containers {
+		if c != nil && c.cardinality() > 0 {
+			nonEmpty++
+		}
+	}
+	binary.Write(bw, binary.LittleEndian, uint32(nonEmpty))
+	var buf [8]byte
+	for hi, c := range s.v4.containers {
+		if c == nil || c.cardinality() == 0 {
+			continue
+		}
+		binary.LittleEndian.PutUint16(buf[:2], uint16(hi))
+		binary.LittleEndian.PutUint32(buf[2:6], uint32(c.cardinality()))
+		bw.Write(buf[:6])
+		switch {
+		case c.bitmap == nil:
+			binary.Write(bw, binary.LittleEndian, c.array)
+		case c.n > roaringArrayMax:
+			binary.Write(bw, binary.LittleEndian, c.bitmap[:])
+		default:
+			// A union that fits an array can still be in bitmap form.
+			binary.Write(bw, binary.LittleEndian, containerOf(c.bitmap).array)
+		}
+	}
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(s.v6)))
+	bw.Write(buf[:])
+	for addr := range s.v6 {
+		bw.Write(addr[:])
+	}
+}
+
+// ReadState reads a state written by State.WriteTo.
+func ReadState(r io.Reader) (*State, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(stateMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrNotState
+	}
+	s := &State{prefixLen: int(header[len(stateMagic)])}
+	magic := string(header[:len(stateMagic)])
+	if s.prefixLen > 32 || magic != stateMagic && magic != sketchStateMagic {
+		return nil, ErrNotState
+	}
+	var sketchHeader [2]byte
+	if magic == sketchStateMagic {
+		if _, err := io.ReadFull(br, sketchHeader[:]); err != nil {
+			return nil, errTruncatedState
+		}
+		if p := sketchHeader[0]; p < MinHLLPrecision || p > MaxHLLPrecision || sketchHeader[1] > 1 {
+			return nil, ErrNotState
+		}
+	}
+	dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	zr := bufio.NewReader(dec)
+
+	if magic == sketchStateMagic {
+		err = s.readSketches(zr, sketchHeader[0], sketchHeader[1] == 1)
+	} else {
+		err = s.readSets(zr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+var errTruncatedState = errors.New("truncated state")
+
+func (s *State) readSketches(zr *bufio.Reader, p uint8, ipv6 bool) error {
+	s.sketch = newHyperLogLog(p)
+	if _, err := io.ReadFull(zr, s.sketch.registers); err != nil {
+		return errTruncatedState
+	}
+	if ipv6 {
+		s.sketch6 = newHyperLogLog(p)
+		if _, err := io.ReadFull(zr, s.sketch6.registers); err != nil {
+			return errTruncatedState
+		}
+	}
+	return nil
+}
+
+func (s *State) readSets(zr *bufio.Reader) error {
+	s.v4, s.v6 = newRoaringBitmap(), ipv6Set{}
+	var buf [8]byte
+	if _, err := io.ReadFull(zr, buf[:4]); err != nil {
+		return errTruncatedState
+	}
+	n := binary.LittleEndian.Uint32(buf[:4])
+	if n > roaringContainers {
+		return ErrNotState
+	}
+	prev := -1
+	for ; n > 0; n-- {
+		if _, err := io.ReadFull(zr, buf[:6]); err != nil {
+			return errTruncatedState
+		}
+		hi := int(binary.LittleEndian.Uint16(buf[:2]))
+		count := int(binary.LittleEndian.Uint32(buf[2:6]))
+		if hi <= prev || count == 0 || count > 1<<16 {
+			return ErrNotState
+		}
+		prev = hi
+		c := &roaringContainer{}
+		if count <= roaringArrayMax {
+			c.array = make([]uint16, count)
+			if err := binary.Read(zr, binary.LittleEndian, c.array); err != nil {
+				return errTruncatedState
+			}
+			for i := 1; i < count; i++ {
+				if c.array[i] <= c.array[i-1] {
+					return ErrNotState
+				}
+			}
+		} else {
+			c.bitmap = new([roaringWords]uint64)
+			if err := binary.Read(zr, binary.LittleEndian, c.bitmap[:]); err != nil {
+				return errTruncatedState
+			}
+			for _, word := range c.bitmap {
+				c.n += bits.OnesCount64(word)
+			}
+			if c.n != count {
+				return ErrNotState
+			}
+		}
+		s.v4.containers[hi] = c
+	}
+
+	if _, err := io.ReadFull(zr, buf[:]); err != nil {
+		return errTruncatedState
+	}
+	var addr [16]byte
+	for n6 := binary.LittleEndian.Uint64(buf[:]); n6 > 0; n6-- {
+		if _, err := io.ReadFull(zr, addr[:]); err != nil {
+			return errTruncatedState
+		}
+		s.v6[addr] = struct{}{}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
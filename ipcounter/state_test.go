@@ -0,0 +1,118 @@
+package ipcounter
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// TestCountPrefix compares CountPrefix with a count of the keys in each
+// prefix, over sets with array and bitmap containers and prefixes that
+// cover several containers, one, or part of one.
+func TestCountPrefix(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	s, err := NewState(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint32
+	add := func(ip uint32) {
+		if !s.v4.contains(ip) {
+			keys = append(keys, ip)
+		}
+		s.v4.add(ip)
+	}
+	// A bitmap container, an array container and scattered keys.
+	for i := 0; i < 20000; i++ {
+		add(0x0a000000 | rng.Uint32N(1<<16))
+	}
+	for i := 0; i < 100; i++ {
+		add(0xc0a80000 | rng.Uint32N(1<<16))
+	}
+	for i := 0; i < 1000; i++ {
+		add(rng.Uint32())
+	}
+	add(0)
+	add(0xffffffff)
+	for _, ip := range []string{"2001:db8::1", "2001:db8::2", "2001:db9::1"} {
+		s.v6.add(netip.MustParseAddr(ip))
+	}
+
+	prefixes := []string{
+		"0.0.0.0/0", "10.0.0.0/8", "10.0.0.0/16", "10.0.128.0/17", "10.0.3.0/24",
+		"10.0.3.64/26", "10.0.3.7/32", "192.168.0.0/16", "192.168.7.0/24",
+		"255.255.255.255/32", "0.0.0.0/32", "128.0.0.0/1",
+	}
+	for i := 0; i < 100; i++ {
+		ip := keys[rng.IntN(len(keys))]
+		prefixes = append(prefixes, fmt.Sprintf("%d.%d.%d.%d/%d", ip>>24, ip>>16&0xff, ip>>8&0xff, ip&0xff, rng.IntN(33)))
+	}
+	for _, p := range prefixes {
+		prefix := netip.MustParsePrefix(p).Masked()
+		var want uint64
+		for _, ip := range keys {
+			if prefix.Contains(netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)})) {
+				want++
+			}
+		}
+		if got, err := s.CountPrefix(prefix); err != nil || got != want {
+			t.Errorf("CountPrefix(%v) = %d, %v; want %d", prefix, got, err, want)
+		}
+	}
+
+	if got, err := s.CountPrefix(netip.MustParsePrefix("2001:db8::/32")); err != nil || got != 2 {
+		t.Errorf("CountPrefix(2001:db8::/32) = %d, %v; want 2", got, err)
+	}
+	masked, _ := NewState(24)
+	if _, err := masked.CountPrefix(netip.MustParsePrefix("10.0.0.0/25")); err == nil {
+		t.Errorf("CountPrefix of a /25 in a set of /24 keys succeeded")
+	}
+}
+
+// TestWritePrefixList checks that WritePrefixList writes the lines of
+// WriteList that are in the prefix, in the same order.
+func TestWritePrefixList(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	for _, prefixLen := range []int{32, 24} {
+		s, err := NewState(prefixLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mask := ^uint32(0) << (32 - prefixLen)
+		for i := 0; i < 20000; i++ {
+			s.v4.add((0xcb007100 | rng.Uint32N(1<<16)) & mask)
+		}
+		for i := 0; i < 1000; i++ {
+			s.v4.add(rng.Uint32() & mask)
+		}
+		for _, ip := range []string{"2001:db8::1", "2001:db8::2", "2001:db9::1"} {
+			s.v6.add(netip.MustParseAddr(ip))
+		}
+		var all bytes.Buffer
+		if _, err := s.WriteList(&all); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range []string{"0.0.0.0/0", "203.0.0.0/8", "203.0.113.0/24", "203.0.0.0/20", "2001:db8::/32"} {
+			prefix := netip.MustParsePrefix(p)
+			var want strings.Builder
+			for _, line := range strings.SplitAfter(all.String(), "\n") {
+				addr, _, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "/")
+				if ip, err := netip.ParseAddr(addr); err == nil && prefix.Contains(ip) {
+					want.WriteString(line)
+				}
+			}
+			var got bytes.Buffer
+			n, err := s.WritePrefixList(&got, prefix)
+			if err != nil {
+				t.Fatalf("/%d keys: WritePrefixList(%v): %v", prefixLen, prefix, err)
+			}
+			if got.String() != want.String() || n != int64(strings.Count(want.String(), "\n")) {
+				t.Errorf("/%d keys: WritePrefixList(%v) wrote %d lines that differ from those of WriteList in the prefix", prefixLen, prefix, n)
+			}
+		}
+	}
+}
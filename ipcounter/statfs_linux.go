@@ -0,0 +1,14 @@
+package ipcounter
+
+import "syscall"
+
+// fsBlockSize returns the preferred I/O size of the filesystem holding
+// fileName. Striped filesystems (RAID, Lustre) typically report their stripe
+// unit here rather than the device sector size.
+func fsBlockSize(fileName string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(fileName, &st); err != nil || st.Bsize <= 0 {
+		return 0, false
+	}
+	return int64(st.Bsize), true
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package ipcounter
+
+func fsBlockSize(fileName string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,39 @@
+package ipcounter
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// inputStorage reads whether the block device holding path is rotational
+// from sysfs. Partitions report it through their parent device; files on
+// filesystems without a block device of their own (tmpfs, overlay, network
+// filesystems) are of unknown kind.
+func inputStorage(path string) storageKind {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return storageUnknown
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	if major == 0 {
+		return storageUnknown
+	}
+	dir := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	for _, name := range []string{dir + "/queue/rotational", dir + "/../queue/rotational"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(string(data)) {
+		case "1":
+			return storageRotational
+		case "0":
+			return storageSolidState
+		}
+	}
+	return storageUnknown
+}
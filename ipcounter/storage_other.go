@@ -0,0 +1,7 @@
+//go:build !linux
+
+package ipcounter
+
+func inputStorage(path string) storageKind {
+	return storageUnknown
+}
@@ -0,0 +1,204 @@
+package ipcounter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+)
+
+// CountReader is Count for input that can only be read once, such as a
+// pipe; see RunReader.
+func (c *Counter) CountReader(ctx context.Context, r io.Reader, opts ...Option) (uint64, error) {
+	result, err := c.RunReader(ctx, r, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return result.Unique + result.UniqueIPv6, nil
+}
+
+// RunReader counts input that can only be read once and whose size is not
+// known, such as a pipe. There are no chunks to split: a single goroutine
+// reads the stream into one bitmap, so WithWorkers and WithDirectIO do not
+// apply, sorted input is not detected and WithSpotCheck is skipped.
+func (c *Counter) RunReader(ctx context.Context, r io.Reader, opts ...Option) (*Result, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	if o.directIO {
+		return nil, errors.New("direct I/O needs a file, not a stream")
+	}
+	return withExternalSet(o, func(o options) (*Result, error) {
+		result, err := runStream(ctx, r, -1, o)
+		if err != nil {
+			return nil, err
+		}
+		return newResult(result, o), nil
+	})
+}
+
+// streamReason reports why the file at path has to be read as a stream:
+// pipes, devices and sockets cannot be split into chunks, and files that
+// report a size of 0 (procfs, some FUSE mounts) would give empty chunks.
+func streamReason(path string) (string, bool) {
+	fi, err := os.Stat(path)
+	switch {
+	case err != nil:
+		// Let opening the file report the error.
+		return "", false
+	case fi.IsDir():
+		return "", false
+	case !fi.Mode().IsRegular():
+		return "is not a regular file", true
+	case fi.Size() == 0:
+		return "reports a size of 0", true
+	}
+	return "", false
+}
+
+// runStream counts r, which holds size bytes or -1 if that is unknown.
+func runStream(ctx context.Context, r io.Reader, size int64, o options) (*runResult, error) {
+	var err error
+
+	if o.recordPath != "" {
+		o.recorder, err = createInvalidRecorder(o.recordPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create invalid-line recording: %v", err)
+		}
+		defer o.recorder.Close()
+	}
+
+	// A stream is counted into the single bitmap planMemory reserves for
+	// the merged result; there are no worker bitmaps and nothing to spill.
+	available, haveAvailable := availableMemory()
+	plan, planErr := planMemory(0, available, haveAvailable, o)
+	logMemoryPlan(plan, available, haveAvailable, o)
+	if planErr != nil {
+		return nil, fmt.Errorf("not enough memory: %v", planErr)
+	}
+
+	if o.beforeScan != nil {
+		if err := o.beforeScan(); err != nil {
+			return nil, err
+		}
+	}
+
+	o.logf("reading a stream: counting in a single pass\n")
+	stop := o.startProgress(size, 1)
+	result, err := countStream(ctx, r, o)
+	stop()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("processing failed: %v", err)
+	}
+
+	if o.recorder != nil {
+		if err := o.recorder.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write invalid-line recording: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// countStream counts r from start to end into one bitmap. It is
+// processChunk for a single chunk of unknown length. Encrypted and
+// compressed input is detected, decrypted and decompressed, in that order;
+// the hash still covers the bytes as read. With WithPcap, the lines are
+// those pcapLines makes of the capture, and binary input is read as
+// records.
+func countStream(ctx context.Context, r io.Reader, opts options) (*runResult, error) {
+	var read atomic.Int64
+	r = countReads(countReads(r, opts.tracker.worker(0)), &read)
+	var hasher *pieceHasher
+	if opts.newHash != nil {
+		hasher = newPieceHasher(opts.newHash, math.MaxInt64)
+		r = io.TeeReader(r, hasher)
+	}
+	raw := r
+
+	// Without a sample to size the buffer from, allow for the longest lines
+	// the chunked path would.
+	reader := bufio.NewReaderSize(r, maxReadSize)
+	if head, _ := reader.Peek(encryptionMagicLen); isEncrypted(head) {
+		opts.logf("input is age-encrypted, decrypting it on the fly\n")
+		dr, err := opts.decrypt(reader, head)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt: %v", err)
+		}
+		reader = bufio.NewReaderSize(dr, maxReadSize)
+	}
+	head, _ := reader.Peek(compressionMagicLen)
+	if c := detectCompression(head); c != uncompressed {
+		opts.logf("input is %s-compressed, decompressing it on the fly\n", c)
+		dr, err := decompress(c, reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start decompressing: %v", err)
+		}
+		defer dr.Close()
+		reader = bufio.NewReaderSize(dr, maxReadSize)
+	}
+
+	var bitmap []uint64
+	if b := preallocBitmaps(1, opts); b != nil {
+		bitmap = b[0]
+	} else if opts.dense() {
+		bitmap = make([]uint64, bitmapWords)
+	}
+	var result *chunkResult
+	var err error
+	switch {
+	case opts.inputFormat == InputBinary4:
+		result, err = scanRecords(ctx, reader, 0, math.MaxInt64, opts, bitmap)
+	case opts.pcap != 0:
+		var lines *pcapLines
+		if lines, err = newPcapLines(reader, opts.pcap, opts.ipv6); err != nil {
+			return nil, fmt.Errorf("failed to read packet capture: %v", err)
+		}
+		result, err = scanLines(ctx, lines, 0, math.MaxInt64, opts, bitmap)
+	default:
+		result, err = scanLines(ctx, newBlockLines(reader, minReadSize), 0, math.MaxInt64, opts, bitmap)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	run := &runResult{
+		lines:       result.lines,
+		filtered:    result.filtered,
+		occurrences: result.occurrences,
+		invalid:     result.invalid,
+		samples:     result.samples,
+		partial:     result.partial,
+		covered:     result.scanned,
+		segments:    result.segments,
+		bitmap:      result.bitmap,
+		v6:          result.v6,
+		frequencies: result.frequencies,
+		top:         result.top,
+		sparse:      result.sparse,
+		sketch:      result.sketch,
+		sketch6:     result.sketch6,
+	}
+	switch {
+	case result.sketch != nil:
+		run.unique = int(result.sketch.estimate())
+	case result.sparse != nil:
+		run.unique = result.sparse.cardinality()
+	default:
+		run.unique = countBits(result.bitmap, opts.mergeWorkers)
+	}
+	if hasher != nil {
+		if run.digests, err = hasher.finish(raw); err != nil {
+			return nil, fmt.Errorf("failed to hash input: %v", err)
+		}
+	}
+	run.bytes = read.Load()
+	return run, nil
+}
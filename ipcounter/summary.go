@@ -0,0 +1,224 @@
+package ipcounter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"math/bits"
+	"net/netip"
+)
+
+// summaryBlockWords is the size of one /16 of the IPv4 bitmap in words.
+const summaryBlockWords = 1 << 16 / 64
+
+// SetSummary describes a counted IPv4 set compactly: how many keys fall in
+// each /16, and a checksum of the whole set. Counts of the same input with
+// the same parsing options and mask give equal summaries whatever the
+// backend, layout or worker count, so comparing the summaries of two runs
+// localizes a discrepancy to /16 regions; see Diff.
+type SetSummary struct {
+	// Counts holds the number of keys in each /16, indexed by its top 16
+	// bits.
+	Counts [1 << 16]uint32
+	// Checksum is the SHA-256 of the non-empty /16s in order, each as its
+	// top 16 bits (big-endian) followed by its 8 KiB bitmap (little-endian
+	// words, address order).
+	Checksum [sha256.Size]byte
+}
+
+// RegionDiff is a /16 whose key counts differ between two summaries.
+type RegionDiff struct {
+	Prefix     netip.Prefix
+	Count      uint32
+	OtherCount uint32
+}
+
+// Equal reports whether s and other describe the same set.
+func (s *SetSummary) Equal(other *SetSummary) bool {
+	return s.Checksum == other.Checksum && s.Counts == other.Counts
+}
+
+// Diff lists the /16s whose counts differ, in address order. Sets can
+// differ with no such region, when a /16 holds different keys of the same
+// number; Equal catches that through the checksum.
+func (s *SetSummary) Diff(other *SetSummary) []RegionDiff {
+	var diffs []RegionDiff
+	for i, n := range s.Counts {
+		if n != other.Counts[i] {
+			addr := netip.AddrFrom4([4]byte{byte(i >> 8), byte(i), 0, 0})
+			diffs = append(diffs, RegionDiff{netip.PrefixFrom(addr, 16), n, other.Counts[i]})
+		}
+	}
+	return diffs
+}
+
+// Summaries are stored as summaryMagic, the checksum, the number of
+// non-empty /16s (uint32) and one record per non-empty /16: its top 16 bits
+// (uint16) and its count (uint32), all little-endian.
+const summaryMagic = "IPCSUM1\n"
+
+// ErrNotSummary is returned by ReadSetSummary for input that is not a
+// summary.
+var ErrNotSummary = errors.New("not a set summary")
+
+// WriteTo writes s in its binary form, a few bytes per non-empty /16.
+func (s *SetSummary) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(summaryMagic)
+	bw.Write(s.Checksum[:])
+	nonEmpty := 0
+	for _, n := range s.Counts {
+		if n > 0 {
+			nonEmpty++
+		}
+	}
+	var rec [6]byte
+	binary.LittleEndian.PutUint32(rec[:4], uint32(nonEmpty))
+	bw.Write(rec[:4])
+	for i, n := range s.Counts {
+		if n > 0 {
+			binary.LittleEndian.PutUint16(rec[:2], uint16(i))
+			binary.LittleEndian.PutUint32(rec[2:], n)
+			bw.Write(rec[:])
+		}
+	}
+	size := int64(len(summaryMagic) + len(s.Checksum) + 4 + 6*nonEmpty)
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// ReadSetSummary reads a summary written by WriteTo.
+func ReadSetSummary(r io.Reader) (*SetSummary, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(summaryMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != summaryMagic {
+		return nil, ErrNotSummary
+	}
+	s := &SetSummary{}
+	if _, err := io.ReadFull(br, s.Checksum[:]); err != nil {
+		return nil, errors.New("truncated summary checksum")
+	}
+	var rec [6]byte
+	if _, err := io.ReadFull(br, rec[:4]); err != nil {
+		return nil, errors.New("truncated summary header")
+	}
+	n := binary.LittleEndian.Uint32(rec[:4])
+	if n > uint32(len(s.Counts)) {
+		return nil, ErrNotSummary
+	}
+	for ; n > 0; n-- {
+		if _, err := io.ReadFull(br, rec[:]); err != nil {
+			return nil, errors.New("truncated summary record")
+		}
+		s.Counts[binary.LittleEndian.Uint16(rec[:2])] = binary.LittleEndian.Uint32(rec[2:])
+	}
+	return s, nil
+}
+
+// summaryBuilder builds a SetSummary from /16 bitmaps given in increasing
+// order, or from keys given in increasing order.
+type summaryBuilder struct {
+	s     SetSummary
+	h     hash.Hash
+	block int
+	bits  [summaryBlockWords]uint64
+	buf   [2 + 8*summaryBlockWords]byte
+}
+
+func newSummaryBuilder() *summaryBuilder {
+	return &summaryBuilder{h: sha256.New(), block: -1}
+}
+
+// addBlock adds the bitmap of the /16 with top bits hi.
+func (b *summaryBuilder) addBlock(hi int, block *[summaryBlockWords]uint64) {
+	n := 0
+	for _, word := range block {
+		n += bits.OnesCount64(word)
+	}
+	if n == 0 {
+		return
+	}
+	b.s.Counts[hi] = uint32(n)
+	binary.BigEndian.PutUint16(b.buf[:2], uint16(hi))
+	for i, word := range block {
+		binary.LittleEndian.PutUint64(b.buf[2+8*i:], word)
+	}
+	b.h.Write(b.buf[:])
+}
+
+// add adds a key no smaller than the previous one.
+func (b *summaryBuilder) add(ip uint32) {
+	if hi := int(ip >> 16); hi != b.block {
+		b.flush()
+		b.block = hi
+	}
+	lo := ip & 0xffff
+	b.bits[lo/64] |= 1 << (lo % 64)
+}
+
+func (b *summaryBuilder) flush() {
+	if b.block >= 0 {
+		b.addBlock(b.block, &b.bits)
+		clear(b.bits[:])
+	}
+}
+
+func (b *summaryBuilder) finish() *SetSummary {
+	b.flush()
+	b.h.Sum(b.s.Checksum[:0])
+	return &b.s
+}
+
+// summarize builds the summary of a result's IPv4 set, or returns nil for
+// results that do not hold an exact set.
+func summarize(r *runResult, o options) *SetSummary {
+	if r.summary != nil {
+		return r.summary
+	}
+	b := newSummaryBuilder()
+	var block [summaryBlockWords]uint64
+	switch {
+	case r.bitmap != nil:
+		for hi := 0; hi < 1<<16; hi++ {
+			b.addBlock(hi, denseBlock(r.bitmap, o.layout, hi, &block))
+		}
+	case r.sparse != nil:
+		for hi, c := range r.sparse.containers {
+			switch {
+			case c == nil:
+				continue
+			case c.bitmap != nil:
+				b.addBlock(hi, c.bitmap)
+			default:
+				clear(block[:])
+				for _, lo := range c.array {
+					block[lo/64] |= 1 << (lo % 64)
+				}
+				b.addBlock(hi, &block)
+			}
+		}
+	default:
+		return nil
+	}
+	return b.finish()
+}
+
+// denseBlock returns the bitmap of the /16 with top bits hi in a dense
+// bitmap, in address order: a view into it with LayoutLinear, a copy into
+// block with other layouts.
+func denseBlock(bitmap []uint64, layout Layout, hi int, block *[summaryBlockWords]uint64) *[summaryBlockWords]uint64 {
+	if layout == LayoutLinear {
+		return (*[summaryBlockWords]uint64)(bitmap[hi*summaryBlockWords:])
+	}
+	clear(block[:])
+	for lo := uint32(0); lo < 1<<16; lo++ {
+		idx, pos := layout.index(uint32(hi)<<16 | lo)
+		block[lo/64] |= (bitmap[idx] >> pos & 1) << (lo % 64)
+	}
+	return block
+}
@@ -0,0 +1,290 @@
+package ipcounter
+
+import (
+	"slices"
+)
+
+// TopEntry is one of the most frequent addresses reported by WithTopN.
+type TopEntry struct {
+	// IP is the address, or the network with WithMask.
+	IP uint32
+	// Count is how often it occurred; with Result.TopApproximate, an upper
+	// bound that is usually close.
+	Count uint64
+}
+
+const (
+	// topExactMax is how many distinct keys a topCounter counts exactly
+	// before it switches to a count-min sketch: some 40 MiB of map.
+	topExactMax = 1 << 20
+	// The count-min sketch has cmsDepth rows of cmsWidth counters,
+	// cmsBytes in all. Estimates exceed the true counts by at most
+	// e/cmsWidth of all occurrences with high probability, and typically
+	// by far less, so only addresses well above that stand out.
+	cmsDepth = 4
+	cmsWidth = 1 << 21
+	cmsBytes = cmsDepth * cmsWidth * 8
+	// topMinCandidates is the fewest candidates a sketch tracks, however
+	// small N is; more candidates make it less likely that an address
+	// frequent overall but spread thinly over the chunks is missed.
+	topMinCandidates = 1024
+)
+
+// topCounter finds the most frequent keys. It counts exactly in a map while
+// there are at most topExactMax distinct keys, then folds the map into a
+// count-min sketch and keeps a bounded set of candidates: the keys with the
+// highest estimates seen so far.
+type topCounter struct {
+	n          int
+	exact      frequencyMap
+	sketch     *countMinSketch
+	candidates *topCandidates
+}
+
+func newTopCounter(n int) *topCounter {
+	return &topCounter{n: n, exact: frequencyMap{}}
+}
+
+func (t *topCounter) add(ip uint32, weight uint64) {
+	if t.exact != nil {
+		t.exact.add(ip, weight)
+		if len(t.exact) > topExactMax {
+			t.toSketch()
+		}
+		return
+	}
+	t.candidates.offer(ip, t.sketch.add(ip, weight))
+}
+
+// toSketch switches t from its exact map to a sketch.
+func (t *topCounter) toSketch() {
+	t.sketch = &countMinSketch{}
+	t.candidates = newTopCandidates(max(4*t.n, topMinCandidates))
+	for ip, n := range t.exact {
+		t.sketch.add(ip, n)
+	}
+	for ip := range t.exact {
+		t.candidates.offer(ip, t.sketch.estimate(ip))
+	}
+	t.exact = nil
+}
+
+// merge adds other's counts to t; other is taken over.
+func (t *topCounter) merge(other *topCounter) {
+	if other == nil {
+		return
+	}
+	if t.exact != nil && other.exact != nil {
+		for ip, n := range other.exact {
+			t.exact.add(ip, n)
+		}
+		if len(t.exact) > topExactMax {
+			t.toSketch()
+		}
+		return
+	}
+	if t.exact != nil {
+		*t, *other = *other, *t
+	}
+
+	// t is a sketch now; add other's counts and re-estimate the candidates
+	// of both against the merged sketch.
+	ips := t.candidates.ips()
+	if other.exact != nil {
+		for ip, n := range other.exact {
+			t.sketch.add(ip, n)
+			ips = append(ips, ip)
+		}
+	} else {
+		t.sketch.merge(other.sketch)
+		ips = append(ips, other.candidates.ips()...)
+	}
+	t.candidates = newTopCandidates(t.candidates.cap)
+	for _, ip := range ips {
+		t.candidates.offer(ip, t.sketch.estimate(ip))
+	}
+}
+
+// top returns the n most frequent keys, most frequent first and ties in
+// address order, and whether the counts are estimates.
+func (t *topCounter) top() ([]TopEntry, bool) {
+	if t.exact != nil {
+		return topOf(t.exact, t.n), false
+	}
+	entries := slices.Clone(t.candidates.entries)
+	sortTop(entries)
+	return entries[:min(len(entries), t.n)], true
+}
+
+// topOf returns the n most frequent keys of an exact count.
+func topOf(frequencies frequencyMap, n int) []TopEntry {
+	c := newTopCandidates(n)
+	for ip, count := range frequencies {
+		c.offer(ip, count)
+	}
+	sortTop(c.entries)
+	return c.entries
+}
+
+func sortTop(entries []TopEntry) {
+	slices.SortFunc(entries, func(a, b TopEntry) int {
+		switch {
+		case ranksAbove(a, b):
+			return -1
+		case ranksAbove(b, a):
+			return 1
+		}
+		return 0
+	})
+}
+
+// mergeTop merges counters into the first non-nil one.
+func mergeTop(counters []*topCounter) *topCounter {
+	var dst *topCounter
+	for _, t := range counters {
+		if dst == nil {
+			dst = t
+		} else {
+			dst.merge(t)
+		}
+	}
+	return dst
+}
+
+// countMinSketch estimates counts from above: each key adds its weight to
+// one counter per row, and its estimate is the smallest of them.
+type countMinSketch struct {
+	counters [cmsDepth][cmsWidth]uint64
+}
+
+// cmsIndexes derives the key's counter in each row from one hash
+// (Kirsch-Mitzenmacher double hashing).
+func cmsIndexes(ip uint32) [cmsDepth]uint32 {
+	h := mix64(uint64(ip))
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	var idx [cmsDepth]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) & (cmsWidth - 1)
+	}
+	return idx
+}
+
+// add adds weight to ip's estimate and returns the new one. It raises only
+// the counters below it (conservative update), which leaves the estimates
+// upper bounds but makes them much tighter than adding to every row.
+func (s *countMinSketch) add(ip uint32, weight uint64) uint64 {
+	idx := cmsIndexes(ip)
+	est := s.counters[0][idx[0]]
+	for row := 1; row < cmsDepth; row++ {
+		est = min(est, s.counters[row][idx[row]])
+	}
+	est = addWeight(est, weight)
+	for row, i := range idx {
+		s.counters[row][i] = max(s.counters[row][i], est)
+	}
+	return est
+}
+
+func (s *countMinSketch) estimate(ip uint32) uint64 {
+	est := uint64(0)
+	for row, i := range cmsIndexes(ip) {
+		if c := s.counters[row][i]; row == 0 || c < est {
+			est = c
+		}
+	}
+	return est
+}
+
+func (s *countMinSketch) merge(other *countMinSketch) {
+	for row := range s.counters {
+		for i, c := range other.counters[row] {
+			s.counters[row][i] = addWeight(s.counters[row][i], c)
+		}
+	}
+}
+
+// topCandidates keeps the cap keys ranked highest among those offered, in
+// a min-heap so that the lowest is the one replaced.
+type topCandidates struct {
+	cap     int
+	entries []TopEntry
+	index   map[uint32]int
+}
+
+func newTopCandidates(cap int) *topCandidates {
+	return &topCandidates{cap: cap, index: make(map[uint32]int)}
+}
+
+// offer records that ip's count is now count, which never decreases.
+func (c *topCandidates) offer(ip uint32, count uint64) {
+	if i, ok := c.index[ip]; ok {
+		c.entries[i].Count = count
+		c.down(i)
+		return
+	}
+	if len(c.entries) < c.cap {
+		c.entries = append(c.entries, TopEntry{ip, count})
+		c.index[ip] = len(c.entries) - 1
+		c.up(len(c.entries) - 1)
+		return
+	}
+	if !ranksAbove(TopEntry{ip, count}, c.entries[0]) {
+		return
+	}
+	delete(c.index, c.entries[0].IP)
+	c.entries[0] = TopEntry{ip, count}
+	c.index[ip] = 0
+	c.down(0)
+}
+
+func (c *topCandidates) ips() []uint32 {
+	ips := make([]uint32, len(c.entries))
+	for i, e := range c.entries {
+		ips[i] = e.IP
+	}
+	return ips
+}
+
+func (c *topCandidates) less(i, j int) bool {
+	return ranksAbove(c.entries[j], c.entries[i])
+}
+
+// ranksAbove orders entries by count, and those of equal count by address,
+// so that which of them make the top N does not depend on map order.
+func ranksAbove(a, b TopEntry) bool {
+	return a.Count > b.Count || a.Count == b.Count && a.IP < b.IP
+}
+
+func (c *topCandidates) swap(i, j int) {
+	c.entries[i], c.entries[j] = c.entries[j], c.entries[i]
+	c.index[c.entries[i].IP] = i
+	c.index[c.entries[j].IP] = j
+}
+
+func (c *topCandidates) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !c.less(i, parent) {
+			return
+		}
+		c.swap(i, parent)
+		i = parent
+	}
+}
+
+func (c *topCandidates) down(i int) {
+	for {
+		smallest := i
+		if l := 2*i + 1; l < len(c.entries) && c.less(l, smallest) {
+			smallest = l
+		}
+		if r := 2*i + 2; r < len(c.entries) && c.less(r, smallest) {
+			smallest = r
+		}
+		if smallest == i {
+			return
+		}
+		c.swap(i, smallest)
+		i = smallest
+	}
+}
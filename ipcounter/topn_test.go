@@ -0,0 +1,56 @@
+package ipcounter
+
+import (
+	"testing"
+)
+
+// TestTopCounterExactLimit checks when a topCounter switches from its exact
+// map to the count-min sketch: in a worker once it has seen more than
+// topExactMax distinct keys, and in a merge once the workers' keys together
+// are more than that.
+func TestTopCounterExactLimit(t *testing.T) {
+	// keyRange is a worker's input: n distinct keys from start, once each,
+	// and then the first again 1000 times and the second 500 times.
+	type keyRange struct{ start, n uint32 }
+	const half = topExactMax / 2
+	for _, tt := range []struct {
+		name        string
+		workers     []keyRange
+		approximate bool
+		want        []TopEntry
+	}{
+		{"one worker at the limit", []keyRange{{0, topExactMax}}, false, []TopEntry{{0, 1001}, {1, 501}}},
+		{"one worker past the limit", []keyRange{{0, topExactMax + 1}}, true, []TopEntry{{0, 1001}, {1, 501}}},
+		{"merge at the limit", []keyRange{{0, half}, {half, half}}, false, []TopEntry{{0, 1001}, {half, 1001}}},
+		{"merge past the limit", []keyRange{{0, half}, {half, half + 1}}, true, []TopEntry{{0, 1001}, {half, 1001}}},
+		{"merge of the same keys", []keyRange{{0, topExactMax}, {0, topExactMax}}, false, []TopEntry{{0, 2002}, {1, 1002}}},
+		{"merge of a sketch and a map", []keyRange{{0, topExactMax + 1}, {topExactMax + 1, 10}}, true, []TopEntry{{0, 1001}, {topExactMax + 1, 1001}}},
+		{"merge of a map and a sketch", []keyRange{{topExactMax + 1, 10}, {0, topExactMax + 1}}, true, []TopEntry{{0, 1001}, {topExactMax + 1, 1001}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			counters := make([]*topCounter, len(tt.workers))
+			for i, r := range tt.workers {
+				counters[i] = newTopCounter(len(tt.want))
+				for ip := r.start; ip < r.start+r.n; ip++ {
+					counters[i].add(ip, 1)
+				}
+				counters[i].add(r.start, 1000)
+				counters[i].add(r.start+1, 500)
+			}
+			top, approximate := mergeTop(counters).top()
+			if approximate != tt.approximate {
+				t.Fatalf("approximate = %v, want %v", approximate, tt.approximate)
+			}
+			if len(top) != len(tt.want) {
+				t.Fatalf("top = %v, want %v", top, tt.want)
+			}
+			for i, e := range top {
+				w := tt.want[i]
+				// Sketch estimates are upper bounds of the true counts.
+				if e.IP != w.IP || e.Count < w.Count || !approximate && e.Count != w.Count {
+					t.Fatalf("top = %v, want %v", top, tt.want)
+				}
+			}
+		})
+	}
+}
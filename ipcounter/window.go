@@ -0,0 +1,197 @@
+package ipcounter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Window pages are windowPageBits-address slices of the IPv4 bitmap,
+// allocated when the first address in them is added.
+const (
+	windowPageBits  = 16
+	windowPageWords = 1 << windowPageBits / 64
+	windowPages     = 1 << (32 - windowPageBits)
+)
+
+type windowPage [windowPageWords]uint64
+
+// Window counts the unique IPv4 addresses added during the last TTL, for
+// long-running processes that see addresses one at a time rather than in a
+// file. The TTL is split into generations, each a sparse bitmap covering
+// TTL/generations. One generation more than the TTL spans is kept, and the
+// oldest is dropped when a new one starts, so an address is forgotten
+// between TTL and TTL+TTL/generations after it was last added, never
+// before. Memory is bounded by the generation count: 8 KiB per
+// 65536-address page touched in each of the generations+1 bitmaps, and
+// never more than 512 MiB per bitmap.
+//
+// Of the options, only WithMask, WithTrim and WithWeights apply, the latter
+// two to AddLine. A Window is safe for concurrent use.
+type Window struct {
+	mu   sync.Mutex
+	opts options
+	span time.Duration
+	// gens is a ring of generations+1 generations, gens[head] the current
+	// one, which started at headStart. The extra one keeps the oldest
+	// generation until all of it is at least a TTL old.
+	gens      []windowGeneration
+	head      int
+	headStart time.Time
+	now       func() time.Time
+}
+
+// NewWindow returns a Window forgetting addresses after ttl, tracked in the
+// given number of generations; more generations expire addresses closer to
+// ttl at the cost of memory.
+func NewWindow(ttl time.Duration, generations int, opts ...Option) (*Window, error) {
+	if generations < 1 {
+		return nil, fmt.Errorf("a window needs at least one generation, got %d", generations)
+	}
+	if ttl < time.Duration(generations) {
+		return nil, fmt.Errorf("TTL %v is too short for %d generations", ttl, generations)
+	}
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	w := &Window{
+		opts: o,
+		span: ttl / time.Duration(generations),
+		gens: make([]windowGeneration, generations+1),
+		now:  time.Now,
+	}
+	w.headStart = w.now()
+	return w, nil
+}
+
+// Add records an occurrence of ip.
+func (w *Window) Add(ip uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.current().add(w.opts.key(ip))
+}
+
+// AddBatch records an occurrence of each of ips. It takes the lock and
+// checks the clock once for the whole batch, which is what dominates Add
+// at millions of calls per second.
+func (w *Window) AddBatch(ips []uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	gen := w.current()
+	for _, ip := range ips {
+		gen.add(w.opts.key(ip))
+	}
+}
+
+// AddAddrs is AddBatch for netip addresses. IPv4-mapped IPv6 addresses
+// count as IPv4; other IPv6 addresses and invalid ones are skipped. It
+// returns how many addresses were added.
+func (w *Window) AddAddrs(addrs []netip.Addr) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	gen := w.current()
+	added := 0
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if !addr.Is4() {
+			continue
+		}
+		a := addr.As4()
+		gen.add(w.opts.key(binary.BigEndian.Uint32(a[:])))
+		added++
+	}
+	return added
+}
+
+// windowGeneration is one generation's pages, indexed by the address bits
+// above windowPageBits.
+type windowGeneration []*windowPage
+
+// current returns the generation addresses are added to now, allocating
+// it if needed. w.mu must be held.
+func (w *Window) current() windowGeneration {
+	w.advance()
+	if w.gens[w.head] == nil {
+		w.gens[w.head] = make(windowGeneration, windowPages)
+	}
+	return w.gens[w.head]
+}
+
+func (g windowGeneration) add(ip uint32) {
+	page := g[ip>>windowPageBits]
+	if page == nil {
+		page = new(windowPage)
+		g[ip>>windowPageBits] = page
+	}
+	off := ip & (1<<windowPageBits - 1)
+	page[off/64] |= 1 << (off % 64)
+}
+
+// AddLine parses one input line the way a count with the Window's options
+// would and adds its address. Lines of weight 0 add nothing; malformed
+// lines return the ParseIPv4, ErrInvalidWeight, ErrMissingField or ErrNoMatch error.
+func (w *Window) AddLine(line []byte) error {
+	ip, weight, err := w.opts.parseLine(line)
+	if err != nil {
+		return err
+	}
+	if weight > 0 {
+		w.Add(ip)
+	}
+	return nil
+}
+
+// Unique returns the number of distinct addresses (or networks, with
+// WithMask) added in the window.
+func (w *Window) Unique() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance()
+
+	var unique uint64
+	var merged windowPage
+	for p := 0; p < windowPages; p++ {
+		found := false
+		for _, gen := range w.gens {
+			if gen == nil || gen[p] == nil {
+				continue
+			}
+			if !found {
+				merged, found = *gen[p], true
+				continue
+			}
+			for i, word := range gen[p] {
+				merged[i] |= word
+			}
+		}
+		if !found {
+			continue
+		}
+		for _, word := range merged {
+			unique += uint64(bits.OnesCount64(word))
+		}
+	}
+	return unique
+}
+
+// advance starts a new generation for every span elapsed since the current
+// one started, dropping the oldest each time.
+func (w *Window) advance() {
+	elapsed := int64(w.now().Sub(w.headStart) / w.span)
+	if elapsed <= 0 {
+		return
+	}
+	for i := int64(0); i < min(elapsed, int64(len(w.gens))); i++ {
+		w.head = (w.head + 1) % len(w.gens)
+		w.gens[w.head] = nil
+	}
+	w.headStart = w.headStart.Add(time.Duration(elapsed) * w.span)
+}
@@ -0,0 +1,40 @@
+package ipcounter
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWindowExpiry checks that an address is kept for at least the TTL and
+// forgotten within TTL+TTL/generations of being added, wherever in its
+// generation's span it was added.
+func TestWindowExpiry(t *testing.T) {
+	const (
+		ttl         = 4 * time.Second
+		generations = 4
+		span        = ttl / generations
+	)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, span / 2, span - time.Millisecond, 3*span + span/3} {
+		for age := time.Duration(0); age <= ttl+2*span; age += 50 * time.Millisecond {
+			now := start
+			w, err := NewWindow(ttl, generations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.now = func() time.Time { return now }
+			w.headStart = now
+
+			now = start.Add(offset)
+			w.Add(1)
+			now = now.Add(age)
+			got := w.Unique()
+			switch {
+			case age < ttl && got != 1:
+				t.Errorf("added at %v: forgotten after %v, before the TTL of %v", offset, age, ttl)
+			case age >= ttl+span && got != 0:
+				t.Errorf("added at %v: still counted after %v, past TTL+TTL/generations", offset, age)
+			}
+		}
+	}
+}
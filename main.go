@@ -1,184 +1,893 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/sha256"
+	"flag"
 	"fmt"
-	"io"
+	"hash"
 	"log"
-	"math/bits"
+	"math"
 	"os"
+	"os/signal"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"golang.org/x/sync/errgroup"
+	"ip-addr-counter/ipcounter"
 )
 
-func main() {
-	start := time.Now()
+// maxWorkers bounds -workers; beyond this, per-worker bitmaps only add
+// memory pressure and merge time.
+const maxWorkers = 256
 
-	numWorkers := runtime.NumCPU()
-	log.Printf("using %d workers\n", numWorkers)
+// quiet suppresses everything logf logs; errors are still reported.
+var quiet bool
 
-	fileName := "ip_addresses"
-	file, err := os.Open(fileName)
-	if err != nil {
-		log.Fatalf("failed to open input file: %v", err)
+// logf logs informational messages unless -quiet is set.
+func logf(format string, args ...any) {
+	if !quiet {
+		log.Printf(format, args...)
 	}
-	defer file.Close()
+}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		log.Fatalf("failed to stat input file: %v", err)
+// parseInterspersed parses args with fs, taking flags after the positional
+// arguments as well as before them, and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if args = fs.Args(); len(args) == 0 {
+			return positional
+		}
+		positional, args = append(positional, args[0]), args[1:]
 	}
-	fileSize := fileInfo.Size()
+}
 
-	chunkSize := fileSize / int64(numWorkers)
-	offsets := make([]int64, 0, numWorkers+1)
+// workerCount validates the requested worker count, picking one per CPU for
+// 0 and clamping to maxWorkers and to -max-procs when that is set.
+func workerCount(requested, maxProcs int) (int, error) {
+	if requested < 0 {
+		return 0, fmt.Errorf("must not be negative, got %d", requested)
+	}
 
-	for i := 0; i < numWorkers; i++ {
-		offsets = append(offsets, int64(i)*chunkSize)
+	n := requested
+	if n == 0 {
+		n = runtime.NumCPU()
+	}
+	if maxProcs > 0 && n > maxProcs {
+		n = maxProcs
 	}
+	if n > maxWorkers {
+		logf("clamping %d workers to %d\n", n, maxWorkers)
+		n = maxWorkers
+	}
+	return n, nil
+}
 
-	offsets = append(offsets, fileSize)
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+}
 
-	bitmaps := make([][]uint64, numWorkers)
-	var g errgroup.Group
+// countFlags holds the flags of a count, and what validate derives from
+// them.
+type countFlags struct {
+	fileName, format, output                  string
+	workers, mergeWorkers, maxProcs           int
+	directIO, mmap, autoIO, preload, prealloc bool
+	spillDir, cacheDir                        string
+	trim, ipv6, weighted                      bool
+	field                                     int
+	delimiter, inputFormat, pcap, extract     string
+	mode                                      string
+	hllPrecision                              int
+	segmentSize, mask, spotCheckFraction      string
+	showInvalid                               int
+	recordInvalid                             string
+	sandbox                                   bool
+	hashName, decryptKey, countOccurrences    string
+	topN                                      int
+	summaryPath, verifySummary, emitUnique    string
+	byPrefix                                  int
+	byPrefixOutput, geoIPOutput, saveState    string
+	geoIPDBs, mergeStates                     pathList
+	inputs                                    labeledInputs
+	includeCIDR, excludeCIDR                  prefixList
+	layout                                    ipcounter.Layout
+	nice                                      int
+	ionice                                    string
+	progress                                  time.Duration
+	background                                bool
+	units                                     string
+
+	// files are the inputs given as arguments or with -input.
+	files []string
+	// multiple is set when the inputs are counted separately and together.
+	multiple bool
+	// stateOnly is set when -merge-state merges the saved sets on their
+	// own, with no input at all.
+	stateOnly bool
+	// prefixLen is the -mask prefix length, 32 without it.
+	prefixLen int
+}
 
-	for i := 0; i < numWorkers; i++ {
-		i := i
-		g.Go(func() error {
-			bitmap, err := processChunk(fileName, offsets[i], offsets[i+1])
-			if err != nil {
-				return fmt.Errorf("worker %d failed: %v", i, err)
-			}
+// countSetup is what buildOptions prepares for a count: its options and
+// the parsed flag values and opened resources the report needs.
+type countSetup struct {
+	opts         []ipcounter.Option
+	segmentBytes int64
+	spotFraction float64
+	expected     *ipcounter.SetSummary
+	geoIP        *ipcounter.GeoIP
+	saved        *ipcounter.State
+}
 
-			bitmaps[i] = bitmap
-			return nil
-		})
+// countOutputs are the files a count writes its results to, opened before
+// the scan so that -sandbox can still be honored and so that a bad path
+// fails fast rather than after hours of work. Those left nil are not
+// written.
+type countOutputs struct {
+	out, frequencies, summary, unique, byPrefix, geoIP, state *os.File
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "merge" {
+		runMerge(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		runSelfTest(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		runQuery(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		runProfile(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && setOperations[os.Args[1]] != "" {
+		runSetOperation(os.Args[1], os.Args[2:])
+		return
+	}
+
+	f := parseFlags()
+	f.validate()
+	f.applyPriority()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setup := buildOptions(ctx, f)
+	if setup.geoIP != nil {
+		defer setup.geoIP.Close()
+	}
+	outs := openOutputs(f)
+	defer outs.close()
 
-	if err := g.Wait(); err != nil {
-		log.Fatalf("processing failed: %v", err)
+	start := time.Now()
+	result, multi := count(ctx, f, setup)
+	report(f, setup, result, outs)
+	summaryMatches := writeOutputs(f, setup, result, outs)
+	reportTotals(f, result, multi, time.Since(start))
+	switch {
+	case result.Partial:
+		os.Exit(130)
+	case !summaryMatches:
+		os.Exit(1)
 	}
+}
 
-	finalBitmap := mergeBitmaps(bitmaps, len(bitmaps[0]))
+// parseFlags defines the flags of a count, parses the command line and
+// expands the input arguments.
+func parseFlags() *countFlags {
+	f := &countFlags{}
+	flag.StringVar(&f.fileName, "file", "ip_addresses", "input to count: a file, \"-\" for stdin, or an http(s):// or s3:// URL (see README.md)")
+	flag.IntVar(&f.workers, "workers", 0, fmt.Sprintf("number of scan workers; 0 uses one per CPU (at most %d)", maxWorkers))
+	flag.BoolVar(&quiet, "quiet", false, "log nothing but errors; the result is printed to stdout unless -output is set")
+	flag.StringVar(&f.format, "format", "text", "result format on stdout: text, or json or csv with the counts, lines, invalid lines, elapsed time and throughput; logs stay on stderr")
+	flag.StringVar(&f.output, "output", "", "also write the unique count to this file (\"-\" for stdout)")
+	flag.BoolVar(&f.directIO, "direct-io", false, "read input with O_DIRECT, bypassing the page cache (Linux only)")
+	flag.BoolVar(&f.mmap, "mmap", false, "scan the input from a memory mapping instead of read buffers, falling back to reads if it cannot be mapped (Linux only)")
+	flag.BoolVar(&f.autoIO, "auto-io", false, "choose buffered reads, -mmap or -direct-io for each input from its size, storage type (rotational or not) and available memory, and log the choice")
+	flag.BoolVar(&f.preload, "preload", false, "read the input into the page cache before counting when it fits and is not cached yet, to speed up repeated runs over the same data (Linux only)")
+	flag.BoolVar(&f.prealloc, "prealloc", false, "allocate and touch all dense bitmap memory before reading the input, so that a host short of memory fails at the start instead of hours in")
+	flag.StringVar(&f.spillDir, "spill-dir", os.TempDir(), "directory for chunk bitmaps spilled to disk when memory is short, and for the partitions of -mode external")
+	flag.StringVar(&f.cacheDir, "cache-dir", "", "keep each chunk's counted set in this directory and reuse it when the same chunk is counted again with the same parsing options; re-runs then only read and hash the input")
+	flag.BoolVar(&f.trim, "trim", false, "also strip surrounding quotes, no-break spaces and byte order marks from each line before parsing")
+	flag.BoolVar(&f.ipv6, "ipv6", false, "also count IPv6 addresses, in a hash set, and report them separately")
+	flag.BoolVar(&f.weighted, "weighted", false, "read \"ip,count\" lines of pre-aggregated input; rows with count 0 are ignored")
+	flag.IntVar(&f.field, "field", 0, "take the address from this field (counted from 1) of lines split at -delimiter, e.g. a column of a CSV file")
+	flag.StringVar(&f.delimiter, "delimiter", ",", "field delimiter for -field: a single character, tab, or space for runs of whitespace")
+	flag.StringVar(&f.inputFormat, "input-format", "text", "input encoding: text (an address per line) or binary4 (packed 4-byte big-endian IPv4 addresses)")
+	flag.StringVar(&f.pcap, "pcap", "", "read the inputs as pcap or pcapng packet captures and count the addresses of their IP packets: src, dst or both")
+	flag.StringVar(&f.extract, "extract", "", "take the address from raw log lines: a preset ("+strings.Join(ipcounter.ExtractPresets(), ", ")+") or regex:PATTERN, using the submatch named ip, else the first submatch, else the whole match")
+	flag.StringVar(&f.mode, "mode", "exact", "counting mode: exact (512 MiB bitmap per worker), roaring (exact, compressed bitmaps for inputs with few distinct addresses), hll (HyperLogLog estimate in a few KiB per worker) or external (exact, partitioned on disk in -spill-dir, in a few MiB of memory)")
+	flag.IntVar(&f.hllPrecision, "hll-precision", 14, fmt.Sprintf("HyperLogLog precision with -mode hll, %d to %d; each step up halves the error and doubles the memory", ipcounter.MinHLLPrecision, ipcounter.MaxHLLPrecision))
+	flag.IntVar(&f.mergeWorkers, "merge-workers", runtime.NumCPU(), "goroutines merging and counting the worker bitmaps")
+	flag.StringVar(&f.segmentSize, "segment-report", "", "report estimated unique addresses per input segment of this size, e.g. 1GiB")
+	flag.StringVar(&f.mask, "mask", "", "count unique networks of this prefix length (e.g. /24) instead of unique addresses")
+	flag.StringVar(&f.spotCheckFraction, "spot-check", "", "re-parse this fraction of the input (e.g. 0.1%) with a reference parser and check that its addresses are in the result; this catches missed addresses, not extra ones")
+	flag.IntVar(&f.showInvalid, "show-invalid", 0, "log the first N lines that fail to parse, with their byte offsets")
+	flag.StringVar(&f.recordInvalid, "record-invalid", "", "write the raw bytes and offsets of lines that fail to parse to this file")
+	flag.BoolVar(&f.sandbox, "sandbox", false, "drop filesystem and network access once the input is open (Linux only; needs a build without cgo, e.g. CGO_ENABLED=0)")
+	flag.StringVar(&f.hashName, "hash", "", "hash the input while counting (sha256)")
+	flag.StringVar(&f.decryptKey, "decrypt-key", "", "age identity file (as written by age-keygen) to decrypt age-encrypted inputs with as they are read, without writing plaintext to disk")
+	flag.StringVar(&f.countOccurrences, "count-occurrences", "", "also count how often each IPv4 address (or -mask network) occurs and write \"ip,count\" lines in address order to this file; needs memory per distinct address")
+	flag.IntVar(&f.topN, "top", 0, "report the N most frequent IPv4 addresses (or -mask networks) with their counts; exact up to about a million distinct addresses in total, count-min sketch estimates beyond")
+	flag.StringVar(&f.summaryPath, "summary", "", "write an audit summary of the counted IPv4 set (per-/16 counts and a checksum) to this file")
+	flag.StringVar(&f.verifySummary, "verify-summary", "", "compare the counted IPv4 set with a summary written by -summary, listing the /16s that differ; exits with status 1 on a mismatch")
+	flag.StringVar(&f.emitUnique, "emit-unique", "", "write the unique IPv4 addresses (or -mask networks), then the IPv6 ones, in ascending order to this file, gzip-compressed if it ends in .gz")
+	flag.IntVar(&f.byPrefix, "by-prefix", 0, "also report the unique IPv4 addresses (or -mask networks) in each observed network of this prefix length, e.g. 24, as \"prefix,unique\" CSV to -by-prefix-output")
+	flag.StringVar(&f.byPrefixOutput, "by-prefix-output", "-", "file for the -by-prefix report (\"-\" for stdout, which -quiet and -output - leave to the count)")
+	flag.Var(&f.geoIPDBs, "geoip-db", "MaxMind DB files, such as GeoLite2 Country and ASN, to report the unique addresses per country and per autonomous system by, after the count (comma-separated, repeatable)")
+	flag.StringVar(&f.geoIPOutput, "geoip-output", "", "write the complete -geoip-db counts as \"table,key,name,unique\" CSV to this file")
+	flag.StringVar(&f.saveState, "save-state", "", "write the counted set, zstd-compressed, to this file, to be merged into later runs with -merge-state")
+	flag.Var(&f.mergeStates, "merge-state", "merge sets saved by -save-state (comma-separated paths or globs, repeatable) into this run's, so that the counts cover their inputs too; with no input given, only the saved sets are merged")
+	flag.Var(&f.inputs, "input", "count this input under a label, as path=label (path may be a glob; repeatable), and report per-label unique counts and the overlap of every pair of labels")
+	flag.Var(&f.includeCIDR, "include-cidr", "count only addresses inside these prefixes, e.g. 203.0.113.0/24 (comma-separated, repeatable)")
+	flag.Var(&f.excludeCIDR, "exclude-cidr", "leave out addresses inside these prefixes, e.g. 10.0.0.0/8,192.168.0.0/16 (comma-separated, repeatable)")
+	flag.Var(&f.layout, "bitmap-layout", "bit index mapping: linear or rotated (experimental)")
+	flag.IntVar(&f.maxProcs, "max-procs", 0, "limit the number of CPUs used (GOMAXPROCS); 0 uses all")
+	flag.IntVar(&f.nice, "nice", 0, "run with this niceness (Linux only)")
+	flag.StringVar(&f.ionice, "ionice", "", "I/O priority: idle, best-effort[:0-7] or realtime[:0-7] (Linux only)")
+	flag.DurationVar(&f.progress, "progress", 0, "log progress (percentage, throughput, ETA, bytes per worker) at this interval, e.g. 5s; off with -quiet")
+	flag.BoolVar(&f.background, "background", false, "pause the scan while the host is under memory or I/O pressure (Linux only); combine with -nice and -ionice idle")
+	flag.StringVar(&numFmt.thousandsSep, "thousands-sep", "", "separator between digit groups in reported numbers, e.g. \",\"")
+	flag.StringVar(&f.units, "units", "iec", "units for byte sizes: iec (KiB, MiB) or si (kB, MB)")
+	flag.IntVar(&numFmt.decimals, "decimals", 1, "decimal places for reported sizes and rates")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		files, err := expandInputs(flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.files, f.fileName = files, files[0]
+	}
+	if len(f.inputs) > 0 {
+		if flag.NArg() > 0 {
+			log.Fatalf("-input cannot be combined with file arguments")
+		}
+		for _, in := range f.inputs {
+			f.files = append(f.files, in.Path)
+		}
+	}
+	f.multiple = len(f.files) > 1 || len(f.inputs) > 0
+	fileGiven := false
+	flag.Visit(func(fl *flag.Flag) { fileGiven = fileGiven || fl.Name == "file" })
+	// With no input at all, -merge-state merges the saved sets on their own.
+	f.stateOnly = len(f.mergeStates) > 0 && len(f.files) == 0 && !fileGiven
+	return f
+}
+
+// validate rejects invalid flag values and combinations, before anything
+// is opened or counted.
+func (f *countFlags) validate() {
+	var err error
+	if f.sandbox && f.cacheDir != "" {
+		log.Fatalf("-sandbox drops filesystem access, which -cache-dir needs")
+	}
+	if f.sandbox && (ipcounter.IsRemote(f.fileName) || slices.ContainsFunc(f.files, ipcounter.IsRemote)) {
+		log.Fatalf("-sandbox drops network access, which a remote input needs")
+	}
+	if f.sandbox {
+		if err := checkSandbox(); err != nil {
+			log.Fatalf("-sandbox cannot be used: %v", err)
+		}
+	}
+	if f.stateOnly && (f.countOccurrences != "" || f.topN > 0 || f.spotCheckFraction != "") {
+		log.Fatalf("-count-occurrences, -top and -spot-check need an input to count, not only -merge-state")
+	}
+	if f.multiple {
+		switch {
+		case f.recordInvalid != "":
+			log.Fatalf("-record-invalid takes a single input file")
+		case f.sandbox:
+			log.Fatalf("-sandbox takes a single input file")
+		}
+	}
+	if numFmt.siUnits, err = parseUnits(f.units); err != nil {
+		log.Fatalf("invalid -units: %v", err)
+	}
+	if numFmt.decimals < 0 {
+		log.Fatalf("-decimals must not be negative")
+	}
 
-	totalUniqueIPs := 0
-	for _, word := range finalBitmap {
-		totalUniqueIPs += bits.OnesCount64(word)
+	switch f.format {
+	case "text":
+	case "json", "csv":
+		if f.output == "-" {
+			log.Fatalf("-output - cannot be combined with -format %s, which already writes to stdout", f.format)
+		}
+	default:
+		log.Fatalf("invalid -format %q: want text, json or csv", f.format)
+	}
+	if f.mergeWorkers < 1 {
+		log.Fatalf("-merge-workers must be at least 1")
+	}
+	if f.maxProcs < 0 {
+		log.Fatalf("-max-procs must not be negative")
+	}
+	if f.progress < 0 {
+		log.Fatalf("-progress must not be negative")
+	}
+	if f.topN < 0 {
+		log.Fatalf("-top must not be negative")
 	}
 
-	log.Printf("total unique IP addresses: %d\n", totalUniqueIPs)
+	switch f.mode {
+	case "exact", "roaring":
+	case "hll":
+		if f.hllPrecision < ipcounter.MinHLLPrecision || f.hllPrecision > ipcounter.MaxHLLPrecision {
+			log.Fatalf("invalid -hll-precision %d: want %d to %d", f.hllPrecision, ipcounter.MinHLLPrecision, ipcounter.MaxHLLPrecision)
+		}
+		switch {
+		case f.summaryPath != "" || f.verifySummary != "":
+			log.Fatalf("-summary and -verify-summary need an exact count, not -mode hll")
+		case f.emitUnique != "":
+			log.Fatalf("-emit-unique needs an exact count, not -mode hll")
+		case f.byPrefix != 0:
+			log.Fatalf("-by-prefix needs an exact count, not -mode hll")
+		case len(f.geoIPDBs) > 0:
+			log.Fatalf("-geoip-db needs an exact count, not -mode hll")
+		}
+	case "external":
+		switch {
+		case f.multiple:
+			log.Fatalf("-mode external counts a single input")
+		case f.saveState != "" || len(f.mergeStates) > 0 || f.emitUnique != "" || f.byPrefix != 0 || len(f.geoIPDBs) > 0:
+			log.Fatalf("-save-state, -merge-state, -emit-unique, -by-prefix and -geoip-db need the counted set, which -mode external does not keep")
+		case f.summaryPath != "" || f.verifySummary != "" || f.spotCheckFraction != "":
+			log.Fatalf("-summary, -verify-summary and -spot-check need the counted set, which -mode external does not keep")
+		}
+	default:
+		log.Fatalf("invalid -mode %q: want exact, roaring, hll or external", f.mode)
+	}
 
-	totalElapsed := time.Since(start)
-	log.Printf("total time elapsed: %v\n", totalElapsed)
+	f.prefixLen = 32
+	if f.mask != "" {
+		if f.prefixLen, err = strconv.Atoi(strings.TrimPrefix(f.mask, "/")); err != nil || f.prefixLen < 0 || f.prefixLen > 32 {
+			log.Fatalf("invalid -mask %q: want a prefix length between /0 and /32", f.mask)
+		}
+	}
+	if f.byPrefix != 0 {
+		switch {
+		case f.byPrefix < 0 || f.byPrefix > f.prefixLen:
+			log.Fatalf("invalid -by-prefix %d: want a prefix length between 1 and %d", f.byPrefix, f.prefixLen)
+		case f.byPrefixOutput == "-" && f.format != "text":
+			log.Fatalf("-by-prefix-output - cannot be combined with -format %s, which already writes to stdout", f.format)
+		case f.byPrefixOutput == "-" && (f.output == "-" || f.output == "" && quiet):
+			log.Fatalf("-by-prefix-output - cannot be combined with -quiet or -output -, which write the count to stdout; give -by-prefix-output a file")
+		}
+	}
+	if f.geoIPOutput != "" && len(f.geoIPDBs) == 0 {
+		log.Fatalf("-geoip-output needs -geoip-db")
+	}
 }
 
-func processChunk(fileName string, startOffset, endOffset int64) ([]uint64, error) {
-	file, err := os.Open(fileName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
+// applyPriority applies -max-procs, -nice and -ionice to the process.
+func (f *countFlags) applyPriority() {
+	if f.maxProcs > 0 {
+		runtime.GOMAXPROCS(f.maxProcs)
+	}
+	if f.nice != 0 {
+		if err := setNice(f.nice); err != nil {
+			log.Fatalf("failed to set niceness: %v", err)
+		}
+	}
+	if f.ionice != "" {
+		class, err := parseIOClass(f.ionice)
+		if err != nil {
+			log.Fatalf("invalid -ionice: %v", err)
+		}
+		if err := setIONice(class); err != nil {
+			log.Fatalf("failed to set I/O priority: %v", err)
+		}
 	}
-	defer file.Close()
+}
 
-	_, err = file.Seek(startOffset, io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("failed to seek in file: %v", err)
+// buildOptions turns the flags into the options of the count, reading the
+// files they name: the -geoip-db databases, the -merge-state sets, the
+// -verify-summary summary and the -decrypt-key identities. -merge-state on
+// its own takes -mask and -hll-precision from the saved sets.
+func buildOptions(ctx context.Context, f *countFlags) *countSetup {
+	var err error
+	s := &countSetup{}
+	s.opts = []ipcounter.Option{
+		ipcounter.WithDirectIO(f.directIO),
+		ipcounter.WithMmap(f.mmap),
+		ipcounter.WithAutoIO(f.autoIO),
+		ipcounter.WithPreload(f.preload),
+		ipcounter.WithPrealloc(f.prealloc),
+		ipcounter.WithSpillDir(f.spillDir),
+		ipcounter.WithTrim(f.trim),
+		ipcounter.WithWeights(f.weighted),
+		ipcounter.WithIPv6(f.ipv6),
+		ipcounter.WithMergeWorkers(f.mergeWorkers),
+		ipcounter.WithLayout(f.layout),
+		ipcounter.WithLogf(logf),
+		ipcounter.WithBytesFormat(formatBytes),
+	}
+	if f.field != 0 {
+		delim, err := parseDelimiter(f.delimiter)
+		if err != nil {
+			log.Fatalf("invalid -delimiter: %v", err)
+		}
+		s.opts = append(s.opts, ipcounter.WithField(delim, f.field))
+	}
+	if f.extract != "" {
+		re, err := parseExtract(f.extract)
+		if err != nil {
+			log.Fatalf("invalid -extract: %v", err)
+		}
+		s.opts = append(s.opts, ipcounter.WithExtract(re))
+	}
+	switch f.inputFormat {
+	case "text":
+	case "binary4":
+		s.opts = append(s.opts, ipcounter.WithInputFormat(ipcounter.InputBinary4))
+	default:
+		log.Fatalf("invalid -input-format %q: want text or binary4", f.inputFormat)
+	}
+	switch f.pcap {
+	case "":
+	case "src":
+		s.opts = append(s.opts, ipcounter.WithPcap(ipcounter.PcapSource))
+	case "dst":
+		s.opts = append(s.opts, ipcounter.WithPcap(ipcounter.PcapDestination))
+	case "both":
+		s.opts = append(s.opts, ipcounter.WithPcap(ipcounter.PcapSource|ipcounter.PcapDestination))
+	default:
+		log.Fatalf("invalid -pcap %q: want src, dst or both", f.pcap)
 	}
 
-	reader := bufio.NewReader(file)
+	switch f.mode {
+	case "roaring":
+		s.opts = append(s.opts, ipcounter.WithRoaring(true))
+	case "hll":
+		s.opts = append(s.opts, ipcounter.WithHyperLogLog(f.hllPrecision))
+	case "external":
+		s.opts = append(s.opts, ipcounter.WithExternalSort(true))
+	}
 
-	if startOffset != 0 {
-		_, err = readLine(reader)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to discard partial line: %v", err)
+	if f.segmentSize != "" {
+		s.segmentBytes, err = parseSize(f.segmentSize)
+		if err != nil || s.segmentBytes == 0 {
+			log.Fatalf("invalid -segment-report: %q", f.segmentSize)
 		}
+		s.opts = append(s.opts, ipcounter.WithSegmentSize(s.segmentBytes))
+	}
+	if f.mask != "" {
+		s.opts = append(s.opts, ipcounter.WithMask(f.prefixLen))
+	}
+	if len(f.includeCIDR) > 0 {
+		s.opts = append(s.opts, ipcounter.WithIncludeCIDR(f.includeCIDR...))
+	}
+	if len(f.excludeCIDR) > 0 {
+		s.opts = append(s.opts, ipcounter.WithExcludeCIDR(f.excludeCIDR...))
 	}
 
-	const bitmapSize = 1 << 32
-	const uint64Size = 64
-	const arraySize = bitmapSize / uint64Size
-	bitmap := make([]uint64, arraySize)
+	if f.spotCheckFraction != "" {
+		if s.spotFraction, err = parseFraction(f.spotCheckFraction); err != nil {
+			log.Fatalf("invalid -spot-check: %v", err)
+		}
+		s.opts = append(s.opts, ipcounter.WithSpotCheck(s.spotFraction))
+	}
 
-	currentOffset := startOffset
+	if f.hashName != "" {
+		newHash := hashAlgorithms[f.hashName]
+		if newHash == nil {
+			log.Fatalf("unsupported hash algorithm: %s", f.hashName)
+		}
+		s.opts = append(s.opts, ipcounter.WithHash(newHash))
+	}
 
-	for currentOffset < endOffset {
-		line, err := readLine(reader)
-		if err == io.EOF {
-			break
+	if f.cacheDir != "" {
+		if err := os.MkdirAll(f.cacheDir, 0o755); err != nil {
+			log.Fatalf("failed to create -cache-dir: %v", err)
 		}
+		s.opts = append(s.opts, ipcounter.WithChunkCache(f.cacheDir))
+	}
+
+	if f.showInvalid != 0 {
+		s.opts = append(s.opts, ipcounter.WithInvalidSamples(f.showInvalid))
+	}
+
+	if f.decryptKey != "" {
+		identities, err := readIdentities(f.decryptKey)
 		if err != nil {
-			return nil, fmt.Errorf("error reading line: %v", err)
+			log.Fatalf("failed to read -decrypt-key: %v", err)
+		}
+		s.opts = append(s.opts, ipcounter.WithDecryption(identities...))
+	}
+
+	if f.progress > 0 && !quiet {
+		s.opts = append(s.opts, ipcounter.WithProgress(f.progress, reportProgress))
+	}
+
+	if f.recordInvalid != "" {
+		s.opts = append(s.opts, ipcounter.WithInvalidRecording(f.recordInvalid))
+	}
+
+	if f.countOccurrences != "" {
+		s.opts = append(s.opts, ipcounter.WithFrequencies(true))
+	}
+	if f.topN > 0 {
+		s.opts = append(s.opts, ipcounter.WithTopN(f.topN))
+	}
+
+	if f.summaryPath != "" || f.verifySummary != "" {
+		s.opts = append(s.opts, ipcounter.WithSummary(true))
+	}
+	if f.verifySummary != "" {
+		if s.expected, err = readSummary(f.verifySummary); err != nil {
+			log.Fatalf("failed to read -verify-summary: %v", err)
 		}
-		currentOffset += int64(len(line)) + 1
+	}
 
-		ipUint32, err := parseIPv4(line)
+	if len(f.geoIPDBs) > 0 {
+		// Opened before the scan, like the outputs, so -sandbox can be honored.
+		if s.geoIP, err = ipcounter.OpenGeoIP(f.geoIPDBs...); err != nil {
+			log.Fatalf("failed to open -geoip-db: %v", err)
+		}
+	}
+	if f.saveState != "" || f.emitUnique != "" || f.byPrefix != 0 || s.geoIP != nil || len(f.mergeStates) > 0 {
+		s.opts = append(s.opts, ipcounter.WithState(true))
+	}
+	if len(f.mergeStates) > 0 {
+		s.saved = readMergeStates(f, s.geoIP != nil)
+	}
+
+	numWorkers, err := workerCount(f.workers, f.maxProcs)
+	if err != nil {
+		log.Fatalf("invalid -workers: %v", err)
+	}
+	if f.fileName != "-" && !f.stateOnly {
+		logf("using %d workers\n", numWorkers)
+	}
+	s.opts = append(s.opts, ipcounter.WithWorkers(numWorkers))
+
+	if f.background {
+		// Opened before the scan so it keeps working under -sandbox.
+		src, err := openPressureSource()
 		if err != nil {
-			continue
+			log.Fatalf("invalid -background: %v", err)
 		}
+		monitor := newPressureMonitor(src)
+		go monitor.run(ctx)
+		s.opts = append(s.opts, ipcounter.WithThrottle(monitor.wait))
+	}
 
-		idx := ipUint32 / uint32(uint64Size)
-		pos := ipUint32 % uint32(uint64Size)
-		bitmap[idx] |= 1 << pos
+	if f.sandbox {
+		s.opts = append(s.opts, ipcounter.WithBeforeScan(func() error {
+			if err := enterSandbox(); err != nil {
+				return fmt.Errorf("failed to enter sandbox: %v", err)
+			}
+			logf("sandbox enabled: filesystem and network access dropped\n")
+			return nil
+		}))
 	}
 
-	return bitmap, nil
+	// The first SIGINT or SIGTERM stops the scan and reports what was
+	// counted; a second one quits at once.
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("interrupted: stopping the scan to report a partial count; interrupt again to quit at once")
+		close(stop)
+		<-signals
+		log.Printf("interrupted again, quitting")
+		os.Exit(130)
+	}()
+	s.opts = append(s.opts, ipcounter.WithStop(stop))
+	return s
 }
 
-func readLine(reader *bufio.Reader) ([]byte, error) {
-	line, isPrefix, err := reader.ReadLine()
+// readMergeStates reads the -merge-state sets and checks that they can be
+// merged into this run's count. With no input, -mask and -hll-precision
+// are taken from them.
+func readMergeStates(f *countFlags, geoIP bool) *ipcounter.State {
+	saved, err := readStates(f.mergeStates)
 	if err != nil {
-		return nil, err
+		log.Fatalf("failed to read -merge-state: %v", err)
 	}
-	if isPrefix {
-		return nil, fmt.Errorf("line too long")
+	switch {
+	case f.stateOnly && saved.Approximate():
+		f.hllPrecision = saved.Precision()
+	case saved.Approximate() != (f.mode == "hll"):
+		log.Fatalf("-merge-state: the saved sets are %s, but this run counts with -mode %s", stateKind(saved), f.mode)
+	case saved.Approximate() && saved.Precision() != f.hllPrecision:
+		log.Fatalf("-merge-state: the saved sketches have precision %d but this run uses -hll-precision %d", saved.Precision(), f.hllPrecision)
 	}
-	return line, nil
+	if f.stateOnly && saved.Approximate() && (f.summaryPath != "" || f.verifySummary != "") {
+		log.Fatalf("-summary and -verify-summary need exact sets, but the saved sets are HyperLogLog sketches")
+	}
+	if f.stateOnly && saved.Approximate() && (f.emitUnique != "" || f.byPrefix != 0 || geoIP) {
+		log.Fatalf("-emit-unique, -by-prefix and -geoip-db need exact sets, but the saved sets are HyperLogLog sketches")
+	}
+	switch {
+	case f.stateOnly && f.mask == "" && saved.PrefixLen() < 32:
+		f.mask = "/" + strconv.Itoa(saved.PrefixLen())
+	case saved.PrefixLen() != f.prefixLen && !(f.stateOnly && f.mask == ""):
+		log.Fatalf("-merge-state: the saved sets hold /%d keys but this run counts /%d keys; use the same -mask", saved.PrefixLen(), f.prefixLen)
+	}
+	return saved
 }
 
-func mergeBitmaps(bitmaps [][]uint64, bitmapSize int) []uint64 {
-	finalBitmap := make([]uint64, bitmapSize)
-	numWorkers := len(bitmaps)
+// openOutputs creates the output files the flags name.
+func openOutputs(f *countFlags) *countOutputs {
+	o := &countOutputs{}
+	create := func(path, what string) *os.File {
+		file, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("failed to create %s: %v", what, err)
+		}
+		return file
+	}
+	switch f.output {
+	case "":
+		if quiet && f.format == "text" {
+			o.out = os.Stdout
+		}
+	case "-":
+		o.out = os.Stdout
+	default:
+		o.out = create(f.output, "output file")
+	}
+	if f.countOccurrences != "" {
+		o.frequencies = create(f.countOccurrences, "occurrences file")
+	}
+	if f.summaryPath != "" {
+		o.summary = create(f.summaryPath, "summary file")
+	}
+	if f.emitUnique != "" {
+		o.unique = create(f.emitUnique, "-emit-unique file")
+	}
+	if f.byPrefix != 0 {
+		if f.byPrefixOutput == "-" {
+			o.byPrefix = os.Stdout
+		} else {
+			o.byPrefix = create(f.byPrefixOutput, "-by-prefix-output file")
+		}
+	}
+	if f.geoIPOutput != "" {
+		o.geoIP = create(f.geoIPOutput, "-geoip-output file")
+	}
+	if f.saveState != "" {
+		o.state = create(f.saveState, "state file")
+	}
+	return o
+}
 
-	for i := 0; i < bitmapSize; i++ {
-		var word uint64
-		for j := 0; j < numWorkers; j++ {
-			word |= bitmaps[j][i]
+// close closes the output files that are still open.
+func (o *countOutputs) close() {
+	for _, file := range []*os.File{o.out, o.frequencies, o.summary, o.unique, o.byPrefix, o.geoIP, o.state} {
+		if file != nil && file != os.Stdout {
+			file.Close()
 		}
-		finalBitmap[i] = word
 	}
+}
 
-	return finalBitmap
+// count runs the count the flags describe and merges the -merge-state sets
+// into its result. The per-file results of several inputs are reported as
+// they are counted, and returned with the total.
+func count(ctx context.Context, f *countFlags, s *countSetup) (*ipcounter.Result, *ipcounter.MultiResult) {
+	counter := ipcounter.New(s.opts...)
+	var result *ipcounter.Result
+	var multi *ipcounter.MultiResult
+	var err error
+	switch {
+	case f.stateOnly:
+		result = &ipcounter.Result{}
+	case len(f.inputs) > 0:
+		var labeled *ipcounter.LabeledResult
+		if labeled, err = counter.RunLabeled(ctx, f.inputs); err == nil {
+			multi = &labeled.MultiResult
+			reportFiles(f.files, multi, f.hashName, s.segmentBytes)
+			reportLabels(labeled.Labels)
+			result = multi.Total
+		}
+	case f.multiple:
+		if multi, err = counter.RunFiles(ctx, f.files); err == nil {
+			reportFiles(f.files, multi, f.hashName, s.segmentBytes)
+			result = multi.Total
+		}
+	case f.fileName == "-":
+		result, err = counter.RunReader(ctx, os.Stdin)
+	default:
+		result, err = counter.Run(ctx, f.fileName)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.saved != nil {
+		if result.State == nil {
+			result.State = s.saved
+		} else if err := result.State.Merge(s.saved); err != nil {
+			log.Fatalf("failed to merge -merge-state: %v", err)
+		}
+		logf("merged the saved sets of %s\n", strings.Join(f.mergeStates, ", "))
+		result.Unique, result.UniqueIPv6 = result.State.Unique(), result.State.UniqueIPv6()
+		result.Approximate = result.State.Approximate()
+		if f.summaryPath != "" || f.verifySummary != "" {
+			result.Summary = result.State.Summary()
+		}
+	}
+	return result, multi
 }
 
-func parseIPv4(ipStr []byte) (uint32, error) {
-	var ip uint32
-	var octet uint32
-	var shift uint
-	parts := 0
+// report logs the counts and what was found along the way, and writes the
+// unique count to -output.
+func report(f *countFlags, s *countSetup, result *ipcounter.Result, outs *countOutputs) {
+	if result.Partial {
+		log.Printf("PARTIAL RESULT: the count was interrupted and covers only %s of the input\n", formatBytes(uint64(result.Covered)))
+	}
+	switch {
+	case f.mask != "":
+		logf("total unique /%s networks: %s\n", strings.TrimPrefix(f.mask, "/"), formatCount(result.Unique))
+	case f.ipv6:
+		logf("total unique IPv4 addresses: %s\n", formatCount(result.Unique))
+	default:
+		logf("total unique IP addresses: %s\n", formatCount(result.Unique))
+	}
+	if f.ipv6 {
+		logf("total unique IPv6 addresses: %s\n", formatCount(result.UniqueIPv6))
+	}
+	if result.Approximate {
+		logf("unique counts are HyperLogLog estimates, standard error about %.2f%%\n",
+			104/math.Sqrt(float64(uint64(1)<<f.hllPrecision)))
+	}
+	if outs.out != nil {
+		if _, err := fmt.Fprintln(outs.out, result.Unique+result.UniqueIPv6); err != nil {
+			log.Fatalf("failed to write output: %v", err)
+		}
+	}
+	if f.weighted {
+		logf("total occurrences: %s\n", formatCount(result.Occurrences))
+	}
+	if len(f.includeCIDR) > 0 || len(f.excludeCIDR) > 0 {
+		logf("lines left out by the CIDR filters: %s\n", formatCount(result.Filtered))
+	}
+	reportInvalid(result.Invalid)
+	reportInvalidSamples(result.InvalidSamples)
+	if f.topN > 0 {
+		reportTop(result.Top, result.TopApproximate, strings.TrimPrefix(f.mask, "/"))
+	}
+	if result.Segments != nil {
+		reportSegments(s.segmentBytes, result.Segments)
+	}
+	if s.spotFraction > 0 && !f.multiple {
+		switch {
+		case result.SpotCheck != nil:
+			reportSpotCheck(result.SpotCheck)
+		case f.fileName == "-":
+			logf("spot check skipped: a stream cannot be read again\n")
+		case f.pcap != "":
+			logf("spot check skipped: packet captures are counted as a stream\n")
+		case result.Approximate:
+			logf("spot check skipped: -mode hll builds no bitmap to check against\n")
+		default:
+			logf("spot check skipped: the sorted-input path builds no bitmap to check against\n")
+		}
+	}
+	if result.Digest != nil {
+		logf("%s tree hash over %s pieces: %x\n",
+			f.hashName, formatBytes(ipcounter.HashPieceSize), result.Digest)
+	}
+}
 
-	for i := 0; i < len(ipStr); i++ {
-		c := ipStr[i]
-		if c >= '0' && c <= '9' {
-			octet = octet*10 + uint32(c-'0')
-			if octet > 255 {
-				return 0, fmt.Errorf("invalid octet value")
+// writeOutputs writes the result to the output files, reports the
+// -geoip-db counts and compares the set with -verify-summary, returning
+// whether it matches.
+func writeOutputs(f *countFlags, s *countSetup, result *ipcounter.Result, outs *countOutputs) bool {
+	if outs.frequencies != nil {
+		if err := writeFrequencies(outs.frequencies, result.Frequencies, strings.TrimPrefix(f.mask, "/")); err != nil {
+			log.Fatalf("failed to write occurrences: %v", err)
+		}
+		if err := outs.frequencies.Close(); err != nil {
+			log.Fatalf("failed to write occurrences: %v", err)
+		}
+		logf("occurrences of %s addresses written to %s\n", formatCount(len(result.Frequencies)), f.countOccurrences)
+	}
+	if outs.summary != nil {
+		if _, err := result.Summary.WriteTo(outs.summary); err != nil {
+			log.Fatalf("failed to write summary: %v", err)
+		}
+		if err := outs.summary.Close(); err != nil {
+			log.Fatalf("failed to write summary: %v", err)
+		}
+		logf("summary written to %s\n", f.summaryPath)
+	}
+	if outs.state != nil {
+		n, err := result.State.WriteTo(outs.state)
+		if err == nil {
+			err = outs.state.Close()
+		}
+		if err != nil {
+			log.Fatalf("failed to write state: %v", err)
+		}
+		logf("state written to %s (%s)\n", f.saveState, formatBytes(uint64(n)))
+	}
+	if outs.unique != nil {
+		n, err := writeUnique(outs.unique, result.State, strings.HasSuffix(f.emitUnique, ".gz"))
+		if err != nil {
+			log.Fatalf("failed to write -emit-unique: %v", err)
+		}
+		logf("%s unique addresses written to %s\n", formatCount(n), f.emitUnique)
+	}
+	if outs.byPrefix != nil {
+		counts, err := result.State.CountByPrefix(f.byPrefix)
+		if err == nil {
+			err = writePrefixCounts(outs.byPrefix, counts)
+		}
+		if err == nil && outs.byPrefix != os.Stdout {
+			err = outs.byPrefix.Close()
+		}
+		if err != nil {
+			log.Fatalf("failed to write -by-prefix report: %v", err)
+		}
+		if outs.byPrefix != os.Stdout {
+			logf("unique counts of %s /%d networks written to %s\n", formatCount(len(counts)), f.byPrefix, f.byPrefixOutput)
+		}
+	}
+	if s.geoIP != nil {
+		geo, err := result.State.CountByGeo(s.geoIP)
+		if err != nil {
+			log.Fatalf("failed to look up -geoip-db: %v", err)
+		}
+		reportGeo(geo)
+		if outs.geoIP != nil {
+			err := writeGeoCounts(outs.geoIP, geo)
+			if err == nil {
+				err = outs.geoIP.Close()
 			}
-		} else if c == '.' {
-			if parts >= 3 {
-				return 0, fmt.Errorf("too many octets")
+			if err != nil {
+				log.Fatalf("failed to write -geoip-output: %v", err)
 			}
-			ip |= octet << (24 - shift)
-			octet = 0
-			shift += 8
-			parts++
-		} else {
-			return 0, fmt.Errorf("invalid character in IP")
+			logf("per-country and per-ASN counts written to %s\n", f.geoIPOutput)
+		}
+	}
+	if s.expected != nil {
+		return reportSummaryDiff(f.verifySummary, result.Summary, s.expected)
+	}
+	return true
+}
+
+// reportTotals logs the time and resources the count took and writes the
+// -format json or csv result to stdout.
+func reportTotals(f *countFlags, result *ipcounter.Result, multi *ipcounter.MultiResult, totalElapsed time.Duration) {
+	logf("total time elapsed: %v\n", totalElapsed)
+	resources := measureResources()
+	reportResources(resources)
+	if f.format == "text" {
+		return
+	}
+	var summaries []resultSummary
+	if f.multiple {
+		for i, path := range f.files {
+			summaries = append(summaries, newResultSummary(path, multi.Files[i], multi.Elapsed[i]))
 		}
+		summaries = append(summaries, newResultSummary(totalRow, result, totalElapsed))
+	} else {
+		summaries = append(summaries, newResultSummary(f.fileName, result, totalElapsed))
 	}
-	ip |= octet << (24 - shift)
-	if parts != 3 {
-		return 0, fmt.Errorf("not enough octets")
+	summaries[len(summaries)-1].Resources = &resources
+	if err := writeSummary(os.Stdout, f.format, summaries); err != nil {
+		log.Fatalf("failed to write result: %v", err)
 	}
-	return ip, nil
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// runMerge implements the merge subcommand, the reduce step of a count
+// spread over several machines: each node counts its shard with
+// -save-state, exact or with -mode hll, and merge combines the partials
+// into the unique count of all shards. With -save-state it writes the
+// merged partial too, so that merges can be stacked.
+func runMerge(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fs.BoolVar(&quiet, "quiet", false, "log nothing but errors")
+	format := fs.String("format", "text", "result format on stdout: text (the unique count), or json or csv with the counts")
+	saveState := fs.String("save-state", "", "also write the merged partial to this file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s merge [flags] partial ...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch *format {
+	case "text", "json", "csv":
+	default:
+		log.Fatalf("invalid -format %q: want text, json or csv", *format)
+	}
+	paths, err := expandInputs(fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now()
+	state, err := readStates(paths)
+	if err != nil {
+		log.Fatalf("failed to merge: %v", err)
+	}
+	logf("merged %s partials, %s\n", formatCount(len(paths)), stateKind(state))
+	result := &ipcounter.Result{
+		Unique:      state.Unique(),
+		UniqueIPv6:  state.UniqueIPv6(),
+		Approximate: state.Approximate(),
+	}
+	if state.PrefixLen() < 32 {
+		logf("total unique /%d networks: %s\n", state.PrefixLen(), formatCount(result.Unique))
+	} else {
+		logf("total unique IPv4 addresses: %s\n", formatCount(result.Unique))
+	}
+	logf("total unique IPv6 addresses: %s\n", formatCount(result.UniqueIPv6))
+
+	if *saveState != "" {
+		f, err := os.Create(*saveState)
+		if err != nil {
+			log.Fatalf("failed to create state file: %v", err)
+		}
+		n, err := state.WriteTo(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatalf("failed to write state: %v", err)
+		}
+		logf("state written to %s (%s)\n", *saveState, formatBytes(uint64(n)))
+	}
+
+	elapsed := time.Since(start)
+	resources := measureResources()
+	reportResources(resources)
+	if *format == "text" {
+		fmt.Println(result.Unique + result.UniqueIPv6)
+		return
+	}
+	summary := newResultSummary(totalRow, result, elapsed)
+	summary.Resources = &resources
+	if err := writeSummary(os.Stdout, *format, []resultSummary{summary}); err != nil {
+		log.Fatalf("failed to write result: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// resultSummary is what -format json and csv print to stdout.
+type resultSummary struct {
+	File           string  `json:"file"`
+	Unique         uint64  `json:"unique"`
+	UniqueIPv6     uint64  `json:"unique_ipv6"`
+	Approximate    bool    `json:"approximate"`
+	Lines          int64   `json:"lines"`
+	Invalid        int64   `json:"invalid"`
+	Bytes          int64   `json:"bytes"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// Partial is set when the count was interrupted; CoveredBytes is then
+	// how much of the input it covers.
+	Partial      bool  `json:"partial,omitempty"`
+	CoveredBytes int64 `json:"covered_bytes,omitempty"`
+	// Resources is set on the row of the whole run only.
+	Resources *resourceUsage `json:"resources,omitempty"`
+}
+
+func newResultSummary(file string, result *ipcounter.Result, elapsed time.Duration) resultSummary {
+	s := resultSummary{
+		File:           file,
+		Unique:         result.Unique,
+		UniqueIPv6:     result.UniqueIPv6,
+		Approximate:    result.Approximate,
+		Lines:          result.Lines,
+		Bytes:          result.Bytes,
+		ElapsedSeconds: elapsed.Seconds(),
+		Partial:        result.Partial,
+		CoveredBytes:   result.Covered,
+	}
+	for _, n := range result.Invalid {
+		s.Invalid += n
+	}
+	if elapsed > 0 {
+		s.BytesPerSecond = float64(result.Bytes) / elapsed.Seconds()
+	}
+	return s
+}
+
+// totalRow is the file name of the summary of the union of several files.
+const totalRow = "(total)"
+
+// writeSummary writes summaries as one JSON object per line or as a CSV
+// header and one row each. Numbers are never grouped or scaled, whatever
+// -thousands-sep and -units say, so that they parse.
+func writeSummary(w io.Writer, format string, summaries []resultSummary) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, s := range summaries {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"file", "unique", "unique_ipv6", "approximate", "lines", "invalid", "bytes", "elapsed_seconds", "bytes_per_second",
+			"cpu_user_seconds", "cpu_sys_seconds", "max_rss_bytes", "read_bytes", "read_syscalls", "gc_cycles", "gc_pause_seconds",
+			"partial", "covered_bytes"})
+		for _, s := range summaries {
+			resources := make([]string, 7)
+			if u := s.Resources; u != nil {
+				resources = []string{
+					strconv.FormatFloat(u.UserSeconds, 'f', 3, 64),
+					strconv.FormatFloat(u.SystemSeconds, 'f', 3, 64),
+					strconv.FormatInt(u.MaxRSSBytes, 10),
+					strconv.FormatInt(u.ReadBytes, 10),
+					strconv.FormatInt(u.ReadSyscalls, 10),
+					strconv.FormatUint(uint64(u.GCCycles), 10),
+					strconv.FormatFloat(u.GCPauseSeconds, 'f', 6, 64),
+				}
+			}
+			covered := ""
+			if s.Partial {
+				covered = strconv.FormatInt(s.CoveredBytes, 10)
+			}
+			cw.Write(append(append([]string{
+				s.File,
+				strconv.FormatUint(s.Unique, 10),
+				strconv.FormatUint(s.UniqueIPv6, 10),
+				strconv.FormatBool(s.Approximate),
+				strconv.FormatInt(s.Lines, 10),
+				strconv.FormatInt(s.Invalid, 10),
+				strconv.FormatInt(s.Bytes, 10),
+				strconv.FormatFloat(s.ElapsedSeconds, 'f', 3, 64),
+				strconv.FormatFloat(s.BytesPerSecond, 'f', 0, 64),
+			}, resources...), strconv.FormatBool(s.Partial), covered))
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// readSummary reads a set summary written by -summary.
+func readSummary(path string) (*ipcounter.SetSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ipcounter.ReadSetSummary(f)
+}
+
+// readStates reads the states written by -save-state at paths and merges
+// them into one.
+func readStates(paths []string) (*ipcounter.State, error) {
+	var merged *ipcounter.State
+	for _, path := range paths {
+		state, err := readState(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if merged == nil {
+			merged = state
+		} else if err := merged.Merge(state); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return merged, nil
+}
+
+// stateKind describes what a state holds, for messages.
+func stateKind(s *ipcounter.State) string {
+	if s.Approximate() {
+		return fmt.Sprintf("HyperLogLog sketches of precision %d", s.Precision())
+	}
+	return "exact sets"
+}
+
+func readState(path string) (*ipcounter.State, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ipcounter.ReadState(f)
+}
+
+// writeFrequencies writes "ip,count" lines in address order, networks as
+// "ip/len" with -mask.
+func writeFrequencies(w io.Writer, frequencies map[uint32]uint64, prefixLen string) error {
+	ips := make([]uint32, 0, len(frequencies))
+	for ip := range frequencies {
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+
+	bw := bufio.NewWriter(w)
+	for _, ip := range ips {
+		bw.WriteString(formatIPv4(ip))
+		if prefixLen != "" {
+			bw.WriteString("/" + prefixLen)
+		}
+		bw.WriteByte(',')
+		bw.WriteString(strconv.FormatUint(frequencies[ip], 10))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// writeUnique writes the list of the keys of state to f, gzip-compressed
+// if compress is set, closes f and returns how many keys it wrote.
+func writeUnique(f *os.File, state *ipcounter.State, compress bool) (int64, error) {
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	n, err := state.WriteList(w)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// writePrefixCounts writes the -by-prefix report: a header and a
+// "prefix,unique" line per network.
+func writePrefixCounts(w io.Writer, counts []ipcounter.PrefixCount) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("prefix,unique\n")
+	for _, c := range counts {
+		bw.WriteString(c.Prefix.String())
+		bw.WriteByte(',')
+		bw.WriteString(strconv.FormatUint(c.Unique, 10))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// geoRows returns the rows of one table of geo, "country" or "asn", most
+// unique addresses first: their keys, with "unknown" for what the
+// databases do not know, the AS names and the counts.
+func geoRows(geo *ipcounter.GeoCounts, table string) (keys, names []string, counts []uint64) {
+	type row struct {
+		key, name string
+		unique    uint64
+	}
+	var rows []row
+	switch table {
+	case "country":
+		for country, n := range geo.Countries {
+			if country == "" {
+				country = "unknown"
+			}
+			rows = append(rows, row{country, "", n})
+		}
+	case "asn":
+		for asn, n := range geo.ASNs {
+			key := "AS" + strconv.FormatUint(uint64(asn), 10)
+			if asn == 0 {
+				key = "unknown"
+			}
+			rows = append(rows, row{key, geo.ASNames[asn], n})
+		}
+	}
+	slices.SortFunc(rows, func(a, b row) int {
+		if a.unique != b.unique {
+			return cmp.Compare(b.unique, a.unique)
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	for _, r := range rows {
+		keys = append(keys, r.key)
+		names = append(names, r.name)
+		counts = append(counts, r.unique)
+	}
+	return keys, names, counts
+}
+
+// writeGeoCounts writes the -geoip-output CSV: a header and a
+// "table,key,name,unique" line per country and per ASN.
+func writeGeoCounts(w io.Writer, geo *ipcounter.GeoCounts) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"table", "key", "name", "unique"})
+	for _, table := range []string{"country", "asn"} {
+		keys, names, counts := geoRows(geo, table)
+		for i, key := range keys {
+			cw.Write([]string{table, key, names[i], strconv.FormatUint(counts[i], 10)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
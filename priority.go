@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes understood by ioprio_set(2).
+const (
+	ioprioClassRT   = 1
+	ioprioClassBE   = 2
+	ioprioClassIdle = 3
+)
+
+// ioClass is an I/O scheduling class with its priority level, parsed from
+// "idle", "best-effort[:0-7]" or "realtime[:0-7]".
+type ioClass struct {
+	class int
+	level int
+}
+
+func parseIOClass(s string) (ioClass, error) {
+	name, levelStr, hasLevel := strings.Cut(s, ":")
+
+	var c ioClass
+	switch name {
+	case "idle":
+		if hasLevel {
+			return c, fmt.Errorf("the idle I/O class takes no level")
+		}
+		return ioClass{class: ioprioClassIdle}, nil
+	case "best-effort":
+		c = ioClass{class: ioprioClassBE, level: 4}
+	case "realtime":
+		c = ioClass{class: ioprioClassRT, level: 4}
+	default:
+		return c, fmt.Errorf("unknown I/O class %q (want idle, best-effort or realtime)", name)
+	}
+
+	if hasLevel {
+		level, err := strconv.Atoi(levelStr)
+		if err != nil || level < 0 || level > 7 {
+			return c, fmt.Errorf("invalid I/O priority level %q (want 0-7)", levelStr)
+		}
+		c.level = level
+	}
+	return c, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+// setNice sets the niceness of every thread of the process. On Linux the
+// priority set by setpriority(2) is per thread, and threads the Go runtime
+// starts later inherit it from the thread that creates them.
+func setNice(nice int) error {
+	return forEachThread(func(tid int) error {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	})
+}
+
+// setIONice sets the I/O scheduling class and level of every thread.
+func setIONice(class ioClass) error {
+	prio := class.class<<ioprioClassShift | class.level
+	return forEachThread(func(tid int) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+func forEachThread(fn func(tid int) error) error {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		tid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if err := fn(tid); err != nil {
+			return fmt.Errorf("thread %d: %v", tid, err)
+		}
+	}
+	return nil
+}
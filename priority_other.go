@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func setNice(nice int) error {
+	return errors.New("-nice is only supported on Linux")
+}
+
+func setIONice(class ioClass) error {
+	return errors.New("-ionice is only supported on Linux")
+}
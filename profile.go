@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// profileSummary is what profile -format json prints.
+type profileSummary struct {
+	File           string           `json:"file"`
+	Bytes          int64            `json:"bytes,omitempty"`
+	Compression    string           `json:"compression"`
+	Encrypted      bool             `json:"encrypted"`
+	SampledBytes   int64            `json:"sampled_bytes"`
+	SampledLines   int64            `json:"sampled_lines"`
+	EstimatedLines int64            `json:"estimated_lines,omitempty"`
+	LineEnding     string           `json:"line_ending"`
+	PaddedLines    int64            `json:"padded_lines"`
+	QuotedLines    int64            `json:"quoted_lines"`
+	Format         string           `json:"format"`
+	Delimiter      string           `json:"delimiter,omitempty"`
+	Valid          int64            `json:"valid"`
+	IPv6           int64            `json:"ipv6"`
+	Invalid        map[string]int64 `json:"invalid"`
+	InvalidRate    float64          `json:"invalid_rate"`
+	FirstOctets    []int64          `json:"first_octets"`
+	Distinct       int64            `json:"distinct"`
+	DuplicateRate  float64          `json:"duplicate_rate"`
+	Sorted         bool             `json:"sorted"`
+	Backend        string           `json:"backend"`
+	Flags          []string         `json:"flags"`
+}
+
+// runProfile implements the profile subcommand: it samples an input and
+// reports its format, line endings, invalid lines by cause, first-octet
+// distribution and duplication, with the flags and backend suggested for
+// counting it.
+func runProfile(args []string) {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	fileName := fs.String("file", "", "input to profile, as for the count; \"-\" reads stdin")
+	format := fs.String("format", "text", "report format on stdout: text or json")
+	decryptKey := fs.String("decrypt-key", "", "age identity file to decrypt age-encrypted inputs with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s profile [flags] [-file] input\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	switch {
+	case *fileName == "" && fs.NArg() == 1:
+		*fileName = fs.Arg(0)
+	case *fileName == "" || fs.NArg() != 0:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format != "text" && *format != "json" {
+		log.Fatalf("invalid -format %q: want text or json", *format)
+	}
+
+	var opts []ipcounter.Option
+	if *decryptKey != "" {
+		identities, err := readIdentities(*decryptKey)
+		if err != nil {
+			log.Fatalf("failed to read -decrypt-key: %v", err)
+		}
+		opts = append(opts, ipcounter.WithDecryption(identities...))
+	}
+
+	p, err := ipcounter.Profile(context.Background(), *fileName, opts...)
+	if err != nil {
+		log.Fatalf("failed to profile %s: %v", *fileName, err)
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(newProfileSummary(p)); err != nil {
+			log.Fatalf("failed to write the profile: %v", err)
+		}
+		return
+	}
+	printProfile(p)
+}
+
+func newProfileSummary(p *ipcounter.DatasetProfile) profileSummary {
+	s := profileSummary{
+		File:           p.Path,
+		Bytes:          max(p.Size, 0),
+		Compression:    p.Compression,
+		Encrypted:      p.Encrypted,
+		SampledBytes:   p.SampledBytes,
+		SampledLines:   p.Lines,
+		EstimatedLines: p.EstimatedLines,
+		LineEnding:     lineEnding(p),
+		PaddedLines:    p.PaddedLines,
+		QuotedLines:    p.QuotedLines,
+		Format:         p.Format,
+		Valid:          p.Valid,
+		IPv6:           p.IPv6,
+		Invalid:        p.Invalid,
+		InvalidRate:    p.InvalidRate(),
+		FirstOctets:    p.FirstOctets[:],
+		Distinct:       p.Distinct,
+		DuplicateRate:  p.DuplicateRate(),
+		Sorted:         p.Sorted,
+		Backend:        p.Backend,
+		Flags:          p.Flags,
+	}
+	if p.Column > 0 {
+		s.Delimiter = string(p.Delimiter)
+	}
+	return s
+}
+
+// lineEnding names the line ends of the sampled lines.
+func lineEnding(p *ipcounter.DatasetProfile) string {
+	switch {
+	case p.Lines == 0:
+		return "none"
+	case p.CRLFLines == 0:
+		return "lf"
+	case p.CRLFLines == p.Lines:
+		return "crlf"
+	}
+	return "mixed"
+}
+
+// printProfile writes p for people: the sample, the layout and validity of
+// its lines, the distribution of the first octets in sixteen /4 ranges and
+// the suggestion.
+func printProfile(p *ipcounter.DatasetProfile) {
+	percent := func(n, of int64) string {
+		if of == 0 {
+			return "0%"
+		}
+		return formatFloat(100*float64(n)/float64(of)) + "%"
+	}
+
+	fmt.Printf("file:          %s\n", p.Path)
+	if p.Size >= 0 {
+		fmt.Printf("size:          %s\n", formatBytes(uint64(p.Size)))
+	}
+	encryption := ""
+	if p.Encrypted {
+		encryption = ", age-encrypted"
+	}
+	fmt.Printf("encoding:      %s%s\n", p.Compression, encryption)
+	fmt.Printf("sample:        %s lines, %s from %s window(s)\n",
+		formatCount(p.Lines), formatBytes(uint64(p.SampledBytes)), formatCount(p.Windows))
+	if p.EstimatedLines > 0 {
+		fmt.Printf("est. lines:    %s\n", formatCount(p.EstimatedLines))
+	}
+	fmt.Printf("line endings:  %s (%s CRLF)\n", lineEnding(p), formatCount(p.CRLFLines))
+	fmt.Printf("padding:       %s lines with whitespace, %s with quotes or other padding\n",
+		formatCount(p.PaddedLines), formatCount(p.QuotedLines))
+
+	layout := p.Format
+	if p.Column > 0 {
+		layout += fmt.Sprintf(" delimited by %q", p.Delimiter)
+	}
+	fmt.Printf("format:        %s\n", layout)
+	fmt.Printf("valid:         %s (%s), %s of them IPv6\n", formatCount(p.Valid), percent(p.Valid, p.Lines), formatCount(p.IPv6))
+	fmt.Printf("invalid:       %s (%s)\n", formatCount(p.Lines-p.Valid), percent(p.Lines-p.Valid, p.Lines))
+	reasons := make([]string, 0, len(p.Invalid))
+	for reason := range p.Invalid {
+		reasons = append(reasons, reason)
+	}
+	slices.SortFunc(reasons, func(a, b string) int { return int(p.Invalid[b] - p.Invalid[a]) })
+	for _, reason := range reasons {
+		fmt.Printf("  %-22s %s\n", reason+":", formatCount(p.Invalid[reason]))
+	}
+	fmt.Printf("distinct:      %s in the sample, %s of valid lines repeat one\n",
+		formatCount(p.Distinct), percent(p.Valid-p.Distinct, p.Valid))
+	fmt.Printf("sorted:        %t\n", p.Sorted)
+
+	v4 := p.Valid - p.IPv6
+	if v4 > 0 {
+		fmt.Println("first octets:")
+		for r := 0; r < 256; r += 16 {
+			var n int64
+			for _, c := range p.FirstOctets[r : r+16] {
+				n += c
+			}
+			bar := strings.Repeat("#", int(40*n/v4))
+			fmt.Printf("  %3d-%-3d %7s %s\n", r, r+15, percent(n, v4), bar)
+		}
+	}
+
+	fmt.Printf("backend:       %s\n", p.Backend)
+	fmt.Printf("flags:         %s\n", strings.Join(p.Flags, " "))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+)
+
+// runQuery implements the query subcommand: it reads a state saved with
+// -save-state and either streams the addresses of a prefix to stdout,
+// answering which addresses of a suspicious network were seen, or prints
+// how many there are.
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.BoolVar(&quiet, "quiet", false, "log nothing but errors")
+	list := fs.String("list", "", "write the addresses of the state in this prefix (CIDR notation) to stdout in ascending order")
+	count := fs.String("count", "", "print how many addresses of the state are in this prefix (CIDR notation)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s query [flags] state [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	// Flags may follow the state too, as in "query set.bm -list 203.0.113.0/24".
+	args = parseInterspersed(fs, args)
+	if len(args) != 1 || (*list == "") == (*count == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	arg, name := *list, "-list"
+	if *count != "" {
+		arg, name = *count, "-count"
+	}
+	prefix, err := netip.ParsePrefix(arg)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	prefix = prefix.Masked()
+
+	state, err := readState(args[0])
+	if err != nil {
+		log.Fatalf("failed to read state: %v", err)
+	}
+	if *count != "" {
+		n, err := state.CountPrefix(prefix)
+		if err != nil {
+			log.Fatalf("failed to query %v: %v", prefix, err)
+		}
+		fmt.Println(n)
+		return
+	}
+	n, err := state.WritePrefixList(os.Stdout, prefix)
+	if err != nil {
+		log.Fatalf("failed to list %v: %v", prefix, err)
+	}
+	logf("%s unique addresses in %v\n", formatCount(n), prefix)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// runReplay implements the replay subcommand: it feeds every line of a
+// recording made with -record-invalid through the parser again, configured
+// by its own flags, and prints how each one is classified now.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	trim := fs.Bool("trim", false, "also strip surrounding quotes, no-break spaces and byte order marks from each line before parsing")
+	weighted := fs.Bool("weighted", false, "read \"ip,count\" lines of pre-aggregated input")
+	field := fs.Int("field", 0, "take the address from this field (counted from 1) of lines split at -delimiter")
+	delimiter := fs.String("delimiter", ",", "field delimiter for -field: a single character, tab, or space for runs of whitespace")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] recording\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	parseOpts := []ipcounter.Option{ipcounter.WithTrim(*trim), ipcounter.WithWeights(*weighted)}
+	if *field < 0 {
+		log.Fatalf("invalid -field %d: fields are counted from 1", *field)
+	}
+	if *field != 0 {
+		delim, err := parseDelimiter(*delimiter)
+		if err != nil {
+			log.Fatalf("invalid -delimiter: %v", err)
+		}
+		parseOpts = append(parseOpts, ipcounter.WithField(delim, *field))
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to open recording: %v", err)
+	}
+	defer file.Close()
+
+	recording, err := ipcounter.NewRecordingReader(file)
+	if err != nil {
+		log.Fatalf("%s is not an invalid-line recording", fs.Arg(0))
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	var accepted int64
+	invalid := make(map[error]int64)
+	for {
+		offset, line, err := recording.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("failed to read recording: %v", err)
+		}
+
+		verdict := ""
+		if ip, _, err := ipcounter.ParseLine(line, parseOpts...); err != nil {
+			invalid[err]++
+			verdict = err.Error()
+		} else {
+			accepted++
+			verdict = "ok " + formatIPv4(ip)
+		}
+		fmt.Fprintf(out, "%d\t%s\t%s\n", offset, verdict, strconv.Quote(string(line)))
+	}
+
+	out.Flush()
+	log.Printf("accepted now: %s\n", formatCount(accepted))
+	reportInvalid(invalid)
+}
+
+func formatIPv4(ip uint32) string {
+	return fmt.Sprintf("%d.%d.%d.%d", ip>>24, ip>>16&0xff, ip>>8&0xff, ip&0xff)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"ip-addr-counter/ipcounter"
+)
+
+func reportInvalid(invalid map[error]int64) {
+	var total int64
+	for _, n := range invalid {
+		total += n
+	}
+	logf("invalid lines: %s\n", formatCount(total))
+	for _, reason := range ipcounter.InvalidReasons {
+		if n := invalid[reason]; n > 0 {
+			logf("  %s: %s\n", reason, formatCount(n))
+		}
+	}
+}
+
+// maxSampleLen is how much of a long invalid line reportInvalidSamples
+// shows.
+const maxSampleLen = 120
+
+// reportInvalidSamples logs the invalid lines kept by -show-invalid with
+// their offsets, quoted so that control bytes and stray \r are visible.
+func reportInvalidSamples(samples []ipcounter.InvalidLine) {
+	if len(samples) == 0 {
+		return
+	}
+	logf("first %s invalid lines:\n", formatCount(len(samples)))
+	for _, s := range samples {
+		line, more := s.Line, ""
+		if len(line) > maxSampleLen {
+			line, more = line[:maxSampleLen], fmt.Sprintf(" (%s more bytes)", formatCount(len(s.Line)-maxSampleLen))
+		}
+		logf("  offset %s, %s: %q%s\n", formatCount(s.Offset), s.Reason, line, more)
+	}
+}
+
+// reportProgress logs one line of a running count's progress, followed by
+// the bytes read by each worker when there are several.
+func reportProgress(p ipcounter.Progress) {
+	rate := formatBytes(uint64(p.Rate())) + "/s"
+	if p.Size < 0 {
+		logf("progress: %s read, %s\n", formatBytes(uint64(p.Read)), rate)
+	} else {
+		eta := "unknown"
+		if r := p.Remaining(); r >= 0 {
+			eta = r.Round(time.Second).String()
+		}
+		logf("progress: %s%% (%s of %s), %s, ETA %s\n", formatFloat(100*p.Fraction()),
+			formatBytes(uint64(p.Read)), formatBytes(uint64(p.Size)), rate, eta)
+	}
+	if len(p.Workers) > 1 {
+		workers := make([]string, len(p.Workers))
+		for i, n := range p.Workers {
+			workers[i] = formatBytes(uint64(n))
+		}
+		logf("  per worker: %s\n", strings.Join(workers, ", "))
+	}
+}
+
+// reportSegments logs the estimated unique addresses and lines per segment.
+func reportSegments(size int64, segments []ipcounter.Segment) {
+	logf("unique addresses per %s segment (estimated):\n", formatBytes(uint64(size)))
+	for _, seg := range segments {
+		from, to := formatBytes(uint64(seg.Start)), formatBytes(uint64(seg.End))
+		if math.IsInf(seg.Unique, 1) {
+			logf("  [%s, %s): lines %s, unique: too many to estimate\n", from, to, formatCount(seg.Lines))
+			continue
+		}
+		logf("  [%s, %s): lines %s, unique ~%s, unique/lines %s\n",
+			from, to, formatCount(seg.Lines), formatCount(int64(math.Round(seg.Unique))),
+			formatFloat(seg.Unique/float64(seg.Lines)))
+	}
+}
+
+func reportSpotCheck(c *ipcounter.SpotCheck) {
+	verdict := "PASS"
+	if !c.Passed {
+		verdict = "FAIL"
+	}
+	logf("spot check: %s (%s windows, %s lines, %s unique by reference parser, %s by counter's parser, %s missing from result)\n",
+		verdict, formatCount(c.Windows), formatCount(c.Lines), formatCount(c.ReferenceUnique),
+		formatCount(c.ParserUnique), formatCount(c.MissingInResult))
+}
+
+// reportSummaryDiffLimit caps the /16s listed by reportSummaryDiff.
+const reportSummaryDiffLimit = 20
+
+// reportSummaryDiff compares the summary of this run with the one read from
+// path and reports whether they match. Mismatches are logged even with
+// -quiet.
+func reportSummaryDiff(path string, got, want *ipcounter.SetSummary) bool {
+	if got.Equal(want) {
+		logf("summary matches %s\n", path)
+		return true
+	}
+	diffs := got.Diff(want)
+	if len(diffs) == 0 {
+		log.Printf("summary differs from %s: every /16 holds as many addresses, but the checksums differ\n", path)
+		return false
+	}
+	log.Printf("summary differs from %s in %s /16 regions (this run vs %s):\n", path, formatCount(len(diffs)), path)
+	for _, d := range diffs[:min(len(diffs), reportSummaryDiffLimit)] {
+		log.Printf("  %s: %s vs %s\n", d.Prefix, formatCount(uint64(d.Count)), formatCount(uint64(d.OtherCount)))
+	}
+	if len(diffs) > reportSummaryDiffLimit {
+		log.Printf("  ... and %s more\n", formatCount(len(diffs)-reportSummaryDiffLimit))
+	}
+	return false
+}
+
+// reportFiles logs each file's own counts, tree hash, segments and spot
+// check when several files were counted.
+func reportFiles(files []string, multi *ipcounter.MultiResult, hashName string, segmentBytes int64) {
+	for i, path := range files {
+		r := multi.Files[i]
+		var invalid int64
+		for _, n := range r.Invalid {
+			invalid += n
+		}
+		line := fmt.Sprintf("%s: unique %s", path, formatCount(r.Unique))
+		if r.UniqueIPv6 > 0 {
+			line += fmt.Sprintf(", IPv6 %s", formatCount(r.UniqueIPv6))
+		}
+		line += fmt.Sprintf(", lines %s, invalid %s, %v", formatCount(r.Lines), formatCount(invalid), multi.Elapsed[i].Round(time.Millisecond))
+		logf("%s\n", line)
+		reportInvalidSamples(r.InvalidSamples)
+		if r.Digest != nil {
+			logf("  %s tree hash: %x\n", hashName, r.Digest)
+		}
+		if r.Segments != nil {
+			reportSegments(segmentBytes, r.Segments)
+		}
+		if r.SpotCheck != nil {
+			reportSpotCheck(r.SpotCheck)
+		}
+	}
+}
+
+// reportLabels logs the unique count of each label and the overlap of every
+// pair of labels.
+func reportLabels(labels []ipcounter.LabelResult) {
+	for _, l := range labels {
+		logf("label %s: unique %s\n", l.Label, formatCount(l.Result.Unique+l.Result.UniqueIPv6))
+	}
+	for i, a := range labels {
+		for _, b := range labels[i+1:] {
+			logf("overlap %s & %s: %s\n", a.Label, b.Label, formatCount(a.Overlaps[b.Label]))
+		}
+	}
+}
+
+// reportTop logs the most frequent addresses, or networks with -mask.
+func reportTop(top []ipcounter.TopEntry, approximate bool, prefixLen string) {
+	if approximate {
+		logf("most frequent (counts are count-min sketch upper bounds):\n")
+	} else {
+		logf("most frequent:\n")
+	}
+	for i, e := range top {
+		ip := formatIPv4(e.IP)
+		if prefixLen != "" {
+			ip += "/" + prefixLen
+		}
+		logf("  %d. %s: %s\n", i+1, ip, formatCount(e.Count))
+	}
+}
+
+// geoReportRows is how many countries and ASNs reportGeo logs; the rest
+// are in -geoip-output.
+const geoReportRows = 20
+
+// reportGeo logs the countries and autonomous systems with the most unique
+// addresses.
+func reportGeo(geo *ipcounter.GeoCounts) {
+	report := func(what, table string) {
+		keys, names, counts := geoRows(geo, table)
+		logf("unique addresses by %s (%s):\n", what, formatCount(len(keys)))
+		for i := range keys[:min(len(keys), geoReportRows)] {
+			logf("  %s: %s\n", strings.TrimSpace(keys[i]+" "+names[i]), formatCount(counts[i]))
+		}
+		if len(keys) > geoReportRows {
+			logf("  ... %s more\n", formatCount(len(keys)-geoReportRows))
+		}
+	}
+	if geo.Countries != nil {
+		report("country", "country")
+	}
+	if geo.ASNs != nil {
+		report("autonomous system", "asn")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// resourceUsage is what the process used over its run, for capacity
+// planning. Fields the platform does not report are left at -1.
+type resourceUsage struct {
+	UserSeconds    float64 `json:"cpu_user_seconds"`
+	SystemSeconds  float64 `json:"cpu_sys_seconds"`
+	MaxRSSBytes    int64   `json:"max_rss_bytes"`
+	ReadBytes      int64   `json:"read_bytes"`
+	ReadSyscalls   int64   `json:"read_syscalls"`
+	GCCycles       uint32  `json:"gc_cycles"`
+	GCPauseSeconds float64 `json:"gc_pause_seconds"`
+}
+
+// measureResources reports the usage of the process so far. ReadBytes and
+// ReadSyscalls count read(2) and the like: input scanned from a memory
+// mapping shows up in neither.
+func measureResources() resourceUsage {
+	u := resourceUsage{MaxRSSBytes: -1, ReadBytes: -1, ReadSyscalls: -1}
+	processUsage(&u)
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	u.GCCycles = m.NumGC
+	u.GCPauseSeconds = time.Duration(m.PauseTotalNs).Seconds()
+	return u
+}
+
+func reportResources(u resourceUsage) {
+	logf("resources: CPU %ss user, %ss system; max RSS %s\n",
+		formatFloat(u.UserSeconds), formatFloat(u.SystemSeconds), formatKnownBytes(u.MaxRSSBytes))
+	if u.ReadSyscalls >= 0 {
+		logf("  read %s in %s read calls\n", formatBytes(uint64(u.ReadBytes)), formatCount(u.ReadSyscalls))
+	}
+	logf("  GC: %s cycles, %v paused\n", formatCount(uint64(u.GCCycles)),
+		time.Duration(u.GCPauseSeconds*float64(time.Second)).Round(time.Microsecond))
+}
+
+func formatKnownBytes(n int64) string {
+	if n < 0 {
+		return "unknown"
+	}
+	return formatBytes(uint64(n))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// processUsage fills in the CPU time and peak RSS from getrusage(2) and the
+// read counters from /proc/self/io.
+func processUsage(u *resourceUsage) {
+	var ru syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &ru) == nil {
+		u.UserSeconds = time.Duration(ru.Utime.Nano()).Seconds()
+		u.SystemSeconds = time.Duration(ru.Stime.Nano()).Seconds()
+		u.MaxRSSBytes = int64(ru.Maxrss) << 10
+	}
+
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		name, value, ok := bytes.Cut(sc.Bytes(), []byte(": "))
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch string(name) {
+		case "rchar":
+			u.ReadBytes = n
+		case "syscr":
+			u.ReadSyscalls = n
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package main
+
+// auditArch is AUDIT_ARCH_X86_64, checked by the seccomp filter.
+const auditArch = 0xc000003e
@@ -0,0 +1,4 @@
+package main
+
+// auditArch is AUDIT_ARCH_AARCH64, checked by the seccomp filter.
+const auditArch = 0xc00000b7
@@ -0,0 +1,83 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildCounter builds the command into dir with the extra environment
+// variables and build flags, and returns the binary's path.
+func buildCounter(t *testing.T, dir, name string, env []string, args ...string) string {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	bin := filepath.Join(dir, name)
+	cmd := exec.Command(goTool, append(append([]string{"build", "-o", bin}, args...), ".")...)
+	cmd.Env = append(os.Environ(), env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return bin
+}
+
+// TestSandbox runs -sandbox in binaries built with and without cgo. The
+// remote inputs link net/http, and with it cgo under the default
+// CGO_ENABLED=1, so a binary built that way must refuse -sandbox up front
+// while a pure Go one must count inside it.
+func TestSandbox(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the command")
+	}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(input, []byte("10.0.0.1\n10.0.0.2\n10.0.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("cgo", func(t *testing.T) {
+		bin := buildCounter(t, dir, "cgo", []string{"CGO_ENABLED=1"})
+		out, err := exec.Command(bin, "-sandbox", "-quiet", input).CombinedOutput()
+		if err == nil {
+			// cgo may be unavailable, leaving a pure Go binary.
+			if strings.TrimSpace(string(out)) != "2" {
+				t.Fatalf("counted %q, want 2", out)
+			}
+			return
+		}
+		if !strings.Contains(string(out), errSandboxCgo.Error()) {
+			t.Fatalf("-sandbox failed with %q, want the cgo explanation", out)
+		}
+	})
+
+	for _, build := range []struct {
+		name string
+		env  []string
+		args []string
+	}{
+		{"nocgo", []string{"CGO_ENABLED=0"}, nil},
+		{"netgo", []string{"CGO_ENABLED=1"}, []string{"-tags", "netgo,osusergo"}},
+	} {
+		t.Run(build.name, func(t *testing.T) {
+			bin := buildCounter(t, dir, build.name, build.env, build.args...)
+			out, err := exec.Command(bin, "-sandbox", "-quiet", input).CombinedOutput()
+			if strings.Contains(string(out), "landlock is not available") {
+				t.Skip("landlock is not available")
+			}
+			if err != nil || strings.TrimSpace(string(out)) != "2" {
+				t.Fatalf("-sandbox: %v, output %q, want 2", err, out)
+			}
+
+			out, err = exec.Command(bin, "-sandbox", "-quiet", "http://127.0.0.1:1/input").CombinedOutput()
+			if err == nil || !strings.Contains(string(out), "which a remote input needs") {
+				t.Fatalf("-sandbox with a remote input: %v, output %q, want it refused", err, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import "errors"
+
+var errSandboxUnsupported = errors.New("-sandbox is only supported on Linux amd64 and arm64")
+
+func checkSandbox() error {
+	return errSandboxUnsupported
+}
+
+func enterSandbox() error {
+	return errSandboxUnsupported
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// runSelfTest implements the selftest subcommand: it checks the parsers,
+// bitmap code, decompressors and file formats against reference
+// implementations on this machine, so a binary can be vetted on new
+// hardware before its counts are trusted. It exits non-zero if any check
+// fails.
+func runSelfTest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	seed := fs.Uint64("seed", 0, "seed for the random test inputs; 0 picks one, which is printed so a failure can be reproduced")
+	dir := fs.String("dir", os.TempDir(), "directory for scratch files")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s selftest [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *seed == 0 {
+		*seed = rand.Uint64()
+	}
+	log.Printf("seed: %d\n", *seed)
+
+	failed := 0
+	for _, c := range ipcounter.SelfTest(*seed, *dir) {
+		if c.Err != nil {
+			failed++
+			fmt.Printf("FAIL\t%s: %v\n", c.Name, c.Err)
+			continue
+		}
+		fmt.Printf("ok\t%s (%s cases)\n", c.Name, formatCount(c.Cases))
+	}
+	if failed > 0 {
+		log.Fatalf("%d of the checks failed", failed)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"ip-addr-counter/ipcounter"
+)
+
+// setOperations are the subcommands combining the sets of two inputs, with
+// what their result holds.
+var setOperations = map[string]string{
+	"union":     "in either input",
+	"intersect": "in both inputs",
+	"diff":      "in the first input but not the second",
+}
+
+// runSetOperation implements the union, intersect and diff subcommands: it
+// counts two inputs into exact sets, or reads them from states saved with
+// -save-state, combines the sets and prints how many addresses the result
+// holds, writing them to -list if given.
+func runSetOperation(op string, args []string) {
+	fs := flag.NewFlagSet(op, flag.ExitOnError)
+	fs.BoolVar(&quiet, "quiet", false, "log nothing but errors")
+	format := fs.String("format", "text", "result format on stdout: text (the count), or json or csv with the counts")
+	list := fs.String("list", "", "also write the addresses of the result in ascending order to this file, gzip-compressed if it ends in .gz")
+	workers := fs.Int("workers", 0, "number of scan workers per input; 0 uses one per CPU")
+	mode := fs.String("mode", "exact", "counting mode: exact or roaring (compressed bitmaps for inputs with few distinct addresses)")
+	trim := fs.Bool("trim", false, "also strip surrounding quotes, no-break spaces and byte order marks from each line before parsing")
+	ipv6 := fs.Bool("ipv6", false, "also take IPv6 addresses into the sets")
+	weighted := fs.Bool("weighted", false, "read \"ip,count\" lines of pre-aggregated input")
+	field := fs.Int("field", 0, "take the address from this field (counted from 1) of lines split at -delimiter")
+	delimiter := fs.String("delimiter", ",", "field delimiter for -field: a single character, tab, or space for runs of whitespace")
+	extract := fs.String("extract", "", "take the address from raw log lines: a preset ("+strings.Join(ipcounter.ExtractPresets(), ", ")+") or regex:PATTERN")
+	mask := fs.Int("mask", 32, "combine networks of this prefix length instead of addresses")
+	decryptKey := fs.String("decrypt-key", "", "age identity file to decrypt age-encrypted inputs with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] first second\n", os.Args[0], op)
+		fmt.Fprintf(fs.Output(), "Counts the addresses %s. Either input may be a state saved with -save-state.\n", setOperations[op])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch *format {
+	case "text", "json", "csv":
+	default:
+		log.Fatalf("invalid -format %q: want text, json or csv", *format)
+	}
+
+	opts := []ipcounter.Option{
+		ipcounter.WithState(true),
+		ipcounter.WithTrim(*trim),
+		ipcounter.WithIPv6(*ipv6),
+		ipcounter.WithWeights(*weighted),
+	}
+	numWorkers, err := workerCount(*workers, 0)
+	if err != nil {
+		log.Fatalf("invalid -workers: %v", err)
+	}
+	opts = append(opts, ipcounter.WithWorkers(numWorkers))
+	switch *mode {
+	case "exact":
+	case "roaring":
+		opts = append(opts, ipcounter.WithRoaring(true))
+	default:
+		log.Fatalf("invalid -mode %q: want exact or roaring", *mode)
+	}
+	if *mask < 0 || *mask > 32 {
+		log.Fatalf("invalid -mask %d: want a prefix length between 0 and 32", *mask)
+	}
+	opts = append(opts, ipcounter.WithMask(*mask))
+	if *field < 0 {
+		log.Fatalf("invalid -field %d: fields are counted from 1", *field)
+	}
+	if *field != 0 {
+		delim, err := parseDelimiter(*delimiter)
+		if err != nil {
+			log.Fatalf("invalid -delimiter: %v", err)
+		}
+		opts = append(opts, ipcounter.WithField(delim, *field))
+	}
+	if *extract != "" {
+		re, err := parseExtract(*extract)
+		if err != nil {
+			log.Fatalf("invalid -extract: %v", err)
+		}
+		opts = append(opts, ipcounter.WithExtract(re))
+	}
+	if *decryptKey != "" {
+		identities, err := readIdentities(*decryptKey)
+		if err != nil {
+			log.Fatalf("failed to read -decrypt-key: %v", err)
+		}
+		opts = append(opts, ipcounter.WithDecryption(identities...))
+	}
+	if fs.Arg(0) == "-" && fs.Arg(1) == "-" {
+		log.Fatalf("stdin (\"-\") can be only one of the inputs")
+	}
+
+	var listOut *os.File
+	if *list != "" {
+		if listOut, err = os.Create(*list); err != nil {
+			log.Fatalf("failed to create -list file: %v", err)
+		}
+		defer listOut.Close()
+	}
+
+	start := time.Now()
+	ctx := context.Background()
+	counter := ipcounter.New(opts...)
+	var sets [2]*ipcounter.State
+	for i, path := range fs.Args() {
+		if sets[i], err = loadSet(ctx, counter, path, *mask); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		logf("%s: %s unique IPv4, %s unique IPv6\n", path, formatCount(sets[i].Unique()), formatCount(sets[i].UniqueIPv6()))
+	}
+
+	set := sets[0]
+	switch op {
+	case "union":
+		err = set.Merge(sets[1])
+	case "intersect":
+		err = set.Intersect(sets[1])
+	case "diff":
+		err = set.Subtract(sets[1])
+	}
+	if err != nil {
+		log.Fatalf("failed to combine the inputs: %v", err)
+	}
+	result := &ipcounter.Result{Unique: set.Unique(), UniqueIPv6: set.UniqueIPv6()}
+	logf("%s: %s unique IPv4, %s unique IPv6 %s\n", op, formatCount(result.Unique), formatCount(result.UniqueIPv6), setOperations[op])
+
+	if listOut != nil {
+		n, err := writeUnique(listOut, set, strings.HasSuffix(*list, ".gz"))
+		if err != nil {
+			log.Fatalf("failed to write -list: %v", err)
+		}
+		logf("%s addresses written to %s\n", formatCount(n), *list)
+	}
+
+	elapsed := time.Since(start)
+	if *format == "text" {
+		fmt.Println(result.Unique + result.UniqueIPv6)
+		return
+	}
+	summary := newResultSummary(op, result, elapsed)
+	if err := writeSummary(os.Stdout, *format, []resultSummary{summary}); err != nil {
+		log.Fatalf("failed to write result: %v", err)
+	}
+}
+
+// loadSet reads the state saved at path or, if path is not a saved state,
+// counts it into one. Saved states must hold exact keys of prefixLen.
+func loadSet(ctx context.Context, counter *ipcounter.Counter, path string, prefixLen int) (*ipcounter.State, error) {
+	if path == "-" {
+		result, err := counter.RunReader(ctx, os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		reportInvalid(result.Invalid)
+		return result.State, nil
+	}
+	if !ipcounter.IsRemote(path) {
+		state, err := readState(path)
+		switch {
+		case err == nil && state.Approximate():
+			return nil, errors.New("saved HyperLogLog sketches hold no addresses to combine")
+		case err == nil && state.PrefixLen() != prefixLen:
+			return nil, fmt.Errorf("the saved state holds /%d keys but -mask is %d", state.PrefixLen(), prefixLen)
+		case err == nil:
+			return state, nil
+		case !errors.Is(err, ipcounter.ErrNotState):
+			return nil, err
+		}
+	}
+	result, err := counter.Run(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	reportInvalid(result.Invalid)
+	return result.State, nil
+}
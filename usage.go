@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// hiddenFlags are experimental flags left out of -help.
+var hiddenFlags = map[string]bool{
+	"bitmap-layout": true,
+}
+
+// usage is flag.Usage without the hidden flags.
+func usage() {
+	printUsage(flag.CommandLine)
+}
+
+// printUsage prints the flags of fs but the hidden ones the way
+// flag.PrintDefaults does, by copying them into a FlagSet of their own:
+// zero defaults are left out and only string defaults are quoted.
+func printUsage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage of %s: [flags] [file or glob ...]\n", os.Args[0])
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(out)
+	fs.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		visible.Var(f.Value, f.Name, f.Usage)
+		// Var takes the default from the current value, which parsing
+		// may have changed already.
+		visible.Lookup(f.Name).DefValue = f.DefValue
+	})
+	visible.PrintDefaults()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"ip-addr-counter/ipcounter"
+)
+
+func TestPrintUsage(t *testing.T) {
+	fs := flag.NewFlagSet("ip-addr-counter", flag.ContinueOnError)
+	var out bytes.Buffer
+	fs.SetOutput(&out)
+	fs.Int("by-prefix", 0, "prefix length")
+	fs.Int("decimals", 1, "decimal places")
+	fs.String("format", "text", "result format")
+	fs.String("output", "", "output file")
+	fs.Bool("quiet", false, "log nothing")
+	fs.Duration("progress", 0, "progress interval")
+	var includeCIDR prefixList
+	fs.Var(&includeCIDR, "include-cidr", "prefixes")
+	var layout ipcounter.Layout
+	fs.Var(&layout, "bitmap-layout", "bit index mapping")
+	fs.Duration("timeout", time.Minute, "timeout")
+	if err := fs.Parse([]string{"-decimals", "3", "-format", "json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	printUsage(fs)
+	got := out.String()
+	for _, want := range []string{
+		"  -by-prefix int\n    \tprefix length\n",
+		"  -decimals int\n    \tdecimal places (default 1)\n",
+		"  -format string\n    \tresult format (default \"text\")\n",
+		"  -output string\n    \toutput file\n",
+		"  -quiet\n    \tlog nothing\n",
+		"  -progress duration\n    \tprogress interval\n",
+		"  -include-cidr value\n    \tprefixes\n",
+		"  -timeout duration\n    \ttimeout (default 1m0s)\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("usage lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "bitmap-layout") {
+		t.Errorf("usage lists the hidden -bitmap-layout:\n%s", got)
+	}
+}